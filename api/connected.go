@@ -0,0 +1,294 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/RangelReale/osin"
+	"github.com/gorilla/mux"
+	tpClients "github.com/tidepool-org/go-common/clients"
+
+	"../models"
+)
+
+//connectedApp is an app the user has given access to their tidepool account
+type connectedApp struct {
+	ClientId string `json:"client_id"`
+	AppName  string `json:"app_name"`
+	Scope    string `json:"scope"`
+	//unix times of when the user last granted access and when a token the app has was last used
+	GrantedAt  int64 `json:"granted_at"`
+	LastUsedAt int64 `json:"last_used_at,omitempty"`
+}
+
+const (
+	error_session_required = "a tidepool session for the user is required"
+	error_app_not_found    = "the app isn't one the user has given access to"
+	connected_date_format  = "2 Jan 2006"
+	//how stale when the app last used what it was given can be, so checking a token isn't always a write
+	consent_used_interval = 5 * time.Minute
+)
+
+//the user the tidepool session given in the header is for, servers aren't users
+func (o *OAuthApi) sessionUser(r *http.Request) string {
+	if token := r.Header.Get(tidepool_session_token); token != "" {
+		if td := o.userApi.CheckToken(token); td != nil && td.IsServer == false {
+			return td.UserID
+		}
+	}
+	return ""
+}
+
+//the user can see when the app last used what they gave it
+func (o *OAuthApi) tokenUsed(access *osin.AccessData) {
+	//an app acting as itself isn't connected to anyone, nor was it when its tokens were for its client_id
+	if userId := authorizingUser(access); userId != "" && userId != access.Client.GetId() {
+		now := time.Now()
+		if err := o.storage.SetConsentUsed(userId, access.Client.GetId(), now, now.Add(-consent_used_interval)); err != nil {
+			log.Printf("tokenUsed: error[%s] for client[%s]", err.Error(), access.Client.GetId())
+		}
+	}
+}
+
+//the apps the user has given access to, both those they consented to and those with tokens from before consent was kept
+func (o *OAuthApi) loadConnectedApps(userId string) ([]*connectedApp, error) {
+
+	consents, err := o.storage.LoadUserConsents(userId)
+	if err != nil {
+		return nil, err
+	}
+	accesses, err := o.storage.LoadUserAccesses(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	apps := make(map[string]*connectedApp)
+	consented := make(map[string]bool)
+	for _, consent := range consents {
+		app := &connectedApp{ClientId: consent.ClientId, Scope: consent.Scope, GrantedAt: consent.UpdatedAt.Unix()}
+		if consent.LastUsedAt.IsZero() == false {
+			app.LastUsedAt = consent.LastUsedAt.Unix()
+		}
+		apps[consent.ClientId] = app
+		consented[consent.ClientId] = true
+	}
+	for _, access := range accesses {
+		//the tokens apps are given as themselves for their developer weren't given by the developer
+		if authorizingUser(access) == "" {
+			continue
+		}
+		clientId := access.Client.GetId()
+		app, ok := apps[clientId]
+		if ok == false {
+			app = &connectedApp{ClientId: clientId, GrantedAt: access.CreatedAt.Unix()}
+			apps[clientId] = app
+		}
+		if consented[clientId] == false {
+			if access.CreatedAt.Unix() < app.GrantedAt {
+				app.GrantedAt = access.CreatedAt.Unix()
+			}
+			for _, scope := range splitScopes(access.Scope) {
+				if hasScope(app.Scope, scope) == false {
+					app.Scope = joinScope(app.Scope, scope)
+				}
+			}
+		}
+		//getting or refreshing a token is using it too
+		if access.CreatedAt.Unix() > app.LastUsedAt {
+			app.LastUsedAt = access.CreatedAt.Unix()
+		}
+	}
+
+	ids := make([]string, 0, len(apps))
+	for id := range apps {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	connected := make([]*connectedApp, 0, len(ids))
+	for _, id := range ids {
+		app := apps[id]
+		app.AppName = app.ClientId
+		if client, err := o.storage.GetClient(id); err == nil {
+			if ud, ok := client.GetUserData().(map[string]interface{}); ok {
+				if name, ok := ud[userdata_app_name].(string); ok && name != "" {
+					app.AppName = name
+				}
+			}
+		}
+		connected = append(connected, app)
+	}
+	return connected, nil
+}
+
+func joinScope(scope, another string) string {
+	if scope == "" {
+		return another
+	}
+	return scope + "," + another
+}
+
+//remove all the user gave the app, its tokens, its permissons and their consent so they are asked again
+func (o *OAuthApi) disconnect(userId, clientId string, r *http.Request) error {
+
+	if err := o.storage.RemoveUserGrants(userId, clientId); err != nil {
+		log.Printf("disconnect: error[%s] removing the tokens", err.Error())
+		return err
+	}
+	if _, err := o.permsApi.SetPermissions(clientId, userId, tpClients.Permissions{}); err != nil {
+		log.Printf("disconnect: err %v withdrawing the permissons", err)
+		return err
+	}
+	if err := o.storage.RemoveConsent(userId, clientId); err != nil {
+		log.Printf("disconnect: error[%s] removing the consent", err.Error())
+		return err
+	}
+	log.Printf("disconnect: app[%s] disconnected by user[%s]", clientId, userId)
+	o.audit(models.AuditAppDisconnected, clientId, userId, "", r)
+	return nil
+}
+
+//the apps the user has connected with, the user is given by their tidepool session
+func (o *OAuthApi) connectedApps(w http.ResponseWriter, r *http.Request) {
+
+	resp := o.oauthServer.NewResponse()
+	defer resp.Close()
+
+	userId := o.sessionUser(r)
+	if userId == "" {
+		log.Printf("connectedApps: error[%s]", error_session_required)
+		resp.SetError(error_invalid_token, error_session_required)
+		resp.StatusCode = http.StatusUnauthorized
+		osin.OutputJSON(resp, w, r)
+		return
+	}
+
+	apps, err := o.loadConnectedApps(userId)
+	if err != nil {
+		log.Printf("connectedApps: error[%s]", err.Error())
+		resp.SetError(osin.E_SERVER_ERROR, error_oauth_service)
+		resp.StatusCode = http.StatusInternalServerError
+		osin.OutputJSON(resp, w, r)
+		return
+	}
+	resp.Output["apps"] = apps
+	osin.OutputJSON(resp, w, r)
+}
+
+//the user disconnects the app, the user is given by their tidepool session
+func (o *OAuthApi) disconnectApp(w http.ResponseWriter, r *http.Request) {
+
+	resp := o.oauthServer.NewResponse()
+	defer resp.Close()
+
+	userId := o.sessionUser(r)
+	if userId == "" {
+		log.Printf("disconnectApp: error[%s]", error_session_required)
+		resp.SetError(error_invalid_token, error_session_required)
+		resp.StatusCode = http.StatusUnauthorized
+		osin.OutputJSON(resp, w, r)
+		return
+	}
+
+	if o.isConnected(userId, mux.Vars(r)["client_id"]) == false {
+		resp.SetError(osin.E_INVALID_REQUEST, error_app_not_found)
+		resp.StatusCode = http.StatusNotFound
+		osin.OutputJSON(resp, w, r)
+		return
+	}
+	if err := o.disconnect(userId, mux.Vars(r)["client_id"], r); err != nil {
+		resp.SetError(osin.E_SERVER_ERROR, error_oauth_service)
+		resp.StatusCode = http.StatusInternalServerError
+	}
+	osin.OutputJSON(resp, w, r)
+}
+
+//only apps the user is connected with can be disconnected
+func (o *OAuthApi) isConnected(userId, clientId string) bool {
+	apps, err := o.loadConnectedApps(userId)
+	if err != nil {
+		log.Printf("isConnected: error[%s]", err.Error())
+		return false
+	}
+	for i := range apps {
+		if apps[i].ClientId == clientId {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *OAuthApi) showConnectedLogin(w http.ResponseWriter, r *http.Request, statusCode int, errorMessage string) {
+	_, t := o.messages(r)
+	o.render(w, r, statusCode, page_connected_login, details{"Error": t.text(errorMessage)})
+}
+
+//the forms carry a handle for the user's login so they don't login again to disconnect an app
+func (o *OAuthApi) showConnectedApps(w http.ResponseWriter, r *http.Request, userId string, apps []*connectedApp) {
+	handle, err := o.issueLoginHandle(userId, purpose_connected)
+	if err != nil {
+		o.showError(w, r, error_oauth_service, http.StatusInternalServerError)
+		return
+	}
+	_, t := o.messages(r)
+	shown := make([]details, len(apps))
+	for i, app := range apps {
+		lastUsed := ""
+		if app.LastUsedAt > 0 {
+			lastUsed = time.Unix(app.LastUsedAt, 0).Format(connected_date_format)
+		}
+		shown[i] = details{
+			"ClientId":   app.ClientId,
+			"AppName":    app.AppName,
+			"Scopes":     grantOptions(t, knownScopes(app.Scope)),
+			"GrantedAt":  time.Unix(app.GrantedAt, 0).Format(connected_date_format),
+			"LastUsedAt": lastUsed,
+		}
+	}
+	o.render(w, r, http.StatusOK, page_connected_apps, details{"LoginHandle": handle, "Apps": shown})
+}
+
+//the page the user logs in to see and disconnect the apps they have connected with
+func (o *OAuthApi) connected(w http.ResponseWriter, r *http.Request) {
+
+	r.ParseForm()
+
+	if r.Method != "POST" {
+		o.showConnectedLogin(w, r, http.StatusOK, "")
+		return
+	}
+	if o.checkCSRF(w, r) == false {
+		return
+	}
+
+	userId, err := o.identifyUser(r, purpose_connected)
+	if err != nil {
+		o.showConnectedLogin(w, r, loginFailedStatus(w, err), err.Error())
+		return
+	}
+	if userId == "" {
+		o.showConnectedLogin(w, r, http.StatusOK, "")
+		return
+	}
+
+	if clientId := r.Form.Get("client_id"); r.Form.Get("disconnect") != "" && clientId != "" {
+		if o.isConnected(userId, clientId) == false {
+			o.showError(w, r, error_app_not_found, http.StatusNotFound)
+			return
+		}
+		if err := o.disconnect(userId, clientId, r); err != nil {
+			o.showError(w, r, error_oauth_service, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	apps, err := o.loadConnectedApps(userId)
+	if err != nil {
+		log.Printf("connected: error[%s]", err.Error())
+		o.showError(w, r, error_oauth_service, http.StatusInternalServerError)
+		return
+	}
+	o.showConnectedApps(w, r, userId, apps)
+}
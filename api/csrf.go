@@ -0,0 +1,67 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const (
+	//every form we show carries the token of the cookie it was shown with
+	csrf_cookie  = "tidepool_oauth_csrf"
+	csrf_field   = "csrf_token"
+	csrf_bytes   = 32
+	csrf_max_age = 3600
+
+	error_csrf = "sorry but that page has expired or wasn't one of ours, please go back, reload the page and try again"
+)
+
+//the token for the forms on the page, the one of the cookie the user already has or a new one
+//the cookie is given again each time so it lasts as long as they are using the pages
+func (o *OAuthApi) csrfToken(w http.ResponseWriter, r *http.Request) string {
+	token := ""
+	if cookie, err := r.Cookie(csrf_cookie); err == nil && len(cookie.Value) == hex.EncodedLen(csrf_bytes) {
+		token = cookie.Value
+	} else {
+		random := make([]byte, csrf_bytes)
+		if _, err := rand.Read(random); err != nil {
+			log.Printf("csrfToken: error[%s]", err.Error())
+			return ""
+		}
+		token = hex.EncodeToString(random)
+		//anything else shown for the request uses the same token
+		r.AddCookie(&http.Cookie{Name: csrf_cookie, Value: token})
+	}
+
+	path := o.prefix
+	if path == "" {
+		path = "/"
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrf_cookie,
+		Value:    token,
+		Path:     path,
+		MaxAge:   csrf_max_age,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(o.baseUrl(), "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return token
+}
+
+//a form posted to us must carry the token of its cookie, another site can post a form to us but can't read the cookie
+func (o *OAuthApi) checkCSRF(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "POST" {
+		return true
+	}
+	if cookie, err := r.Cookie(csrf_cookie); err == nil && cookie.Value != "" &&
+		subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(r.PostFormValue(csrf_field))) == 1 {
+		return true
+	}
+	log.Printf("checkCSRF: error[%s] for [%s]", error_csrf, r.URL.Path)
+	o.showError(w, r, error_csrf, http.StatusForbidden)
+	return false
+}
@@ -0,0 +1,408 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/RangelReale/osin"
+	tpClients "github.com/tidepool-org/go-common/clients"
+
+	"../clients"
+	"../models"
+)
+
+const (
+	error_app_details       = "sorry but your application needs a name, at least one redirect_uri and one of the permissons"
+	error_developer_app     = "sorry but that application isn't one of yours"
+	error_no_secret         = "sorry but your application can't keep a secret so doesn't have one to change"
+	msg_secret_rotated      = "Your application has a new client_secret, the old one can be used until %s"
+	msg_secret_revoked      = "The old client_secret of your application can no longer be used"
+	developerPostAction     = "developer"
+	developer_action_create = "create"
+	developer_action_update = "update"
+	developer_action_delete = "delete"
+	developer_action_rotate = "rotate"
+	developer_action_revoke = "revoke_secret"
+
+	//osin is given this to allow a client more than one redirect_uri
+	redirect_uri_separator = " "
+)
+
+//the redirect_uris given one per line, or on the one line separated by spaces
+func formRedirectUris(form url.Values) string {
+	return strings.Join(strings.Fields(form.Get("uri")), redirect_uri_separator)
+}
+
+//the app as given on the form with a new client_id and, unless it can't keep one, a secret
+func (o *OAuthApi) newClient(developerId string, form url.Values) (*osin.DefaultClient, string) {
+
+	name, uris, scopes := form.Get("usr_name"), formRedirectUris(form), selectedScopes(form)
+	if name == "" || uris == "" || scopes == "" {
+		return nil, error_app_details
+	}
+
+	//public clients can't keep a secret so don't get one
+	public := form.Get("public") != ""
+	secret := ""
+	if public == false {
+		var err error
+		if secret, err = o.secretGen.Generate(); err != nil {
+			log.Printf("newClient: error generating the secret: %s", err.Error())
+			return nil, error_generic
+		}
+	}
+
+	return &osin.DefaultClient{
+		Id:          uuid.New(),
+		Secret:      secret,
+		RedirectUri: uris,
+		UserData: map[string]interface{}{
+			clients.UserDataDeveloperId: developerId,
+			userdata_app_name:           name,
+			userdata_require_pkce:       public || form.Get("require_pkce") != "",
+			//a client that can't keep a secret can't authenticate as itself
+			userdata_client_credentials: public == false && form.Get("client_credentials") != "",
+			userdata_scope:              scopes,
+		},
+	}, ""
+}
+
+//the clients that belong to the developer, apps signed up before developers had their own account are their own developer
+func (o *OAuthApi) developerClients(developerId string) ([]osin.Client, error) {
+
+	found, err := o.storage.LoadDeveloperClients(developerId)
+	if err != nil {
+		return nil, err
+	}
+	if own, err := o.storage.GetClient(developerId); err == nil && isOwnDeveloper(own) {
+		found = append(found, own)
+	}
+	sort.Sort(byAppName(found))
+	return found, nil
+}
+
+//an app signed up when each had its own tidepool account which its client_id is
+func isOwnDeveloper(client osin.Client) bool {
+	ud, ok := client.GetUserData().(map[string]interface{})
+	return ok && ud[clients.UserDataDeveloperId] == nil
+}
+
+//the developer's client, nil when there is no such client or it isn't theirs
+func (o *OAuthApi) developerClient(developerId, clientId string) osin.Client {
+	client, err := o.storage.GetClient(clientId)
+	if err != nil {
+		return nil
+	}
+	if ud, ok := client.GetUserData().(map[string]interface{}); ok && ud[clients.UserDataDeveloperId] == developerId {
+		return client
+	}
+	if clientId == developerId && isOwnDeveloper(client) {
+		return client
+	}
+	return nil
+}
+
+type byAppName []osin.Client
+
+func (c byAppName) Len() int           { return len(c) }
+func (c byAppName) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c byAppName) Less(i, j int) bool { return appName(c[i]) < appName(c[j]) }
+
+func appName(client osin.Client) string {
+	if ud, ok := client.GetUserData().(map[string]interface{}); ok {
+		if name, ok := ud[userdata_app_name].(string); ok {
+			return name
+		}
+	}
+	return client.GetId()
+}
+
+//a copy of the client with its own user data that can be changed and saved
+func copyClient(client osin.Client) (*osin.DefaultClient, map[string]interface{}) {
+	copied := &osin.DefaultClient{}
+	copied.CopyFrom(client)
+	ud := map[string]interface{}{}
+	if current, ok := client.GetUserData().(map[string]interface{}); ok {
+		for key, value := range current {
+			ud[key] = value
+		}
+	}
+	copied.UserData = ud
+	return copied, ud
+}
+
+//the name, redirect_uris and scopes can be changed, the scopes the app no longer has are withdrawn from its users
+//and users are asked for those it has gained when they next authorize it
+func (o *OAuthApi) updateClient(client osin.Client, form url.Values) string {
+
+	name, uris, scopes := form.Get("usr_name"), formRedirectUris(form), selectedScopes(form)
+	if name == "" || uris == "" || scopes == "" {
+		return error_app_details
+	}
+
+	updated, ud := copyClient(client)
+	ud[userdata_app_name] = name
+	ud[userdata_scope] = scopes
+	updated.RedirectUri = uris
+
+	if err := o.storage.SetClient(updated.Id, updated); err != nil {
+		log.Printf("updateClient: error[%s] saving client[%s]", err.Error(), updated.Id)
+		return error_generic
+	}
+	if err := o.withdrawScopes(updated.Id, clientScopes(client), scopes); err != nil {
+		return error_generic
+	}
+	return ""
+}
+
+//the client can no longer ask for the scopes it had but doesn't now, so each user's consent and permissons are cut back to
+//what it still has and the codes and tokens carrying what it has lost are revoked
+func (o *OAuthApi) withdrawScopes(clientId, previous, current string) error {
+
+	var dropped []string
+	for _, scope := range splitScopes(previous) {
+		if hasScope(current, scope) == false {
+			dropped = append(dropped, scope)
+		}
+	}
+	if len(dropped) == 0 {
+		return nil
+	}
+
+	consents, err := o.storage.LoadClientConsents(clientId)
+	if err != nil {
+		log.Printf("withdrawScopes: error[%s] loading the consents", err.Error())
+		return err
+	}
+	for _, consent := range consents {
+		var kept []string
+		for _, scope := range splitScopes(consent.Scope) {
+			if hasScope(current, scope) {
+				kept = append(kept, scope)
+			}
+		}
+		if len(kept) == len(splitScopes(consent.Scope)) {
+			continue
+		}
+		if len(kept) == 0 {
+			if _, err := o.permsApi.SetPermissions(clientId, consent.UserId, tpClients.Permissions{}); err != nil {
+				log.Printf("withdrawScopes: err %v withdrawing the permissons of user[%s]", err, consent.UserId)
+				return err
+			}
+			if err := o.storage.RemoveConsent(consent.UserId, clientId); err != nil {
+				log.Printf("withdrawScopes: error[%s] removing the consent of user[%s]", err.Error(), consent.UserId)
+				return err
+			}
+			continue
+		}
+		consent.Scope = strings.Join(kept, ",")
+		if o.applyPermissons(consent.UserId, clientId, consent.Scope) == false {
+			log.Printf("withdrawScopes: error[%s] for user[%s]", error_applying_permissons, consent.UserId)
+			return errors.New(error_applying_permissons)
+		}
+		if err := o.storage.SaveConsent(consent); err != nil {
+			log.Printf("withdrawScopes: error[%s] saving the consent of user[%s]", err.Error(), consent.UserId)
+			return err
+		}
+	}
+	if err := o.storage.RemoveScopeGrants(clientId, dropped); err != nil {
+		log.Printf("withdrawScopes: error[%s] revoking the grants", err.Error())
+		return err
+	}
+	log.Printf("withdrawScopes: scopes%v withdrawn from client[%s]", dropped, clientId)
+	return nil
+}
+
+//the client gets a new secret, the one it had can still be used for the grace period so the app can be updated
+func (o *OAuthApi) rotateSecret(client osin.Client) (*osin.DefaultClient, time.Time, string) {
+
+	if client.GetSecret() == "" {
+		return nil, time.Time{}, error_no_secret
+	}
+	secret, err := o.secretGen.Generate()
+	if err != nil {
+		log.Printf("rotateSecret: error generating the secret: %s", err.Error())
+		return nil, time.Time{}, error_generic
+	}
+
+	expiresAt := time.Now().Add(o.GetSecretGracePeriod())
+	rotated, ud := copyClient(client)
+	//the secret is kept as it was stored, the storage hashes it when it is yet to be upgraded
+	ud[clients.UserDataPreviousSecret] = client.GetSecret()
+	ud[clients.UserDataPreviousSecretExpiresAt] = expiresAt
+	rotated.Secret = secret
+
+	if err := o.storage.SetClient(rotated.Id, rotated); err != nil {
+		log.Printf("rotateSecret: error[%s] saving client[%s]", err.Error(), rotated.Id)
+		return nil, time.Time{}, error_generic
+	}
+	//the new secret is only ever shown the once
+	return rotated, expiresAt, ""
+}
+
+//the secret from before the rotation stops working straight away e.g. when it has been leaked
+func (o *OAuthApi) revokePreviousSecret(client osin.Client) string {
+
+	revoked, ud := copyClient(client)
+	delete(ud, clients.UserDataPreviousSecret)
+	delete(ud, clients.UserDataPreviousSecretExpiresAt)
+
+	if err := o.storage.SetClient(revoked.Id, revoked); err != nil {
+		log.Printf("revokePreviousSecret: error[%s] saving client[%s]", err.Error(), revoked.Id)
+		return error_generic
+	}
+	return ""
+}
+
+//the app is gone along with all its tokens and the permissons users gave it
+func (o *OAuthApi) deleteClient(client osin.Client) string {
+
+	consents, err := o.storage.LoadClientConsents(client.GetId())
+	if err != nil {
+		log.Printf("deleteClient: error[%s] loading the consents", err.Error())
+		return error_generic
+	}
+	for i := range consents {
+		if _, err := o.permsApi.SetPermissions(client.GetId(), consents[i].UserId, tpClients.Permissions{}); err != nil {
+			log.Printf("deleteClient: err %v withdrawing the permissons of user[%s]", err, consents[i].UserId)
+			return error_generic
+		}
+	}
+	if err := o.storage.RemoveClient(client.GetId()); err != nil {
+		log.Printf("deleteClient: error[%s] removing client[%s]", err.Error(), client.GetId())
+		return error_generic
+	}
+	log.Printf("deleteClient: client[%s] deleted", client.GetId())
+	return ""
+}
+
+func (o *OAuthApi) showDeveloperLogin(w http.ResponseWriter, r *http.Request, statusCode int, errorMessage string) {
+	_, t := o.messages(r)
+	o.render(w, r, statusCode, page_developer_login, details{"Error": t.text(errorMessage)})
+}
+
+//the apps of the developer, along with what happened to the one they changed and its new credentials when it has them
+//the forms carry a handle for the developer's login so they don't login again for each change
+func (o *OAuthApi) showDeveloperApps(w http.ResponseWriter, r *http.Request, developerId string, apps []osin.Client, notice string, credentials *osin.DefaultClient, statusCode int, errorMessage string) {
+	handle, err := o.issueLoginHandle(developerId, purpose_developer)
+	if err != nil {
+		o.showError(w, r, error_oauth_service, http.StatusInternalServerError)
+		return
+	}
+	_, t := o.messages(r)
+	shown := make([]details, len(apps))
+	for i, app := range apps {
+		ud, _ := app.GetUserData().(map[string]interface{})
+		registered, _ := ud[userdata_scope].(string)
+		if registered == "" {
+			registered = getAllScopes()
+		}
+		_, hasPrevious := ud[clients.UserDataPreviousSecret]
+		shown[i] = details{
+			"ClientId":          app.GetId(),
+			"AppName":           appName(app),
+			"RedirectUris":      strings.Replace(app.GetRedirectUri(), redirect_uri_separator, "\n", -1),
+			"Scopes":            requestOptions(t, registered),
+			"HasSecret":         app.GetSecret() != "",
+			"HasPreviousSecret": hasPrevious,
+		}
+	}
+	o.render(w, r, statusCode, page_developer_apps, details{
+		"LoginHandle": handle,
+		"Notice":      t.text(notice),
+		"Credentials": credentials,
+		"Apps":        shown,
+		"NewScopes":   requestOptions(t, ""),
+		"Error":       t.text(errorMessage),
+	})
+}
+
+//the portal a developer logs in to with their tidepool account to manage their applications
+func (o *OAuthApi) developer(w http.ResponseWriter, r *http.Request) {
+
+	r.ParseForm()
+
+	if r.Method != "POST" {
+		o.showDeveloperLogin(w, r, http.StatusOK, "")
+		return
+	}
+	if o.checkCSRF(w, r) == false {
+		return
+	}
+
+	developerId, err := o.identifyUser(r, purpose_developer)
+	if err != nil {
+		o.showDeveloperLogin(w, r, loginFailedStatus(w, err), err.Error())
+		return
+	}
+	if developerId == "" {
+		o.showDeveloperLogin(w, r, http.StatusOK, "")
+		return
+	}
+
+	//what went wrong is shown with their apps so they can carry on
+	var credentials *osin.DefaultClient
+	notice, errMsg, statusCode := "", "", http.StatusOK
+	switch action := r.Form.Get("action"); action {
+	case developer_action_create:
+		var client *osin.DefaultClient
+		client, errMsg = o.newClient(developerId, r.Form)
+		if errMsg == "" {
+			if err := o.storage.SetClient(client.Id, client); err != nil {
+				log.Printf("developer: error[%s] saving the new client", err.Error())
+				errMsg = error_generic
+			}
+		}
+		if errMsg != "" {
+			statusCode = http.StatusBadRequest
+			break
+		}
+		log.Printf("developer: client[%s] created by developer[%s]", client.Id, developerId)
+		notice, credentials = msg_signup_complete, client
+	case developer_action_update, developer_action_delete, developer_action_rotate, developer_action_revoke:
+		client := o.developerClient(developerId, r.Form.Get("client_id"))
+		if client == nil {
+			log.Printf("developer: error[%s] client[%s] developer[%s]", error_developer_app, r.Form.Get("client_id"), developerId)
+			errMsg, statusCode = error_developer_app, http.StatusNotFound
+			break
+		}
+		switch action {
+		case developer_action_update:
+			errMsg = o.updateClient(client, r.Form)
+		case developer_action_delete:
+			errMsg = o.deleteClient(client)
+		case developer_action_rotate:
+			var expiresAt time.Time
+			if credentials, expiresAt, errMsg = o.rotateSecret(client); errMsg == "" {
+				log.Printf("developer: secret of client[%s] rotated by developer[%s]", client.GetId(), developerId)
+				o.audit(models.AuditSecretRotated, client.GetId(), developerId, "", r)
+				_, t := o.messages(r)
+				notice = fmt.Sprintf(t.text(msg_secret_rotated), expiresAt.UTC().Format(time.RFC1123))
+			}
+		case developer_action_revoke:
+			if errMsg = o.revokePreviousSecret(client); errMsg == "" {
+				log.Printf("developer: previous secret of client[%s] revoked by developer[%s]", client.GetId(), developerId)
+				o.audit(models.AuditPreviousSecretRevoked, client.GetId(), developerId, "", r)
+				notice = msg_secret_revoked
+			}
+		}
+		if errMsg != "" {
+			statusCode = http.StatusBadRequest
+		}
+	}
+
+	apps, err := o.developerClients(developerId)
+	if err != nil {
+		log.Printf("developer: error[%s] loading the clients", err.Error())
+		o.showError(w, r, error_generic, http.StatusInternalServerError)
+		return
+	}
+	o.showDeveloperApps(w, r, developerId, apps, notice, credentials, statusCode, errMsg)
+}
@@ -0,0 +1,276 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/RangelReale/osin"
+
+	"../models"
+)
+
+const (
+	grant_type_device_code = "urn:ietf:params:oauth:grant-type:device_code"
+
+	//how long the user has to authorize the device and how often it can poll until they do
+	device_expires_in     = 600
+	device_poll_interval  = 5
+	device_slow_down_secs = 5
+
+	//device grant errors, see https://tools.ietf.org/html/rfc8628#section-3.5
+	error_authorization_pending = "authorization_pending"
+	error_slow_down             = "slow_down"
+	error_expired_token         = "expired_token"
+
+	error_device_user_code  = "sorry but that code isn't one we know of or has expired, please check the code your device is showing"
+	error_device_code       = "the device_code is unknown or was issued to another client"
+	msg_device_authorized   = "Your device is now connected to Tidepool, you can close this page and return to it"
+	msg_device_denied       = "Your device has not been connected to Tidepool, you can close this page"
+	devicePostAction        = "device?user_code=%s"
+	device_verification_uri = "/device"
+)
+
+func (o *OAuthApi) showUserCodeForm(w http.ResponseWriter, r *http.Request) {
+	o.render(w, r, http.StatusOK, page_device_code, nil)
+}
+
+func (o *OAuthApi) showDeviceAuthorized(w http.ResponseWriter, r *http.Request, message string) {
+	_, t := o.messages(r)
+	o.render(w, r, http.StatusOK, page_device_done, details{"Message": t.text(message)})
+}
+
+//give the device the codes it needs to be authorized, see https://tools.ietf.org/html/rfc8628#section-3.1
+func (o *OAuthApi) deviceCode(w http.ResponseWriter, r *http.Request) {
+
+	log.Print("deviceCode: starting device authorization")
+
+	resp := o.oauthServer.NewResponse()
+	defer resp.Close()
+
+	if o.clientLockedOut(resp, w, r) {
+		return
+	}
+
+	client := o.authenticateClient(r)
+	if client == nil {
+		log.Printf("deviceCode: error[%s]", error_client_auth)
+		resp.SetError(osin.E_INVALID_CLIENT, error_client_auth)
+		resp.StatusCode = http.StatusUnauthorized
+		osin.OutputJSON(resp, w, r)
+		return
+	}
+	if allowsGrant(client, grant_type_device_code) == false {
+		log.Printf("deviceCode: error[%s] client[%s]", error_grant_not_registered, client.GetId())
+		resp.SetError(osin.E_UNAUTHORIZED_CLIENT, error_grant_not_registered)
+		resp.StatusCode = http.StatusBadRequest
+		osin.OutputJSON(resp, w, r)
+		return
+	}
+
+	scope, ok := checkRequestedScopes(client, r.Form.Get("scope"))
+	if ok == false {
+		log.Printf("deviceCode: error[%s] client[%s]", error_client_scope, client.GetId())
+		resp.SetError(osin.E_INVALID_SCOPE, error_client_scope)
+		resp.StatusCode = http.StatusBadRequest
+		osin.OutputJSON(resp, w, r)
+		return
+	}
+
+	deviceCode, err := o.tokenGen.device.Generate()
+	if err != nil {
+		log.Printf("deviceCode: error[%s] generating the device code", err.Error())
+		resp.SetError(osin.E_SERVER_ERROR, error_oauth_service)
+		resp.StatusCode = http.StatusInternalServerError
+		osin.OutputJSON(resp, w, r)
+		return
+	}
+	userCode, err := models.GenerateUserCode()
+	if err != nil {
+		log.Printf("deviceCode: error[%s] generating the user code", err.Error())
+		resp.SetError(osin.E_SERVER_ERROR, error_oauth_service)
+		resp.StatusCode = http.StatusInternalServerError
+		osin.OutputJSON(resp, w, r)
+		return
+	}
+
+	device := &models.DeviceAuthorization{
+		DeviceCode: deviceCode,
+		UserCode:   userCode,
+		ClientId:   client.GetId(),
+		Scope:      scope,
+		CreatedAt:  time.Now(),
+		ExpiresIn:  device_expires_in,
+		Interval:   device_poll_interval,
+	}
+	if err := o.storage.SaveDevice(device); err != nil {
+		log.Printf("deviceCode: error[%s] saving the device", err.Error())
+		resp.SetError(osin.E_SERVER_ERROR, error_oauth_service)
+		resp.StatusCode = http.StatusInternalServerError
+		osin.OutputJSON(resp, w, r)
+		return
+	}
+
+	verificationUri := o.endpointUrl(route_device)
+
+	resp.Output["device_code"] = device.DeviceCode
+	resp.Output["user_code"] = device.UserCode
+	resp.Output["verification_uri"] = verificationUri
+	resp.Output["verification_uri_complete"] = verificationUri + "?user_code=" + url.QueryEscape(device.UserCode)
+	resp.Output["expires_in"] = device.ExpiresIn
+	resp.Output["interval"] = device.Interval
+	osin.OutputJSON(resp, w, r)
+}
+
+//the user enters the code from their device and then logs in to authorize it
+func (o *OAuthApi) device(w http.ResponseWriter, r *http.Request) {
+
+	log.Print("device: authorizing device")
+
+	r.ParseForm()
+
+	if o.checkCSRF(w, r) == false {
+		return
+	}
+
+	userCode := models.NormalizeUserCode(r.Form.Get("user_code"))
+	if userCode == "" {
+		o.showUserCodeForm(w, r)
+		return
+	}
+
+	//the user codes are short so guesses are counted against where they came from like logins are
+	if wait := o.lockedOut(o.addressKey(r)); wait > 0 {
+		log.Printf("device: error[%s]", error_throttled)
+		o.showThrottled(w, r, wait)
+		return
+	}
+	device, err := o.storage.LoadDeviceByUserCode(userCode)
+	if err != nil || device.IsExpired() || device.UserData != nil || device.Denied {
+		log.Print("device: no device waiting for the user code")
+		o.count(o.addressKey(r))
+		o.showError(w, r, error_device_user_code, http.StatusBadRequest)
+		return
+	}
+	client, err := o.storage.GetClient(device.ClientId)
+	if err != nil {
+		log.Printf("device: error[%s] getting client[%s]", err.Error(), device.ClientId)
+		o.showError(w, r, error_oauth_service, http.StatusInternalServerError)
+		return
+	}
+
+	//the same login as the authorize page for what the device asked for
+	ar := &osin.AuthorizeRequest{Client: client, Scope: device.Scope, HttpRequest: r}
+	if o.handleLoginPage(ar, fmt.Sprintf(devicePostAction, url.QueryEscape(userCode)), w, r) == false {
+		return
+	}
+
+	if ar.Authorized {
+		//only what the user approved is given to the device
+		device.Scope = ar.Scope
+		device.UserData = models.GetTokenUserData(ar.UserData)
+	} else {
+		device.Denied = true
+	}
+	if err := o.storage.UpdateDevice(device); err != nil {
+		log.Printf("device: error[%s] saving the authorized device", err.Error())
+		o.showError(w, r, error_oauth_service, http.StatusInternalServerError)
+		return
+	}
+	if device.Denied {
+		log.Printf("device: denied for client[%s]", client.GetId())
+		o.showDeviceAuthorized(w, r, msg_device_denied)
+		return
+	}
+	log.Printf("device: authorized for client[%s]", client.GetId())
+	o.showDeviceAuthorized(w, r, msg_device_authorized)
+}
+
+//the device polls for its tokens, see https://tools.ietf.org/html/rfc8628#section-3.4
+func (o *OAuthApi) deviceToken(resp *osin.Response, w http.ResponseWriter, r *http.Request) {
+
+	deviceError := func(errorId, description string) {
+		log.Printf("deviceToken: error[%s]", errorId)
+		resp.SetError(errorId, description)
+		resp.StatusCode = http.StatusBadRequest
+		osin.OutputJSON(resp, w, r)
+	}
+
+	client := o.authenticateClient(r)
+	if client == nil {
+		deviceError(osin.E_INVALID_CLIENT, error_client_auth)
+		return
+	}
+	if allowsGrant(client, grant_type_device_code) == false {
+		deviceError(osin.E_UNAUTHORIZED_CLIENT, error_grant_not_registered)
+		return
+	}
+
+	device, err := o.storage.LoadDevice(r.Form.Get("device_code"))
+	if err != nil || device.ClientId != client.GetId() {
+		deviceError(osin.E_INVALID_GRANT, error_device_code)
+		return
+	}
+	if device.IsExpired() {
+		o.storage.RemoveDevice(device.DeviceCode)
+		deviceError(error_expired_token, "")
+		return
+	}
+	if device.Denied {
+		o.storage.RemoveDevice(device.DeviceCode)
+		deviceError(osin.E_ACCESS_DENIED, "")
+		return
+	}
+
+	now := time.Now()
+	tooSoon := now.Sub(device.LastPolledAt) < time.Duration(device.Interval)*time.Second
+	device.LastPolledAt = now
+
+	if tooSoon {
+		device.Interval += device_slow_down_secs
+		o.storage.UpdateDevice(device)
+		deviceError(error_slow_down, "")
+		return
+	}
+	if device.UserData == nil {
+		o.storage.UpdateDevice(device)
+		deviceError(error_authorization_pending, "")
+		return
+	}
+
+	//the device code can only be exchanged the once, only the poll that takes the device is given the tokens
+	taken, err := o.storage.TakeDevice(device.DeviceCode)
+	if err == osin.ErrNotFound {
+		deviceError(osin.E_INVALID_GRANT, error_device_code)
+		return
+	}
+	if err != nil {
+		log.Printf("deviceToken: error[%s] taking the device", err.Error())
+		resp.SetError(osin.E_SERVER_ERROR, error_oauth_service)
+		resp.StatusCode = http.StatusInternalServerError
+		osin.OutputJSON(resp, w, r)
+		return
+	}
+	device = taken
+
+	ar := &osin.AccessRequest{
+		Type:            osin.AccessRequestType(grant_type_device_code),
+		Client:          client,
+		Scope:           device.Scope,
+		UserData:        device.UserData,
+		GenerateRefresh: allowsGrant(client, string(osin.REFRESH_TOKEN)),
+		Expiration:      o.oauthServer.Config.AccessExpiration,
+		Authorized:      true,
+		HttpRequest:     r,
+	}
+	o.oauthServer.FinishAccessRequest(resp, r, ar)
+	if resp.IsError == false {
+		o.addIdToken(resp, ar)
+	}
+	if resp.IsError && resp.InternalError != nil {
+		log.Printf("deviceToken: error[%s]", resp.InternalError.Error())
+	}
+	osin.OutputJSON(resp, w, r)
+}
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/RangelReale/osin"
+)
+
+const (
+	//the names of the routes we give out the urls of, see SetHandlers
+	route_authorize    = "authorize"
+	route_token        = "token"
+	route_info         = "info"
+	route_revoke       = "revoke"
+	route_introspect   = "introspect"
+	route_register     = "register"
+	route_registration = "registration"
+	route_device_code  = "device_code"
+	route_device       = "device"
+	route_userinfo     = "userinfo"
+	route_jwks         = "jwks"
+)
+
+//where the api is served from, always the configured issuer as the Host of a request is whatever the caller sent
+func (o *OAuthApi) baseUrl() string {
+	return o.OpenID.Issuer
+}
+
+//the url of the named route as it is served, empty when there is no such route
+func (o *OAuthApi) endpointUrl(name string, pairs ...string) string {
+	if o.router == nil {
+		return ""
+	}
+	route := o.router.Get(name)
+	if route == nil {
+		return ""
+	}
+	endpoint, err := route.URL(pairs...)
+	if err != nil {
+		log.Printf("endpointUrl: error[%s] for route[%s]", err.Error(), name)
+		return ""
+	}
+	return o.baseUrl() + strings.TrimPrefix(endpoint.Path, o.prefix)
+}
+
+//the scopes that can be asked for, the openid ones only when OpenID Connect is on
+func (o *OAuthApi) supportedScopes() []string {
+	supported := []string{}
+	if o.signer != nil {
+		supported = append(supported, scope_openid, scope_email, scope_profile)
+	}
+	for i := range allScopes {
+		supported = append(supported, allScopes[i].name)
+	}
+	return supported
+}
+
+//what we are and support as given by the live routes and config, see https://tools.ietf.org/html/rfc8414#section-2
+func (o *OAuthApi) serverMetadata(resp *osin.Response, r *http.Request) {
+
+	authMethods := []string{auth_method_basic, auth_method_post, auth_method_none}
+
+	resp.Output["issuer"] = o.baseUrl()
+	resp.Output["authorization_endpoint"] = o.endpointUrl(route_authorize)
+	resp.Output["token_endpoint"] = o.endpointUrl(route_token)
+	resp.Output["info_endpoint"] = o.endpointUrl(route_info)
+	resp.Output["revocation_endpoint"] = o.endpointUrl(route_revoke)
+	resp.Output["introspection_endpoint"] = o.endpointUrl(route_introspect)
+	resp.Output["registration_endpoint"] = o.endpointUrl(route_register)
+	resp.Output["device_authorization_endpoint"] = o.endpointUrl(route_device_code)
+	resp.Output["response_types_supported"] = []string{string(osin.CODE)}
+	resp.Output["grant_types_supported"] = supportedGrantTypes
+	resp.Output["scopes_supported"] = o.supportedScopes()
+	resp.Output["token_endpoint_auth_methods_supported"] = authMethods
+	resp.Output["revocation_endpoint_auth_methods_supported"] = authMethods
+	resp.Output["introspection_endpoint_auth_methods_supported"] = []string{auth_method_basic, auth_method_post}
+	resp.Output["code_challenge_methods_supported"] = []string{osin.PKCE_PLAIN, osin.PKCE_S256}
+	resp.Output["ui_locales_supported"] = o.catalog.supported()
+	if o.signer != nil {
+		resp.Output["jwks_uri"] = o.endpointUrl(route_jwks)
+	}
+}
+
+//client SDKs configure themselves from this, see https://tools.ietf.org/html/rfc8414#section-3
+func (o *OAuthApi) authorizationServer(w http.ResponseWriter, r *http.Request) {
+
+	resp := o.oauthServer.NewResponse()
+	defer resp.Close()
+
+	o.serverMetadata(resp, r)
+	osin.OutputJSON(resp, w, r)
+}
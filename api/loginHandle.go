@@ -0,0 +1,55 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"../models"
+)
+
+const (
+	//the field the login handle is posted back in
+	login_handle_field = "login_handle"
+	//long enough to decide what to do on the page it came with
+	login_handle_expiry = 15 * time.Minute
+
+	error_login_expired = "sorry but that page has expired, please login again"
+
+	//what the handles of the connected apps and developer pages are for, those of the consent page are for the request being authorized
+	purpose_connected = "connected"
+	purpose_developer = "developer"
+)
+
+//a handle for the user who has just logged in, the page they are shown posts it back instead of them logging in again.
+//Their tidepool session never leaves us, the handle is only good for the purpose it was issued for and only the once
+func (o *OAuthApi) issueLoginHandle(userId, purpose string) (string, error) {
+	handle, err := o.tokenGen.login.Generate()
+	if err != nil {
+		log.Printf("issueLoginHandle: error[%s] generating the handle", err.Error())
+		return "", err
+	}
+	now := time.Now()
+	loginHandle := &models.LoginHandle{Handle: handle, UserId: userId, Purpose: purpose, CreatedAt: now, ExpiresAt: now.Add(login_handle_expiry)}
+	if err := o.storage.SaveLoginHandle(loginHandle); err != nil {
+		log.Printf("issueLoginHandle: error[%s] saving the handle", err.Error())
+		return "", err
+	}
+	return handle, nil
+}
+
+//the user the handle posted back was issued to, it can't be used again whether or not it was for the purpose
+func (o *OAuthApi) loginHandleUser(r *http.Request, purpose string) (string, error) {
+	handle := r.Form.Get(login_handle_field)
+	if o.tokenGen.login.Valid(handle) == false {
+		log.Print("loginHandleUser: not a handle we could have issued")
+		return "", errors.New(error_login_expired)
+	}
+	loginHandle, err := o.storage.TakeLoginHandle(handle)
+	if err != nil || loginHandle.Purpose != purpose {
+		log.Print("loginHandleUser: the handle has been used, has expired or isn't for the page")
+		return "", errors.New(error_login_expired)
+	}
+	return loginHandle.UserId, nil
+}
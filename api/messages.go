@@ -0,0 +1,235 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	//what we show when we have none of the languages the user prefers
+	default_language = "en"
+	//the messages in a language are in a file named for it e.g. es.json or pt-br.json
+	messages_file_ext = ".json"
+)
+
+type (
+	//the text of each message the user sees by its id
+	messages map[string]string
+	//the messages in each language we have them in, english has them all and the others fall back to it
+	catalog struct {
+		languages map[string]messages
+	}
+	//a language from Accept-Language and how much the user wants it
+	acceptedLanguage struct {
+		tag     string
+		quality float64
+	}
+	byQuality []acceptedLanguage
+)
+
+//the english of every message the user sees, translations give them by the same ids
+var englishMessages = messages{
+	//errors shown on the pages
+	"error_signup_details":           error_signup_details,
+	"error_signup_pw_match":          error_signup_pw_match,
+	"error_signup_account":           error_signup_account,
+	"error_signup_account_duplicate": error_signup_account_duplicate,
+	"error_generic":                  error_generic,
+	"error_check_tidepool_creds":     error_check_tidepool_creds,
+	"error_applying_permissons":      error_applying_permissons,
+	"error_oauth_service":            error_oauth_service,
+	"error_signup_scopes":            error_signup_scopes,
+	"error_no_scope_granted":         error_no_scope_granted,
+	"error_app_details":              error_app_details,
+	"error_developer_app":            error_developer_app,
+	"error_no_secret":                error_no_secret,
+	"error_app_not_found":            error_app_not_found,
+	"error_device_user_code":         error_device_user_code,
+	"error_csrf":                     error_csrf,
+	"error_throttled":                error_throttled,
+	"error_login_expired":            error_login_expired,
+	//the scopes
+	"scope_view_request":   scopeView.requestMsg,
+	"scope_view_grant":     scopeView.grantMsg,
+	"scope_upload_request": scopeUpload.requestMsg,
+	"scope_upload_grant":   scopeUpload.grantMsg,
+	//what happened
+	"msg_signup_complete":   msg_signup_complete,
+	"msg_secret_rotated":    msg_secret_rotated,
+	"msg_secret_revoked":    msg_secret_revoked,
+	"msg_device_authorized": msg_device_authorized,
+	"msg_device_denied":     msg_device_denied,
+	//the pages
+	"msg_page_title":                  "Tidepool",
+	"msg_signup_title":                "Tidepool developer account signup",
+	"msg_signup_app_info":             "Application Information:",
+	"msg_signup_account_info":         "Account Information:",
+	"msg_signup_save_details":         "Please save these details",
+	"msg_signup_developer":            "Login to the developer portal with your email and password to add more applications or change this one",
+	"msg_signup_public_client":        "Your application has no client_secret, it must use PKCE (RFC 7636) with code_challenge and code_verifier",
+	"msg_tidepool_account_access":     "Login to grant access to Tidepool",
+	"msg_tidepool_permissons_granted": "With access to your Tidepool account %s can:",
+	"msg_connected_apps":              "Apps connected to your Tidepool account",
+	"msg_no_connected_apps":           "You haven't given any apps access to your Tidepool account",
+	"msg_connected_login":             "Login to see the apps connected to your Tidepool account",
+	"msg_app_granted":                 "connected %s",
+	"msg_app_last_used":               "last used %s",
+	"msg_developer_login":             "Login to manage your Tidepool applications",
+	"msg_developer_apps":              "Your Tidepool applications",
+	"msg_developer_no_apps":           "You don't have any applications yet",
+	"msg_developer_new_app":           "Add an application",
+	"msg_device_connect":              "Enter the code shown on your device to connect it to Tidepool",
+	"btn_authorize":                   "Grant access to Tidepool",
+	"btn_no_authorize":                "Deny access to Tidepool",
+	"btn_signup":                      "Signup",
+	"btn_login":                       "Login",
+	"btn_disconnect":                  "Disconnect",
+	"btn_create_app":                  "Add application",
+	"btn_update_app":                  "Save",
+	"btn_delete_app":                  "Delete",
+	"btn_rotate_secret":               "New client_secret",
+	"btn_revoke_secret":               "Stop the old client_secret working",
+	"btn_device_continue":             "Continue",
+	"placeholder_email":               "Email",
+	"placeholder_pw":                  "Password",
+	"placeholder_pw_confirm":          "Confirm Password",
+	"placeholder_name":                "Application Name",
+	"placeholder_uris":                "Application redirect_uri, one per line",
+	"placeholder_user_code":           "Code e.g. WDJB-MJHT",
+	"label_public_client":             "My application can't keep a secret e.g. a mobile or desktop app",
+	"label_require_pkce":              "Require PKCE (RFC 7636) when authorizing",
+	"label_client_credentials":        "My application also acts as itself without a user e.g. a clinic or EHR integration",
+}
+
+//the id of each english message, the code says what happened in english and it is given to the user in their language
+var messageIds = idsOf(englishMessages)
+
+func idsOf(english messages) map[string]string {
+	ids := make(map[string]string, len(english))
+	for id, text := range english {
+		ids[text] = id
+	}
+	return ids
+}
+
+//the translations in dir are loaded along with our english, a message missing from a translation is given in english
+func newCatalog(dir string) (*catalog, error) {
+
+	c := &catalog{languages: map[string]messages{default_language: englishMessages}}
+	if dir == "" {
+		return c, nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"+messages_file_ext))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var translated messages
+		if err := json.Unmarshal(content, &translated); err != nil {
+			return nil, err
+		}
+		lang := strings.ToLower(strings.TrimSuffix(filepath.Base(file), messages_file_ext))
+		all := make(messages, len(englishMessages))
+		for id, text := range englishMessages {
+			all[id] = text
+		}
+		for id, text := range translated {
+			all[id] = text
+		}
+		c.languages[lang] = all
+	}
+	return c, nil
+}
+
+//the first of the languages given that we have, or just the language when we have it but not the region, english when we have none of them
+func (c *catalog) language(preferred []string) string {
+	for _, tag := range preferred {
+		tag = strings.ToLower(strings.Replace(tag, "_", "-", -1))
+		if _, ok := c.languages[tag]; ok {
+			return tag
+		}
+		if base := strings.SplitN(tag, "-", 2)[0]; base != tag {
+			if _, ok := c.languages[base]; ok {
+				return base
+			}
+		}
+	}
+	return default_language
+}
+
+//the languages we have so clients know they can ask for them
+func (c *catalog) supported() []string {
+	langs := make([]string, 0, len(c.languages))
+	for lang := range c.languages {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+//the message in the language, what was said is given as is when it isn't one of ours
+func (m messages) text(english string) string {
+	if id, ok := messageIds[english]; ok {
+		if text, ok := m[id]; ok {
+			return text
+		}
+	}
+	return english
+}
+
+//the languages the user prefers, those asked for with ui_locales before those of their browser
+//see http://openid.net/specs/openid-connect-core-1_0.html#AuthRequest
+func preferredLanguages(r *http.Request) []string {
+	preferred := strings.Fields(r.FormValue("ui_locales"))
+	return append(preferred, acceptedLanguages(r.Header.Get("Accept-Language"))...)
+}
+
+//the languages in the Accept-Language header most wanted first, see https://tools.ietf.org/html/rfc7231#section-5.3.5
+func acceptedLanguages(header string) []string {
+	var accepted []acceptedLanguage
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		tag := strings.TrimSpace(fields[0])
+		if tag == "" || tag == "*" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range fields[1:] {
+			if param = strings.TrimSpace(param); strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		if quality > 0 {
+			accepted = append(accepted, acceptedLanguage{tag: tag, quality: quality})
+		}
+	}
+	sort.Stable(byQuality(accepted))
+
+	tags := make([]string, len(accepted))
+	for i := range accepted {
+		tags[i] = accepted[i].tag
+	}
+	return tags
+}
+
+func (a byQuality) Len() int           { return len(a) }
+func (a byQuality) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byQuality) Less(i, j int) bool { return a[i].quality > a[j].quality }
+
+//the messages in the language the user prefers
+func (o *OAuthApi) messages(r *http.Request) (string, messages) {
+	lang := o.catalog.language(preferredLanguages(r))
+	return lang, o.catalog.languages[lang]
+}
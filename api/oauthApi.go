@@ -20,13 +20,35 @@ import (
 
 type (
 	OAuthConfig struct {
-		ExpireDays int `json:"expireDays"`
+		ExpireDays  int                     `json:"expireDays"`
+		Credentials models.CredentialConfig `json:"credentials"`
+		//withdraw the permissons given to an app when the last of the users tokens for it is revoked
+		RevokePermissons bool         `json:"revokePermissons"`
+		OpenID           OpenIDConfig `json:"openid"`
+		//opaque or jwt, a jwt access token is signed with the openid key
+		TokenFormat string `json:"tokenFormat"`
+		//how long a client secret can still be used once it has been rotated e.g. 24h
+		SecretGracePeriod string             `json:"secretGracePeriod"`
+		Registration      RegistrationConfig `json:"registration"`
+		//the pages are shown with the templates in this dir, our own are used for those it doesn't have
+		TemplateDir string `json:"templateDir"`
+		//the translations of what the user sees, one <language>.json of the messages by id for each language
+		MessageDir string         `json:"messageDir"`
+		Throttle   ThrottleConfig `json:"throttle"`
 	}
 	OAuthApi struct {
 		oauthServer *osin.Server
-		storage     *clients.OAuthStorage
+		storage     clients.Storage
 		userApi     shoreline.Client
 		permsApi    tpClients.Gatekeeper
+		secretGen   *models.CredentialGenerator
+		tokenGen    *credentialGen
+		signer      *tokenSigner
+		views       *views
+		catalog     *catalog
+		//where the handlers are, the urls we give out are built from the routes
+		router *mux.Router
+		prefix string
 		OAuthConfig
 	}
 	//scope that maps to a tidepool permisson
@@ -38,8 +60,9 @@ type (
 
 var (
 	//Available scopes's
-	scopeView   scope = scope{name: "view", requestMsg: "Requests uploading of data on behalf", grantMsg: "Allow uploading of data on your behalf"}
-	scopeUpload scope = scope{name: "upload", requestMsg: "Requests viewing of data on behalf", grantMsg: "Allow viewing of data on your behalf"}
+	scopeView   scope = scope{name: "view", requestMsg: "Requests viewing of data on behalf", grantMsg: "Allow viewing of data on your behalf"}
+	scopeUpload scope = scope{name: "upload", requestMsg: "Requests uploading of data on behalf", grantMsg: "Allow uploading of data on your behalf"}
+	allScopes         = []scope{scopeView, scopeUpload}
 )
 
 const (
@@ -52,34 +75,49 @@ const (
 	error_check_tidepool_creds     = "sorry but there was an issue authorizing your tidepool user, are your credentials correct?"
 	error_applying_permissons      = "sorry but there was an issue apply the permissons for your tidepool user"
 	error_oauth_service            = "sorry but there was an issue with our OAuth service"
-	//user message
-	msg_signup_complete             = "Your Tidepool developer account has been created"
-	msg_signup_save_details         = "Please save these details"
-	msg_tidepool_account_access     = "Login to grant access to Tidepool"
-	msg_tidepool_permissons_granted = "With access to your Tidepool account %s can:"
-	//form text
-	btn_authorize            = "Grant access to Tidepool"
-	btn_no_authorize         = "Deny access to Tidepool"
-	btn_signup               = "Signup"
-	placeholder_email        = "Email"
-	placeholder_pw           = "Password"
-	placeholder_pw_confirm   = "Confirm Password"
-	placeholder_redirect_uri = "Application redirect_uri"
-	placeholder_name         = "Application Name"
+	error_malformed_credential     = "the code or token given is not one we could have issued"
+	error_pkce_required            = "code_challenge (rfc7636) required for this client"
+	error_client_auth              = "the client could not be authenticated"
+	error_token_required           = "the token to revoke is required"
+	error_token_other_client       = "the token was not issued to this client"
+	error_introspect_auth          = "a tidepool server token or the client credentials are required"
+	error_client_credentials       = "the client_credentials grant is not allowed for this client"
+	error_client_scope             = "the scope asked for is more than the client was registered for"
+	error_client_openid_scope      = "the openid scopes are about a user so can't be asked for with the client_credentials grant"
+	error_signup_scopes            = "sorry but you need to choose at least one of the permissons your application needs"
+	error_no_scope_granted         = "sorry but you need to allow at least one of the permissons to grant access"
+	//user message, all the user sees is in the message catalog so it can be translated
+	msg_signup_complete = "Your Tidepool developer account has been created"
 
 	oneDayInSecs = 86400
-	//TODO: get prefix from router??
-	authPostAction = "https://devel-api.tidepool.io/oauth/authorize?response_type=%s&client_id=%s&state=%s&scope=%s&redirect_uri=%s"
-	//TODO: stop gap for styling
-	btnCss   = "input[type=submit]{background:#0b9eb3;color:#fff;}"
-	inputCss = "input{width:80%%;height:37px;margin:5px;font-size:18px;}"
-	mfwCss   = "body{margin:40px auto;max-width:650px;line-height:1.6;font-size:18px;color:#444;padding:0 10px}h1,h2,h3{line-height:1.2}"
-	basicCss = "<style type=\"text/css\"></style>"
+
+	default_secret_grace_period = 24 * time.Hour
+
+	//the authorize endpoint relative to the page it is posted from and the request being authorized
+	authPostAction = "authorize?response_type=%s&client_id=%s&state=%s&scope=%s&redirect_uri=%s&code_challenge=%s&code_challenge_method=%s&nonce=%s&ui_locales=%s"
+
+	//header a tidepool service gives its server token in
+	tidepool_session_token = "x-tidepool-session-token"
+	token_type_bearer      = "Bearer"
+
+	//client settings kept in the client user data
+	userdata_app_name           = "AppName"
+	userdata_require_pkce       = "RequirePKCE"
+	userdata_client_credentials = "ClientCredentials"
+	userdata_scope              = "Scope"
 )
 
+//how long a client secret can still be used once it has been rotated
+func (c *OAuthConfig) GetSecretGracePeriod() time.Duration {
+	if period, err := time.ParseDuration(c.SecretGracePeriod); err == nil && period >= 0 {
+		return period
+	}
+	return default_secret_grace_period
+}
+
 func InitOAuthApi(
 	config OAuthConfig,
-	storage *clients.OAuthStorage,
+	storage clients.Storage,
 	userApi shoreline.Client,
 	permsApi tpClients.Gatekeeper) *OAuthApi {
 
@@ -88,12 +126,76 @@ func InitOAuthApi(
 	sconfig := osin.NewServerConfig()
 	sconfig.AllowGetAccessRequest = true
 	sconfig.AllowClientSecretInParams = true
+	//a client without a secret can only use the code flow with PKCE
+	sconfig.RequirePKCEForPublicClients = true
+	//a client can have more than one redirect_uri
+	sconfig.RedirectUriSeparator = redirect_uri_separator
+	//client_credentials is then only allowed for the clients set up for it
+	sconfig.AllowedAccessTypes = osin.AllowedAccessType{osin.AUTHORIZATION_CODE, osin.REFRESH_TOKEN, osin.CLIENT_CREDENTIALS}
+	//osin would remove the access a refresh token replaces by its access token, we only keep the hash of that so remove it by the refresh token
+	sconfig.RetainTokenAfterRefresh = true
+
+	secretGen, err := models.NewCredentialGenerator(models.ClientSecretPrefix, config.Credentials)
+	if err != nil {
+		log.Fatalf("OAuthApi credentials error[%s]", err.Error())
+	}
+	tokenGen, err := newCredentialGen(config.Credentials)
+	if err != nil {
+		log.Fatalf("OAuthApi credentials error[%s]", err.Error())
+	}
+
+	if config.Throttle.TrustForwardedFor == false && (config.Throttle.AddressLimit > 0 || config.Throttle.SignupLimit > 0) {
+		log.Print("OAuthApi throttle counts by address without trustForwardedFor, behind a proxy every request has the proxy's address")
+	}
+
+	//every url we give out is built from the issuer
+	if config.OpenID.Issuer == "" {
+		log.Fatal("OAuthApi openid issuer error[the issuer must be the url the api is served from]")
+	}
+
+	oauthServer := osin.NewServer(sconfig, storage)
+	oauthServer.AuthorizeTokenGen = tokenGen
+	oauthServer.AccessTokenGen = tokenGen
+
+	var signer *tokenSigner
+	if config.OpenID.KeyFile != "" {
+		if signer, err = newTokenSigner(config.OpenID.KeyFile, config.OpenID.KeyId); err != nil {
+			log.Fatalf("OAuthApi OpenID signing key error[%s]", err.Error())
+		}
+	} else {
+		log.Print("OAuthApi no OpenID signing key so OpenID Connect is off")
+	}
+
+	views, err := newViews(config.TemplateDir)
+	if err != nil {
+		log.Fatalf("OAuthApi templates error[%s]", err.Error())
+	}
+	catalog, err := newCatalog(config.MessageDir)
+	if err != nil {
+		log.Fatalf("OAuthApi messages error[%s]", err.Error())
+	}
+
+	switch config.TokenFormat {
+	case "", token_format_opaque:
+	case token_format_jwt:
+		if signer == nil {
+			log.Fatal("OAuthApi jwt access tokens need the OpenID signing key")
+		}
+		oauthServer.AccessTokenGen = &jwtAccessGen{credentialGen: tokenGen, signer: signer, issuer: config.OpenID.Issuer}
+	default:
+		log.Fatalf("OAuthApi unknown token format [%s]", config.TokenFormat)
+	}
 
 	return &OAuthApi{
 		storage:     storage,
-		oauthServer: osin.NewServer(sconfig, storage),
+		oauthServer: oauthServer,
 		userApi:     userApi,
 		permsApi:    permsApi,
+		secretGen:   secretGen,
+		tokenGen:    tokenGen,
+		signer:      signer,
+		views:       views,
+		catalog:     catalog,
 		OAuthConfig: config,
 	}
 }
@@ -101,21 +203,104 @@ func InitOAuthApi(
 func (o *OAuthApi) SetHandlers(prefix string, rtr *mux.Router) {
 
 	log.Print("OAuthApi attaching handlers ...")
+	o.router, o.prefix = rtr, prefix
 	//signup user and give them secret and id required for oauth2 usage
 	rtr.HandleFunc(prefix+"/signup", o.signup).Methods("GET", "POST")
+	//the developer manages their applications
+	rtr.HandleFunc(prefix+"/"+developerPostAction, o.developer).Methods("GET", "POST")
+	//partners register their clients with an initial access token an admin gave them
+	rtr.HandleFunc(prefix+"/register/initial_token", o.initialToken).Methods("POST")
+	rtr.HandleFunc(prefix+"/register", o.register).Methods("POST").Name(route_register)
+	//and then manage them with the registration access token each was given
+	rtr.HandleFunc(prefix+"/register/{client_id}", o.readRegistration).Methods("GET").Name(route_registration)
+	rtr.HandleFunc(prefix+"/register/{client_id}", o.updateRegistration).Methods("PUT")
+	rtr.HandleFunc(prefix+"/register/{client_id}", o.deleteRegistration).Methods("DELETE")
 
 	//the oauth2 specific part of the api
-	rtr.HandleFunc(prefix+"/authorize", o.authorize).Methods("GET", "POST")
-	rtr.HandleFunc(prefix+"/token", o.token).Methods("POST")
-	rtr.HandleFunc(prefix+"/info", o.info).Methods("GET")
+	rtr.HandleFunc(prefix+"/authorize", o.authorize).Methods("GET", "POST").Name(route_authorize)
+	rtr.HandleFunc(prefix+"/token", o.token).Methods("POST").Name(route_token)
+	rtr.HandleFunc(prefix+"/info", o.info).Methods("GET").Name(route_info)
+	rtr.HandleFunc(prefix+"/revoke", o.revoke).Methods("POST").Name(route_revoke)
+	rtr.HandleFunc(prefix+"/introspect", o.introspect).Methods("POST").Name(route_introspect)
+	rtr.HandleFunc(prefix+"/.well-known/oauth-authorization-server", o.authorizationServer).Methods("GET")
+
+	//the user can see and disconnect the apps they have given access to
+	rtr.HandleFunc(prefix+"/connected", o.connected).Methods("GET", "POST")
+	rtr.HandleFunc(prefix+"/connected/apps", o.connectedApps).Methods("GET")
+	rtr.HandleFunc(prefix+"/connected/apps/{client_id}", o.disconnectApp).Methods("DELETE")
+
+	//devices without a browser get the user to authorize them elsewhere
+	rtr.HandleFunc(prefix+"/device/code", o.deviceCode).Methods("POST").Name(route_device_code)
+	rtr.HandleFunc(prefix+device_verification_uri, o.device).Methods("GET", "POST").Name(route_device)
+
+	//OpenID Connect
+	if o.signer != nil {
+		rtr.HandleFunc(prefix+"/userinfo", o.userinfo).Methods("GET", "POST").Name(route_userinfo)
+		rtr.HandleFunc(prefix+"/jwks", o.jwks).Methods("GET").Name(route_jwks)
+		rtr.HandleFunc(prefix+"/.well-known/openid-configuration", o.openidConfiguration).Methods("GET")
+	}
+
+}
+
+func findScope(name string) (scope, bool) {
+	for i := range allScopes {
+		if allScopes[i].name == name {
+			return allScopes[i], true
+		}
+	}
+	return scope{}, false
+}
+
+//the openid scopes say who the user is rather than giving a tidepool permisson so any client can ask for them
+func isOpenIDScope(name string) bool {
+	return name == scope_openid || name == scope_email || name == scope_profile
+}
+
+//the scopes asked for as long as the client was registered for them, or all it was registered for when none were asked for
+func checkRequestedScopes(client osin.Client, requested string) (string, bool) {
+	registered := clientScopes(client)
+	asked := splitScopes(requested)
+	if len(asked) == 0 {
+		return registered, true
+	}
+	for i := range asked {
+		if isOpenIDScope(asked[i]) == false && hasScope(registered, asked[i]) == false {
+			return "", false
+		}
+	}
+	return strings.Join(asked, ","), true
+}
 
+//the tidepool permissons asked for that the user hasn't already given the client
+func unconsentedScopes(requested, consented string) []scope {
+	var unconsented []scope
+	for _, asked := range splitScopes(requested) {
+		if theScope, ok := findScope(asked); ok && hasScope(consented, asked) == false {
+			unconsented = append(unconsented, theScope)
+		}
+	}
+	return unconsented
 }
 
-func makeScopeOption(theScope scope) string {
-	//disabled and selected by default at this stage
-	selected := "checked"
-	disabled := "return false"
-	return fmt.Sprintf("<input type=\"checkbox\" name=\"%s\"  value=\"%s\" %s onclick=\"%s\" /> %s", theScope.name, theScope.name, theScope.requestMsg, selected, disabled)
+//the scopes the user agreed to, those tidepool permissons asked for that they had already given or have now ticked along with the openid scopes asked for
+func approvedScopes(requested, consented string, form url.Values) (permissons []string, approved []string) {
+	for _, asked := range splitScopes(requested) {
+		if isOpenIDScope(asked) || hasScope(consented, asked) {
+			if isOpenIDScope(asked) == false {
+				permissons = append(permissons, asked)
+			}
+			approved = append(approved, asked)
+			continue
+		}
+		for _, ticked := range form["grant_scope"] {
+			if ticked == asked {
+				permissons = append(permissons, asked)
+				approved = append(approved, asked)
+				break
+			}
+		}
+	}
+	return permissons, approved
 }
 
 //check we have all the fields we require
@@ -154,92 +339,74 @@ func getAllScopes() string {
 	return fmt.Sprintf("%s,%s", scopeView.name, scopeUpload.name)
 }
 
-//attach basic styles to the rendered components
-func applyStyle(w http.ResponseWriter) {
-	style := fmt.Sprintf("<head><style type=\"text/css\">%s%s%s</style></head>", mfwCss, inputCss, btnCss)
-	w.Write([]byte(style))
-}
-
 //show the signup from so an external user can signup to the tidepool platform
-func showSignupForm(w http.ResponseWriter) {
-
-	//TODO: as a template
-	w.Write([]byte("<html>"))
-	applyStyle(w)
-	w.Write([]byte("<body>"))
-	w.Write([]byte("<h2>Tidepool developer account signup</h2>"))
-	w.Write([]byte("<form action=\"\" method=\"POST\">"))
-	w.Write([]byte("<fieldset>"))
-	w.Write([]byte("<h4>Application Information:</h4>"))
-	w.Write([]byte(fmt.Sprintf("<input type=\"text\" name=\"usr_name\" placeholder=\"%s\" /><br/>", placeholder_name)))
-	w.Write([]byte(fmt.Sprintf("<input type=\"text\" name=\"uri\" placeholder=\"%s\" /><br/>", placeholder_redirect_uri)))
-	w.Write([]byte("<ol>"))
-	w.Write([]byte("<li>" + scopeView.requestMsg + " </li>"))
-	w.Write([]byte("<li>" + scopeUpload.requestMsg + " </li>"))
-	w.Write([]byte("</ol>"))
-	//TODO: enable the ability to choose but hardcode for now
-	//w.Write([]byte(makeScopeOption(scopeUpload) + "<br />"))
-	//w.Write([]byte(makeScopeOption(scopeView) + "<br />"))
-	w.Write([]byte("<h4>Account Information:</h4>"))
-	w.Write([]byte(fmt.Sprintf("<input type=\"email\" name=\"email\" placeholder=\"%s\" /><br/>", placeholder_email)))
-	w.Write([]byte(fmt.Sprintf("<input type=\"password\" name=\"password\" placeholder=\"%s\" /><br/>", placeholder_pw)))
-	w.Write([]byte(fmt.Sprintf("<input type=\"password\" name=\"password_confirm\" placeholder=\"%s\" /><br/>", placeholder_pw_confirm)))
-	w.Write([]byte(fmt.Sprintf("<input type=\"submit\" value=\"%s\"/>", btn_signup)))
-	w.Write([]byte("</fieldset>"))
-	w.Write([]byte("</form>"))
-	w.Write([]byte("</body></html>"))
+func (o *OAuthApi) showSignupForm(w http.ResponseWriter, r *http.Request) {
+	_, t := o.messages(r)
+	o.render(w, r, http.StatusOK, page_signup, details{"Scopes": requestOptions(t, "")})
 }
 
 //show details on successful signup
-func showSignupSuccess(w http.ResponseWriter, signedUp *osin.DefaultClient) {
-	signedUpIdMsg := fmt.Sprintf("client_id=%s", signedUp.Id)
-	signedUpSecretMsg := fmt.Sprintf("client_secret=%s", signedUp.Secret)
-	log.Printf("showSignupSuccess: complete [%v] [%s] ", signedUpIdMsg, signedUpSecretMsg)
+func (o *OAuthApi) showSignupSuccess(w http.ResponseWriter, r *http.Request, signedUp *osin.DefaultClient) {
+	log.Printf("showSignupSuccess: complete [client_id=%s]", signedUp.Id)
+	o.render(w, r, http.StatusOK, page_signup_complete, details{"Credentials": signedUp})
+}
 
-	w.Write([]byte("<html>"))
-	applyStyle(w)
-	w.Write([]byte("<body>"))
-	w.Write([]byte("<h2>" + msg_signup_complete + "</h2>"))
-	w.Write([]byte("<p>" + msg_signup_save_details + "</p>"))
+//show login form for user giving authorization
+//the login form posts back to where it was shown with the request being authorized, relative so it stays on the scheme and host the page came from
+func (o *OAuthApi) authorizeFormAction(ar *osin.AuthorizeRequest) string {
+	return fmt.Sprintf(authPostAction,
+		ar.Type, ar.Client.GetId(), url.QueryEscape(ar.State), url.QueryEscape(ar.Scope), url.QueryEscape(ar.RedirectUri),
+		url.QueryEscape(ar.CodeChallenge), url.QueryEscape(ar.CodeChallengeMethod), url.QueryEscape(ar.HttpRequest.Form.Get("nonce")),
+		url.QueryEscape(ar.HttpRequest.Form.Get("ui_locales")))
+}
 
-	w.Write([]byte(signedUpIdMsg + " <br/>"))
-	w.Write([]byte(signedUpSecretMsg + " <br/>"))
-	w.Write([]byte("</html></body>"))
+func (o *OAuthApi) showLoginForm(ar *osin.AuthorizeRequest, formAction string, w http.ResponseWriter, statusCode int, errorMessage string) {
+	_, t := o.messages(ar.HttpRequest)
+	o.render(w, ar.HttpRequest, statusCode, page_login, details{
+		"AppName":    appName(ar.Client),
+		"Scopes":     grantOptions(t, knownScopes(ar.Scope)),
+		"FormAction": formAction,
+		"Error":      t.text(errorMessage),
+	})
 }
 
-//show login form for user giving authorization
-func showLoginForm(ar *osin.AuthorizeRequest, w http.ResponseWriter) {
-	ud := ar.Client.GetUserData().(map[string]interface{})
-
-	w.Write([]byte("<html>"))
-	applyStyle(w)
-	w.Write([]byte("<body>"))
-	w.Write([]byte("<h2>" + msg_tidepool_account_access + "</h2>"))
-	w.Write([]byte("<b>" + fmt.Sprintf(msg_tidepool_permissons_granted, ud["AppName"]) + "</b>"))
-	w.Write([]byte(fmt.Sprintf("<form action="+authPostAction+" method=\"POST\">",
-		ar.Type, ar.Client.GetId(), ar.State, ar.Scope, url.QueryEscape(ar.RedirectUri))))
-	//TODO: defaulted at this stage for initial implementation e.g. strings.Contains(ar.Scope, scopeView.name)
-	w.Write([]byte("<ol>"))
-	w.Write([]byte("<li>" + scopeView.grantMsg + " </li>"))
-	w.Write([]byte("<li>" + scopeUpload.grantMsg + " </li>"))
-	w.Write([]byte("</ol>"))
-	w.Write([]byte(fmt.Sprintf("<input type=\"text\" name=\"login\" placeholder=\"%s\" /><br/>", placeholder_email)))
-	w.Write([]byte(fmt.Sprintf("<input type=\"password\" name=\"password\" placeholder=\"%s\" /><br/>", placeholder_pw)))
-	w.Write([]byte(fmt.Sprintf("<input type=\"submit\" value=\"%s\"/>", btn_authorize)))
-	//TODO allow them to deny
-	//w.Write([]byte(fmt.Sprintf("<input type=\"submit\" value=\"%s\"/>", btn_no_authorize)))
-	w.Write([]byte("</form>"))
-	w.Write([]byte("</body></html>"))
-}
-
-//wrapper to write error and show to the user
-func showError(w http.ResponseWriter, errorMessage string, statusCode int) {
-	w.WriteHeader(statusCode)
-	applyStyle(w)
-	w.Write([]byte("<html><body>"))
-	w.Write([]byte("<i>" + errorMessage + "</i>"))
-	w.Write([]byte("</body></html>"))
-	return
+//once logged in the user is asked for just the permissons they haven't already given the app
+//the form carries a handle for their login to the request being authorized so they don't login again
+func (o *OAuthApi) showConsentForm(ar *osin.AuthorizeRequest, formAction, userId string, unconsented []scope, w http.ResponseWriter, statusCode int, errorMessage string) {
+	handle, err := o.issueLoginHandle(userId, formAction)
+	if err != nil {
+		o.showError(w, ar.HttpRequest, error_oauth_service, http.StatusInternalServerError)
+		return
+	}
+	_, t := o.messages(ar.HttpRequest)
+	o.render(w, ar.HttpRequest, statusCode, page_consent, details{
+		"AppName":     appName(ar.Client),
+		"Scopes":      grantOptions(t, unconsented),
+		"FormAction":  formAction,
+		"LoginHandle": handle,
+		"Error":       t.text(errorMessage),
+	})
+}
+
+//wrapper to write error and show to the user in their language
+func (o *OAuthApi) showError(w http.ResponseWriter, r *http.Request, errorMessage string, statusCode int) {
+	_, t := o.messages(r)
+	o.render(w, r, statusCode, page_error, details{"Message": t.text(errorMessage)})
+}
+
+//keep a record of what happened with the client, not being able to doesn't stop what the user is doing
+func (o *OAuthApi) audit(event, clientId, userId, scope string, r *http.Request) {
+	record := &models.AuditRecord{
+		Event:      event,
+		ClientId:   clientId,
+		UserId:     userId,
+		Scope:      scope,
+		RemoteAddr: r.RemoteAddr,
+		CreatedAt:  time.Now(),
+	}
+	if err := o.storage.SaveAudit(record); err != nil {
+		log.Printf("audit: error[%s] saving event[%s] for client[%s]", err.Error(), event, clientId)
+	}
 }
 
 // Apply the requested permissons for the app on authorizing users account
@@ -265,67 +432,183 @@ func (o *OAuthApi) applyPermissons(authorizingUserId, appUserId, scope string) b
 	return true
 }
 
-//try login the user to the platform and apply requested permissons
-func (o *OAuthApi) applyAuthorization(user, password string, ar *osin.AuthorizeRequest) error {
-	log.Print("applyAuthorization")
+//who the user is from their tidepool login, or from the login handle the page they were shown for the purpose posted back
+//no user and no error when they have yet to login
+func (o *OAuthApi) identifyUser(r *http.Request, purpose string) (string, error) {
+	form := r.Form
+
+	if form.Get("login") != "" && form.Get("password") != "" {
+		//shoreline isn't asked once there have been too many failures for the login or from where it came from
+		keys := []throttleKey{o.addressKey(r), o.loginKey(form.Get("login"))}
+		if wait := o.lockedOut(keys...); wait > 0 {
+			log.Printf("identifyUser: error[%s]", error_throttled)
+			return "", &throttledError{wait: wait}
+		}
+		usr, _, err := o.userApi.Login(form.Get("login"), form.Get("password"))
+		if err != nil || usr == nil {
+			log.Printf("identifyUser: err during account login: %v", err)
+			o.count(keys...)
+			return "", errors.New(error_check_tidepool_creds)
+		}
+		log.Printf("identifyUser: tidepool login success for userid[%s]", usr.UserID)
+		o.forget(o.loginKey(form.Get("login")))
+		return usr.UserID, nil
+	}
+	if form.Get(login_handle_field) != "" {
+		return o.loginHandleUser(r, purpose)
+	}
+	return "", nil
+}
+
+//the scopes the user has already given the client
+func (o *OAuthApi) consentedScopes(userId string, client osin.Client) string {
+	if consent, err := o.storage.LoadConsent(userId, client.GetId()); err == nil {
+		return consent.Scope
+	}
+	return ""
+}
 
-	if usr, _, err := o.userApi.Login(user, password); err != nil {
-		log.Printf("applyAuthorization: err during account login: %s", err.Error())
-		return err
-	} else if usr != nil {
-		log.Printf("applyAuthorization: tidepool login success for userid[%s] now applying permissons", usr.UserID)
-		if o.applyPermissons(usr.UserID, ar.Client.GetId(), getAllScopes()) {
+//apply the permissons the user has agreed to, those they had already given are not asked for again
+func (o *OAuthApi) applyAuthorization(userId, consented string, ar *osin.AuthorizeRequest) error {
+	log.Printf("applyAuthorization: for userid[%s]", userId)
+
+	//kept with the code and then its tokens so we know who authorized them
+	ar.UserData = &models.TokenUserData{
+		UserId:   userId,
+		AuthTime: time.Now().Unix(),
+		Nonce:    ar.HttpRequest.Form.Get("nonce"),
+	}
+	//only what the user has agreed to is given to the app and ends up in its token
+	requested := ar.Scope
+	permissons, approved := approvedScopes(requested, consented, ar.HttpRequest.Form)
+	ar.Scope = strings.Join(approved, ",")
+	if len(permissons) == 0 {
+		if len(approved) == len(splitScopes(requested)) {
+			//just who they are was asked for
 			return nil
-		} else {
-			log.Printf("applyAuthorization: error[%s]", error_applying_permissons)
-			return errors.New(error_applying_permissons)
 		}
+		log.Printf("applyAuthorization: error[%s]", error_no_scope_granted)
+		return errors.New(error_no_scope_granted)
+	}
+
+	//the app keeps what it was given before as well as what it has been given now
+	granted := splitScopes(consented)
+	for i := range permissons {
+		if hasScope(consented, permissons[i]) == false {
+			granted = append(granted, permissons[i])
+		}
+	}
+	if len(granted) == len(splitScopes(consented)) {
+		log.Print("applyAuthorization: the permissons were already given")
+		return nil
 	}
-	log.Printf("applyAuthorization: no user or error from login returning[%s] ", error_check_tidepool_creds)
-	return errors.New(error_check_tidepool_creds)
+
+	if o.applyPermissons(userId, ar.Client.GetId(), strings.Join(granted, ",")) == false {
+		log.Printf("applyAuthorization: error[%s]", error_applying_permissons)
+		return errors.New(error_applying_permissons)
+	}
+	consent := &models.Consent{UserId: userId, ClientId: ar.Client.GetId(), Scope: strings.Join(granted, ","), UpdatedAt: time.Now()}
+	if err := o.storage.SaveConsent(consent); err != nil {
+		//they will just be asked again next time
+		log.Printf("applyAuthorization: error[%s] saving the consent", err.Error())
+	}
+	return nil
 }
 
 //login page for user that is authroizing access to thier tidepool account
-func (o *OAuthApi) handleLoginPage(ar *osin.AuthorizeRequest, w http.ResponseWriter, r *http.Request) bool {
+//true once the user has decided, ar.Authorized is what they decided
+func (o *OAuthApi) handleLoginPage(ar *osin.AuthorizeRequest, formAction string, w http.ResponseWriter, r *http.Request) bool {
 
 	r.ParseForm()
 
-	if r.Method == "POST" && r.Form.Get("login") != "" && r.Form.Get("password") != "" {
-
-		if err := o.applyAuthorization(r.Form.Get("login"), r.Form.Get("password"), ar); err == nil {
-			return true
-		} else {
-			showError(w, error_check_tidepool_creds, http.StatusBadRequest)
+	if r.Method == "POST" && r.Form.Get("deny") != "" {
+		//they don't need to login to say no
+		userId := ""
+		if r.Form.Get(login_handle_field) != "" {
+			userId, _ = o.loginHandleUser(r, formAction)
 		}
+		log.Printf("handleLoginPage: access denied to client[%s]", ar.Client.GetId())
+		o.audit(models.AuditAccessDenied, ar.Client.GetId(), userId, ar.Scope, r)
+		ar.Authorized = false
+		return true
 	}
-	showLoginForm(ar, w)
-	return false
+
+	if r.Method != "POST" {
+		o.showLoginForm(ar, formAction, w, http.StatusOK, "")
+		return false
+	}
+
+	//the consent is posted back with a handle for the login to this request
+	userId, err := o.identifyUser(r, formAction)
+	if err != nil {
+		o.showLoginForm(ar, formAction, w, loginFailedStatus(w, err), err.Error())
+		return false
+	}
+	if userId == "" {
+		o.showLoginForm(ar, formAction, w, http.StatusOK, "")
+		return false
+	}
+
+	//the user is only asked to consent to what they haven't already
+	consented := o.consentedScopes(userId, ar.Client)
+	unconsented := unconsentedScopes(ar.Scope, consented)
+	if len(unconsented) > 0 && r.Form.Get(login_handle_field) == "" {
+		o.showConsentForm(ar, formAction, userId, unconsented, w, http.StatusOK, "")
+		return false
+	}
+
+	if err := o.applyAuthorization(userId, consented, ar); err != nil {
+		o.showConsentForm(ar, formAction, userId, unconsented, w, http.StatusBadRequest, err.Error())
+		return false
+	}
+	ar.Authorized = true
+	return true
 }
 
 //Process signup for the app user
 func (o *OAuthApi) signup(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 
+	if o.checkCSRF(w, r) == false {
+		return
+	}
+
 	validationMsg, formValid := signupFormValid(r.Form)
 
+	//the app is only ever given the scopes it signed up for
+	scopes := selectedScopes(r.Form)
+	if r.Method == "POST" && formValid && scopes == "" {
+		log.Printf("processSignup: error[%s]", error_signup_scopes)
+		o.showError(w, r, error_signup_scopes, http.StatusBadRequest)
+		return
+	}
+
 	if r.Method == "POST" && formValid {
 
-		if signupResp, err := o.userApi.Signup(r.Form.Get("usr_name"), r.Form.Get("password"), r.Form.Get("email")); err != nil {
+		//every signup from the address is counted so accounts can't be made without limit
+		signups := o.signupKey(r)
+		if wait := o.lockedOut(signups); wait > 0 {
+			log.Printf("processSignup: error[%s]", error_throttled)
+			o.showThrottled(w, r, wait)
+			return
+		}
+		o.count(signups)
+
+		//the developer account the application, and any they add later, belong to
+		if signupResp, err := o.userApi.Signup(r.Form.Get("email"), r.Form.Get("password"), r.Form.Get("email")); err != nil {
 			log.Printf("processSignup: error[%s] status[%s]", error_signup_account, err.Error())
-			showError(w, error_signup_account, http.StatusInternalServerError)
+			o.showError(w, r, error_signup_account, http.StatusInternalServerError)
 		} else {
-			secret, _ := models.GenerateHash(signupResp.UserID, r.Form.Get("uri"), time.Now().String())
-
-			theClient := &osin.DefaultClient{
-				Id:          signupResp.UserID,
-				Secret:      secret,
-				RedirectUri: r.Form.Get("uri"),
-				UserData:    map[string]interface{}{"AppName": signupResp.UserName},
+			theClient, errMsg := o.newClient(signupResp.UserID, r.Form)
+			if errMsg != "" {
+				log.Printf("processSignup: error[%s]", errMsg)
+				o.showError(w, r, errMsg, http.StatusBadRequest)
+				return
 			}
 
 			authData := &osin.AuthorizeData{
 				Client:      theClient,
-				Scope:       getAllScopes(),
+				Scope:       scopes,
 				RedirectUri: theClient.RedirectUri,
 				ExpiresIn:   int32(o.OAuthConfig.ExpireDays * oneDayInSecs),
 				CreatedAt:   time.Now(),
@@ -334,8 +617,8 @@ func (o *OAuthApi) signup(w http.ResponseWriter, r *http.Request) {
 			// generate token code
 			code, err := o.oauthServer.AuthorizeTokenGen.GenerateAuthorizeToken(authData)
 			if err != nil {
-				log.Print("processSignup: err[%s]", err.Error())
-				showError(w, err.Error(), http.StatusInternalServerError)
+				log.Printf("processSignup: err[%s]", err.Error())
+				o.showError(w, r, err.Error(), http.StatusInternalServerError)
 				return
 			}
 
@@ -344,26 +627,99 @@ func (o *OAuthApi) signup(w http.ResponseWriter, r *http.Request) {
 			log.Printf("processSignup: AuthorizeData %v", authData)
 			if saveErr := o.storage.SaveAuthorize(authData); saveErr != nil {
 				log.Printf("processSignup: error during SaveAuthorize: %s", saveErr.Error())
-				showError(w, error_generic, http.StatusInternalServerError)
+				o.showError(w, r, error_generic, http.StatusInternalServerError)
 			}
 
 			if setErr := o.storage.SetClient(theClient.Id, theClient); setErr != nil {
 				log.Printf("signup error during SetClient: %s", setErr.Error())
-				showError(w, error_generic, http.StatusInternalServerError)
+				o.showError(w, r, error_generic, http.StatusInternalServerError)
 			}
 			log.Print("processSignup: about to announce the details")
-			showSignupSuccess(w, theClient)
+			o.showSignupSuccess(w, r, theClient)
 		}
 		return
 	} else if r.Method == "POST" && formValid == false {
 		log.Printf("processSignup: error[%s]", validationMsg)
-		showError(w, validationMsg, http.StatusBadRequest)
+		o.showError(w, r, validationMsg, http.StatusBadRequest)
 		return
 	} else if r.Method == "GET" {
-		showSignupForm(w)
+		o.showSignupForm(w, r)
 	}
 }
 
+//a setting that is on for the client, those missing from the client user data are off
+func clientSetting(client osin.Client, setting string) bool {
+	if ud, ok := client.GetUserData().(map[string]interface{}); ok {
+		on, _ := ud[setting].(bool)
+		return on
+	}
+	return false
+}
+
+//has the client been set up to always use PKCE, public clients always do so are checked by osin
+func requiresPKCE(client osin.Client) bool {
+	return clientSetting(client, userdata_require_pkce)
+}
+
+//the scopes the client was registered for
+func clientScopes(client osin.Client) string {
+	if ud, ok := client.GetUserData().(map[string]interface{}); ok {
+		if registered, ok := ud[userdata_scope].(string); ok {
+			return registered
+		}
+	}
+	return getAllScopes()
+}
+
+//the tidepool account an app acts for with its own credentials, that of the developer it belongs to. Apps signed up
+//before developers had their own account were signed up with an account of their own which their client_id is
+func clientAccount(client osin.Client) string {
+	if ud, ok := client.GetUserData().(map[string]interface{}); ok {
+		if developerId, ok := ud[clients.UserDataDeveloperId].(string); ok && developerId != "" {
+			return developerId
+		}
+	}
+	return client.GetId()
+}
+
+//the app acts for the account of its developer, it is only given the scopes it was registered for
+func (o *OAuthApi) applyClientCredentials(ar *osin.AccessRequest) (string, string) {
+
+	if clientSetting(ar.Client, userdata_client_credentials) == false || ar.Client.GetSecret() == "" {
+		return osin.E_UNAUTHORIZED_CLIENT, error_client_credentials
+	}
+
+	scope, ok := checkRequestedScopes(ar.Client, ar.Scope)
+	if ok == false {
+		return osin.E_INVALID_SCOPE, error_client_scope
+	}
+	//there is no user to say who they are
+	for _, asked := range splitScopes(scope) {
+		if isOpenIDScope(asked) {
+			return osin.E_INVALID_SCOPE, error_client_openid_scope
+		}
+	}
+	ar.Scope = scope
+
+	ar.UserData = &models.TokenUserData{UserId: clientAccount(ar.Client), AuthTime: time.Now().Unix(), ClientCredentials: true}
+	return "", ""
+}
+
+//is the code or refresh token being exchanged one that we couldn't have issued
+func (o *OAuthApi) malformedGrant(r *http.Request) bool {
+	r.ParseForm()
+
+	switch osin.AccessRequestType(r.Form.Get("grant_type")) {
+	case osin.AUTHORIZATION_CODE:
+		return o.tokenGen.code.Malformed(r.Form.Get("code"))
+	case osin.REFRESH_TOKEN:
+		return o.tokenGen.refresh.Malformed(r.Form.Get("refresh_token"))
+	case grant_type_device_code:
+		return o.tokenGen.device.Malformed(r.Form.Get("device_code"))
+	}
+	return false
+}
+
 /***
  * Implementation of OAuth2 endpoints
  **/
@@ -377,14 +733,41 @@ func (o *OAuthApi) authorize(w http.ResponseWriter, r *http.Request) {
 	log.Print("authorize: off to handle auth request via oauthServer")
 
 	if ar := o.oauthServer.HandleAuthorizeRequest(resp, r); ar != nil {
+
+		if requiresPKCE(ar.Client) && ar.CodeChallenge == "" {
+			log.Printf("authorize: error[%s] client[%s]", error_pkce_required, ar.Client.GetId())
+			resp.SetErrorState(osin.E_INVALID_REQUEST, error_pkce_required, ar.State)
+			osin.OutputJSON(resp, w, r)
+			return
+		}
+		if allowsGrant(ar.Client, string(osin.AUTHORIZATION_CODE)) == false {
+			log.Printf("authorize: error[%s] client[%s]", error_grant_not_registered, ar.Client.GetId())
+			resp.SetErrorState(osin.E_UNAUTHORIZED_CLIENT, error_grant_not_registered, ar.State)
+			osin.OutputJSON(resp, w, r)
+			return
+		}
+
+		scope, ok := checkRequestedScopes(ar.Client, ar.Scope)
+		if ok == false {
+			log.Printf("authorize: error[%s] client[%s] scope[%s]", error_client_scope, ar.Client.GetId(), ar.Scope)
+			resp.SetErrorState(osin.E_INVALID_SCOPE, error_client_scope, ar.State)
+			osin.OutputJSON(resp, w, r)
+			return
+		}
+		ar.Scope = scope
+
 		log.Print("authorize: show the login")
 
-		if o.handleLoginPage(ar, w, r) == false {
+		//the login, consent and deny are only taken from our own forms
+		if o.checkCSRF(w, r) == false {
 			return
 		}
-		log.Printf("authorize: resp code[%s] state[%s] ", resp.Output["code"], resp.Output["state"])
-		ar.Authorized = true
+		if o.handleLoginPage(ar, o.authorizeFormAction(ar), w, r) == false {
+			return
+		}
+		//osin redirects with access_denied when they said no
 		o.oauthServer.FinishAuthorizeRequest(resp, r, ar)
+		log.Printf("authorize: resp code[%s] state[%s] ", resp.Output["code"], resp.Output["state"])
 	}
 	if resp.IsError && resp.InternalError != nil {
 		log.Printf("authorize: stink bro it's all gone pete tong error[%s] code[%d] ", resp.InternalError.Error(), resp.StatusCode)
@@ -400,9 +783,66 @@ func (o *OAuthApi) token(w http.ResponseWriter, r *http.Request) {
 	resp := o.oauthServer.NewResponse()
 	defer resp.Close()
 
+	if o.clientLockedOut(resp, w, r) {
+		return
+	}
+
+	if o.malformedGrant(r) {
+		log.Printf("token: error[%s]", error_malformed_credential)
+		resp.SetError(osin.E_INVALID_GRANT, error_malformed_credential)
+		osin.OutputJSON(resp, w, r)
+		return
+	}
+
+	//osin doesn't know about the device grant
+	if r.Form.Get("grant_type") == grant_type_device_code {
+		o.deviceToken(resp, w, r)
+		return
+	}
+
+	//a public client using PKCE has no secret to give but osin wants to see it as empty
+	if _, hasSecret := r.Form["client_secret"]; !hasSecret && r.Form.Get("code_verifier") != "" && r.Header.Get("Authorization") == "" {
+		r.Form.Set("client_secret", "")
+	}
+
 	if ar := o.oauthServer.HandleAccessRequest(resp, r); ar != nil {
+		if usesAuthMethod(ar.Client, r) == false {
+			log.Printf("token: error[%s] client[%s]", error_auth_not_registered, ar.Client.GetId())
+			resp.SetError(osin.E_INVALID_CLIENT, error_auth_not_registered)
+			resp.StatusCode = http.StatusUnauthorized
+			osin.OutputJSON(resp, w, r)
+			return
+		}
+		if allowsGrant(ar.Client, string(ar.Type)) == false {
+			log.Printf("token: error[%s] client[%s] grant_type[%s]", error_grant_not_registered, ar.Client.GetId(), ar.Type)
+			resp.SetError(osin.E_UNAUTHORIZED_CLIENT, error_grant_not_registered)
+			osin.OutputJSON(resp, w, r)
+			return
+		}
+		//a client not registered for refresh tokens isn't given them
+		ar.GenerateRefresh = ar.GenerateRefresh && allowsGrant(ar.Client, string(osin.REFRESH_TOKEN))
+		if ar.Type == osin.CLIENT_CREDENTIALS {
+			if errorId, description := o.applyClientCredentials(ar); errorId != "" {
+				log.Printf("token: error[%s] client[%s]", description, ar.Client.GetId())
+				resp.SetError(errorId, description)
+				osin.OutputJSON(resp, w, r)
+				return
+			}
+		}
 		ar.Authorized = true
 		o.oauthServer.FinishAccessRequest(resp, r, ar)
+		if resp.IsError == false && ar.Type == osin.REFRESH_TOKEN {
+			//the tokens that have been refreshed can't be used again
+			if err := o.storage.RemoveRefreshAccess(r.Form.Get("refresh_token")); err != nil {
+				log.Printf("token: error[%s] removing the refreshed tokens", err.Error())
+			}
+		}
+		if resp.IsError == false {
+			o.addIdToken(resp, ar)
+		}
+	} else if resp.ErrorId == osin.E_INVALID_CLIENT || resp.ErrorId == osin.E_UNAUTHORIZED_CLIENT {
+		//osin couldn't authenticate the client
+		o.count(o.clientKeys(r)...)
 	}
 	if resp.IsError && resp.InternalError != nil {
 		log.Printf("token: error[%s] status[%d]", resp.InternalError.Error(), resp.StatusCode)
@@ -418,8 +858,243 @@ func (o *OAuthApi) info(w http.ResponseWriter, r *http.Request) {
 	resp := o.oauthServer.NewResponse()
 	defer resp.Close()
 
+	r.ParseForm()
+	if bearer := osin.CheckBearerAuth(r); bearer != nil && o.tokenGen.access.Malformed(bearer.Code) {
+		log.Printf("info: error[%s]", error_malformed_credential)
+		resp.SetError(osin.E_INVALID_REQUEST, error_malformed_credential)
+		osin.OutputJSON(resp, w, r)
+		return
+	}
+
 	if ir := o.oauthServer.HandleInfoRequest(resp, r); ir != nil {
 		o.oauthServer.FinishInfoRequest(resp, r, ir)
+		if resp.IsError == false {
+			o.tokenUsed(ir.AccessData)
+		}
+	}
+	osin.OutputJSON(resp, w, r)
+}
+
+//the tidepool user that authorized the token, there is none when the app was given it as itself
+func authorizingUser(access *osin.AccessData) string {
+	if user := models.GetTokenUserData(access.UserData); user != nil && user.ClientCredentials == false {
+		return user.UserId
+	}
+	return ""
+}
+
+//the tidepool account the token is for, that of the user who authorized it or the one the app acts for
+func tokenAccount(access *osin.AccessData) string {
+	if user := models.GetTokenUserData(access.UserData); user != nil {
+		return user.UserId
+	}
+	return ""
+}
+
+//the client that authenticated the request using basic auth or the client_id and client_secret params
+func (o *OAuthApi) authenticateClient(r *http.Request) osin.Client {
+	r.ParseForm()
+
+	id, secret := r.Form.Get("client_id"), r.Form.Get("client_secret")
+	if auth, err := osin.CheckBasicAuth(r); err != nil {
+		return nil
+	} else if auth != nil {
+		id, secret = auth.Username, auth.Password
+	}
+	if id == "" {
+		return nil
+	}
+	client, err := o.storage.GetClient(id)
+	if err != nil || osin.CheckClientSecret(client, secret) == false {
+		o.count(o.clientKeys(r)...)
+		return nil
+	}
+	if usesAuthMethod(client, r) == false {
+		log.Printf("authenticateClient: error[%s] client[%s]", error_auth_not_registered, id)
+		return nil
+	}
+	return client
+}
+
+//the access the token is for, looking for the type of token hinted at first
+func (o *OAuthApi) loadToken(token, hint string) (access *osin.AccessData, isRefresh bool) {
+	if hint != string(osin.REFRESH_TOKEN) {
+		if access, err := o.storage.LoadAccess(token); err == nil {
+			return access, false
+		}
+	}
+	if access, err := o.storage.LoadRefresh(token); err == nil {
+		return access, true
+	}
+	if hint == string(osin.REFRESH_TOKEN) {
+		if access, err := o.storage.LoadAccess(token); err == nil {
+			return access, false
+		}
+	}
+	return nil, false
+}
+
+//withdraw the permissons the user gave the app once they have no tokens left for it
+func (o *OAuthApi) withdrawPermissons(authorizingUserId, appUserId string) {
+
+	accesses, err := o.storage.LoadUserAccesses(authorizingUserId)
+	if err != nil {
+		log.Printf("withdrawPermissons: error[%s] loading the users tokens", err.Error())
+		return
+	}
+	for i := range accesses {
+		if accesses[i].Client.GetId() == appUserId && authorizingUser(accesses[i]) != "" {
+			log.Printf("withdrawPermissons: user[%s] still has tokens for app[%s]", authorizingUserId, appUserId)
+			return
+		}
+	}
+	if _, err := o.permsApi.SetPermissions(appUserId, authorizingUserId, tpClients.Permissions{}); err != nil {
+		log.Printf("withdrawPermissons: err %v withdrawing the permissons", err)
+		return
+	}
+	//they are asked again should they authorize the app again
+	if err := o.storage.RemoveConsent(authorizingUserId, appUserId); err != nil {
+		log.Printf("withdrawPermissons: error[%s] removing the consent", err.Error())
+	}
+	log.Printf("withdrawPermissons: permissons for app[%s] withdrawn by user[%s]", appUserId, authorizingUserId)
+}
+
+//revoke an access or refresh token, see https://tools.ietf.org/html/rfc7009
+func (o *OAuthApi) revoke(w http.ResponseWriter, r *http.Request) {
+
+	log.Print("revoke: revoking token")
+
+	resp := o.oauthServer.NewResponse()
+	defer resp.Close()
+
+	if o.clientLockedOut(resp, w, r) {
+		return
+	}
+
+	client := o.authenticateClient(r)
+	if client == nil {
+		log.Printf("revoke: error[%s]", error_client_auth)
+		resp.SetError(osin.E_INVALID_CLIENT, error_client_auth)
+		resp.StatusCode = http.StatusUnauthorized
+		osin.OutputJSON(resp, w, r)
+		return
+	}
+
+	token := r.Form.Get("token")
+	if token == "" {
+		log.Printf("revoke: error[%s]", error_token_required)
+		resp.SetError(osin.E_INVALID_REQUEST, error_token_required)
+		resp.StatusCode = http.StatusBadRequest
+		osin.OutputJSON(resp, w, r)
+		return
+	}
+
+	access, isRefresh := o.loadToken(token, r.Form.Get("token_type_hint"))
+	if access == nil {
+		//an unknown token is treated as already revoked
+		log.Print("revoke: no token found")
+		osin.OutputJSON(resp, w, r)
+		return
+	}
+	if access.Client.GetId() != client.GetId() {
+		log.Printf("revoke: error[%s] client[%s]", error_token_other_client, client.GetId())
+		resp.SetError(osin.E_UNAUTHORIZED_CLIENT, error_token_other_client)
+		resp.StatusCode = http.StatusBadRequest
+		osin.OutputJSON(resp, w, r)
+		return
+	}
+
+	//the access token goes with the refresh token it was issued with
+	remove := o.storage.RemoveAccess
+	if isRefresh {
+		remove = o.storage.RemoveRefreshAccess
+	}
+	if err := remove(token); err != nil {
+		log.Printf("revoke: error[%s] removing the access token", err.Error())
+		resp.SetError(osin.E_SERVER_ERROR, error_oauth_service)
+		resp.StatusCode = http.StatusInternalServerError
+		osin.OutputJSON(resp, w, r)
+		return
+	}
+	log.Printf("revoke: token revoked for client[%s]", client.GetId())
+
+	if userId := authorizingUser(access); o.RevokePermissons && userId != "" {
+		o.withdrawPermissons(userId, client.GetId())
+	}
+	osin.OutputJSON(resp, w, r)
+}
+
+//is the request from one of our services using its shoreline server token
+func (o *OAuthApi) isTidepoolServer(r *http.Request) bool {
+	if token := r.Header.Get(tidepool_session_token); token != "" {
+		if td := o.userApi.CheckToken(token); td != nil && td.IsServer {
+			return true
+		}
+	}
+	return false
+}
+
+//tell a resource server about a token, see https://tools.ietf.org/html/rfc7662
+func (o *OAuthApi) introspect(w http.ResponseWriter, r *http.Request) {
+
+	log.Print("introspect: checking token")
+
+	resp := o.oauthServer.NewResponse()
+	defer resp.Close()
+
+	r.ParseForm()
+
+	//our services can ask about any token but a client only its own
+	var client osin.Client
+	if o.isTidepoolServer(r) == false {
+		if o.clientLockedOut(resp, w, r) {
+			return
+		}
+		if client = o.authenticateClient(r); client == nil {
+			log.Printf("introspect: error[%s]", error_introspect_auth)
+			resp.SetError(osin.E_INVALID_CLIENT, error_introspect_auth)
+			resp.StatusCode = http.StatusUnauthorized
+			osin.OutputJSON(resp, w, r)
+			return
+		}
+	}
+
+	token := r.Form.Get("token")
+	resp.Output["active"] = false
+
+	if token == "" || (o.tokenGen.access.Malformed(token) && o.tokenGen.refresh.Malformed(token)) {
+		log.Print("introspect: no token or one we couldn't have issued")
+		osin.OutputJSON(resp, w, r)
+		return
+	}
+
+	access, isRefresh := o.loadToken(token, r.Form.Get("token_type_hint"))
+	if access == nil || (isRefresh == false && access.IsExpired()) {
+		log.Print("introspect: token not found or expired")
+		osin.OutputJSON(resp, w, r)
+		return
+	}
+	if client != nil && access.Client.GetId() != client.GetId() {
+		log.Printf("introspect: token not issued to client[%s]", client.GetId())
+		osin.OutputJSON(resp, w, r)
+		return
+	}
+
+	if isRefresh == false {
+		o.tokenUsed(access)
+	}
+
+	resp.Output["active"] = true
+	resp.Output["scope"] = access.Scope
+	resp.Output["client_id"] = access.Client.GetId()
+	resp.Output["iat"] = access.CreatedAt.Unix()
+	if userId := tokenAccount(access); userId != "" {
+		resp.Output["sub"] = userId
+	}
+	//the refresh token outlives the access token it came with
+	if isRefresh == false {
+		resp.Output["exp"] = access.ExpireAt().Unix()
+		resp.Output["token_type"] = token_type_bearer
 	}
 	osin.OutputJSON(resp, w, r)
 }
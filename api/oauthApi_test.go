@@ -1,20 +1,214 @@
 package api
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/RangelReale/osin"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
 	tpClients "github.com/tidepool-org/go-common/clients"
+	"github.com/tidepool-org/go-common/clients/shoreline"
+
+	"../clients"
+	"../models"
+)
+
+const (
+	test_redirect_uri   = "http://localhost:14000/appauth/code"
+	test_session_token  = "user-session-token"
+	test_csrf_token     = "test-csrf-token"
+	test_wrong_password = "wrong-password"
+	test_issuer         = "http://localhost:8009/oauth"
 )
 
+//the shoreline mock only knows of server sessions, this also knows of the session it gives the user it logs in
+type sessionShoreline struct {
+	*shoreline.ShorelineMockClient
+}
+
+func (c *sessionShoreline) Login(username, password string) (*shoreline.UserData, string, error) {
+	if password == test_wrong_password {
+		return nil, "", errors.New("wrong password")
+	}
+	usr, _, err := c.ShorelineMockClient.Login(username, password)
+	return usr, test_session_token, err
+}
+
+func (c *sessionShoreline) CheckToken(token string) *shoreline.TokenData {
+	if token == test_session_token {
+		return &shoreline.TokenData{UserID: "123.456.789"}
+	}
+	return c.ShorelineMockClient.CheckToken(token)
+}
+
+//an api backed by in-memory storage and mocked tidepool services with a registered client
+//the api with our test client and any others given
+func initTestApi(t *testing.T, others ...*osin.DefaultClient) (*mux.Router, *osin.DefaultClient) {
+	return initTestApiWith(t, OAuthConfig{ExpireDays: 14}, tpClients.NewGatekeeperMock(nil, nil), others...)
+}
+
+func initTestApiWith(t *testing.T, config OAuthConfig, permsApi tpClients.Gatekeeper, others ...*osin.DefaultClient) (*mux.Router, *osin.DefaultClient) {
+	return initTestApiOn(t, newTestStorage(), config, permsApi, others...)
+}
+
+func newTestStorage() clients.Storage {
+	hasher, _ := models.NewTokenHasher("testing secret")
+	return clients.NewHashedStorage(clients.NewMemoryStorage(), hasher, models.NewBcryptVerifier(4))
+}
+
+//the api on the storage given so a test can check what was saved
+func initTestApiOn(t *testing.T, storage clients.Storage, config OAuthConfig, permsApi tpClients.Gatekeeper, others ...*osin.DefaultClient) (*mux.Router, *osin.DefaultClient) {
+
+	theClient := &osin.DefaultClient{
+		Id:          "app-1234",
+		Secret:      "app-secret",
+		RedirectUri: test_redirect_uri,
+		UserData:    map[string]interface{}{"AppName": "test app"},
+	}
+	for _, client := range append(others, theClient) {
+		if err := storage.SetClient(client.Id, client); err != nil {
+			t.Fatalf("SetClient failed %s", err.Error())
+		}
+	}
+
+	if config.OpenID.Issuer == "" {
+		config.OpenID.Issuer = test_issuer
+	}
+
+	api := InitOAuthApi(
+		config,
+		storage,
+		&sessionShoreline{shoreline.NewMock("shoreline-token")},
+		permsApi,
+	)
+
+	rtr := mux.NewRouter()
+	api.SetHandlers("", rtr)
+	return rtr, theClient
+}
+
+//gives a code and exchanges it for a token for the client
+func getToken(t *testing.T, rtr *mux.Router, client *osin.DefaultClient) map[string]interface{} {
+
+	authorizeQuery := url.Values{
+		"response_type": {"code"},
+		"client_id":     {client.Id},
+		"redirect_uri":  {test_redirect_uri},
+	}
+	authorizeRes := loginAndConsent(rtr, "/authorize?"+authorizeQuery.Encode(), scopeView.name, scopeUpload.name)
+	redirect, _ := url.Parse(authorizeRes.Header().Get("Location"))
+
+	tokenRes := doRequest(rtr, "POST", "/token", url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {client.Id},
+		"client_secret": {client.Secret},
+		"redirect_uri":  {test_redirect_uri},
+		"code":          {redirect.Query().Get("code")},
+	})
+
+	var token map[string]interface{}
+	json.NewDecoder(tokenRes.Body).Decode(&token)
+	if token["access_token"] == nil {
+		t.Fatalf("token should have given an access_token but got %v", token)
+	}
+	return token
+}
+
+//gives a code for the scope and exchanges it for a token for a registered client, which authenticates with basic auth
+func getBasicToken(rtr *mux.Router, clientId, secret, scope string) map[string]interface{} {
+
+	authorizeRes := loginAndConsent(rtr, "/authorize?"+url.Values{
+		"response_type": {"code"},
+		"client_id":     {clientId},
+		"redirect_uri":  {test_redirect_uri},
+		"scope":         {scope},
+	}.Encode(), splitScopes(scope)...)
+	redirect, _ := url.Parse(authorizeRes.Header().Get("Location"))
+
+	var token map[string]interface{}
+	json.NewDecoder(doBasicRequest(rtr, "/token", clientId, secret, url.Values{
+		"grant_type":   {"authorization_code"},
+		"redirect_uri": {test_redirect_uri},
+		"code":         {redirect.Query().Get("code")},
+	}).Body).Decode(&token)
+	return token
+}
+
+//the user logs in on the page and, when asked, consents to the scopes given
+func loginAndConsent(rtr *mux.Router, path string, grants ...string) *httptest.ResponseRecorder {
+	res := doRequest(rtr, "POST", path, url.Values{"login": {"user@tidepool.org"}, "password": {"pw"}})
+	handle := loginHandle(res)
+	if res.Code != http.StatusOK || handle == "" {
+		return res
+	}
+	return doRequest(rtr, "POST", path, url.Values{login_handle_field: {handle}, "grant_scope": grants})
+}
+
+var loginHandlePattern = regexp.MustCompile(`name="login_handle" value="([^"]+)"`)
+
+//the login handle the page is posted back with, empty when the page has none
+func loginHandle(res *httptest.ResponseRecorder) string {
+	if found := loginHandlePattern.FindStringSubmatch(res.Body.String()); found != nil {
+		return found[1]
+	}
+	return ""
+}
+
+//the form is posted by a client authenticating with basic auth
+func doBasicRequest(rtr *mux.Router, path, clientId, secret string, form url.Values) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(clientId, secret)
+	res := httptest.NewRecorder()
+	rtr.ServeHTTP(res, req)
+	return res
+}
+
+//the form is posted as the browser would from our page, with the csrf token of its cookie
+func doRequest(rtr *mux.Router, method, path string, form url.Values) *httptest.ResponseRecorder {
+	if method == "POST" && form != nil {
+		posted := url.Values{csrf_field: {test_csrf_token}}
+		for key, values := range form {
+			posted[key] = values
+		}
+		form = posted
+	}
+	req, _ := http.NewRequest(method, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: csrf_cookie, Value: test_csrf_token})
+	res := httptest.NewRecorder()
+	rtr.ServeHTTP(res, req)
+	return res
+}
+
 func Test_signupScope(t *testing.T) {
 
 	formData := make(url.Values)
 	formData[scopeView.name] = []string{scopeView.name}
 	formData[scopeUpload.name] = []string{scopeUpload.name}
 
-	scope := signupScope(formData)
+	scope := selectedScopes(formData)
 
 	expectedScope := scopeView.name + "," + scopeUpload.name
 
@@ -28,10 +222,11 @@ func Test_signupFormValid(t *testing.T) {
 	formData := make(url.Values)
 	formData["usr_name"] = []string{"other"}
 	formData["password"] = []string{"stuff"}
+	formData["password_confirm"] = []string{"stuff"}
 	formData["uri"] = []string{"and"}
 	formData["email"] = []string{"some@more.org"}
 
-	valid := signupFormValid(formData)
+	_, valid := signupFormValid(formData)
 
 	if valid == false {
 		t.Fatalf("form %v should be valid", formData)
@@ -47,7 +242,7 @@ func Test_signupFormValid_false(t *testing.T) {
 	formData["uri"] = []string{"and"}
 	formData["email"] = []string{"some@more.org"}
 
-	valid := signupFormValid(formData)
+	_, valid := signupFormValid(formData)
 
 	if valid {
 		t.Fatalf("form %v should NOT be valid", formData)
@@ -69,24 +264,2093 @@ func Test_applyPermissons(t *testing.T) {
 
 }
 
-func Test_makeScopeOption(t *testing.T) {
+func Test_signupPageScopes(t *testing.T) {
+
+	rtr, _ := initTestApi(t)
+
+	page := doRequest(rtr, "GET", "/signup", nil).Body.String()
+
+	if strings.Contains(page, `type="checkbox" name="`+scopeUpload.name+`"`) == false {
+		t.Fatalf("the signup page should have a checkbox for the scope but gave %s", page)
+	}
+
+	if strings.Contains(page, scopeUpload.requestMsg) == false {
+		t.Fatalf("the signup page should include the scope detail but gave %s", page)
+	}
+
+}
+
+func Test_pagesEscaped(t *testing.T) {
+
+	scriptClient := &osin.DefaultClient{
+		Id:          "script-1234",
+		Secret:      "script-secret",
+		RedirectUri: test_redirect_uri,
+		UserData:    map[string]interface{}{"AppName": "<script>alert('app')</script>"},
+	}
+	rtr, _ := initTestApi(t, scriptClient)
+
+	authorizeQuery := url.Values{
+		"response_type": {"code"},
+		"client_id":     {scriptClient.Id},
+		"redirect_uri":  {test_redirect_uri},
+	}
+	page := doRequest(rtr, "GET", "/authorize?"+authorizeQuery.Encode(), nil).Body.String()
+
+	if strings.Contains(page, "<script>") {
+		t.Fatalf("the app name should be escaped on the login page but gave %s", page)
+	}
+	if strings.Contains(page, "&lt;script&gt;") == false {
+		t.Fatalf("the login page should still show the app name but gave %s", page)
+	}
+}
+
+func Test_templateDir(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "coastline-templates")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	themed := `{{define "content"}}<h1 class="themed">Connect your device</h1>{{end}}`
+	if err := ioutil.WriteFile(filepath.Join(dir, page_device_code), []byte(themed), 0600); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	rtr, _ := initTestApiWith(t, OAuthConfig{ExpireDays: 14, TemplateDir: dir}, tpClients.NewGatekeeperMock(nil, nil))
+
+	if page := doRequest(rtr, "GET", "/device", nil).Body.String(); strings.Contains(page, `<h1 class="themed">`) == false || strings.Contains(page, "<style") == false {
+		t.Fatalf("the device page should be from the template dir in our layout but gave %s", page)
+	}
+	if page := doRequest(rtr, "GET", "/connected", nil).Body.String(); strings.Contains(page, `name="password"`) == false {
+		t.Fatalf("pages not in the template dir should be our own but gave %s", page)
+	}
+
+	if _, err := newViews(filepath.Join(dir, "missing")); err != nil {
+		t.Fatalf("a template dir without templates should give our own but gave error %s", err.Error())
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, template_layout), []byte(`{{define "layout"}`), 0600); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := newViews(dir); err == nil {
+		t.Fatal("a broken template should be an error")
+	}
+}
+
+func Test_csrf(t *testing.T) {
+
+	perms := &recordingGatekeeper{}
+	rtr, theClient := initTestApiOn(t, newTestStorage(), OAuthConfig{ExpireDays: 14}, perms)
+
+	authorizeQuery := url.Values{
+		"response_type": {"code"},
+		"client_id":     {theClient.Id},
+		"redirect_uri":  {test_redirect_uri},
+	}
+	path := "/authorize?" + authorizeQuery.Encode()
+	login := url.Values{"login": {"user@tidepool.org"}, "password": {"pw"}}
+
+	//the login page gives the cookie and its token is on the form
+	req, _ := http.NewRequest("GET", path, nil)
+	page := httptest.NewRecorder()
+	rtr.ServeHTTP(page, req)
+
+	var cookie *http.Cookie
+	for _, c := range page.Result().Cookies() {
+		if c.Name == csrf_cookie {
+			cookie = c
+		}
+	}
+	if cookie == nil || cookie.Value == "" || cookie.HttpOnly == false || cookie.MaxAge != csrf_max_age {
+		t.Fatalf("the login page should give the csrf cookie but gave %v", page.Result().Cookies())
+	}
+	if strings.Contains(page.Body.String(), `name="csrf_token" value="`+cookie.Value+`"`) == false {
+		t.Fatalf("the login form should carry the token of the cookie but gave %s", page.Body.String())
+	}
+
+	post := func(path string, form url.Values, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		res := httptest.NewRecorder()
+		rtr.ServeHTTP(res, req)
+		return res
+	}
+	withToken := func(form url.Values, token string) url.Values {
+		posted := url.Values{csrf_field: {token}}
+		for key, values := range form {
+			posted[key] = values
+		}
+		return posted
+	}
+
+	//a form from another site has neither, or can't know the token of the cookie
+	for _, res := range []*httptest.ResponseRecorder{
+		post(path, login, nil),
+		post(path, login, cookie),
+		post(path, withToken(login, "forged-token"), cookie),
+		post(path, withToken(login, cookie.Value), nil),
+		post(path, url.Values{"deny": {"Deny access to Tidepool"}}, cookie),
+		post("/signup", url.Values{"usr_name": {"app"}, "uri": {test_redirect_uri}, "email": {"dev@tidepool.org"}, "password": {"pw"}, "password_confirm": {"pw"}, "view": {"view"}}, nil),
+		post("/developer", login, nil),
+		post("/connected", login, nil),
+		post("/device", url.Values{"user_code": {"WDJB-MJHT"}}, nil),
+	} {
+		if res.Code != http.StatusForbidden || strings.Contains(res.Body.String(), html.EscapeString(error_csrf)) == false {
+			t.Fatalf("a form without the token gave status %d %s expected %d and the error", res.Code, res.Body.String(), http.StatusForbidden)
+		}
+		if loginHandle(res) != "" || res.Header().Get("Location") != "" {
+			t.Fatalf("a form without the token shouldn't be acted on but gave %s", res.Body.String())
+		}
+	}
+	if perms.permissions != nil {
+		t.Fatalf("no permissons should have been given but %v were", perms.permissions)
+	}
+
+	//our own form is acted on
+	if res := post(path, withToken(login, cookie.Value), cookie); res.Code != http.StatusOK || loginHandle(res) == "" {
+		t.Fatalf("the login with the token should ask for consent but gave %d %s", res.Code, res.Body.String())
+	}
+}
+
+//the whole seconds of the Retry-After given
+func retryAfter(t *testing.T, res *httptest.ResponseRecorder) int {
+	seconds, err := strconv.Atoi(res.Header().Get("Retry-After"))
+	if err != nil {
+		t.Fatalf("got Retry-After [%s] expected the seconds to wait", res.Header().Get("Retry-After"))
+	}
+	return seconds
+}
+
+func Test_throttleLogins(t *testing.T) {
+
+	rtr, _ := initTestApiWith(t, OAuthConfig{ExpireDays: 14, Throttle: ThrottleConfig{LoginLimit: 3, Lockout: "1m"}}, tpClients.NewGatekeeperMock(nil, nil))
+
+	login := func(name, password string) *httptest.ResponseRecorder {
+		return doRequest(rtr, "POST", "/connected", url.Values{"login": {name}, "password": {password}})
+	}
+
+	for i := 0; i < 3; i++ {
+		if res := login("user@tidepool.org", test_wrong_password); res.Code != http.StatusBadRequest {
+			t.Fatalf("a wrong password gave status %d expected %d", res.Code, http.StatusBadRequest)
+		}
+	}
+	//shoreline isn't asked so even the right password is refused until the lockout is over
+	for _, name := range []string{"user@tidepool.org", " USER@tidepool.org"} {
+		res := login(name, "pw")
+		if res.Code != http.StatusTooManyRequests || strings.Contains(res.Body.String(), html.EscapeString(error_throttled)) == false {
+			t.Fatalf("a locked out login gave status %d expected %d", res.Code, http.StatusTooManyRequests)
+		}
+		if wait := retryAfter(t, res); wait <= 0 || wait > 60 {
+			t.Fatalf("got Retry-After %d expected the lockout of a minute", wait)
+		}
+	}
+	//guesses while locked out don't get to shoreline either
+	if res := login("user@tidepool.org", test_wrong_password); res.Code != http.StatusTooManyRequests {
+		t.Fatalf("a guess while locked out gave status %d expected %d", res.Code, http.StatusTooManyRequests)
+	}
+
+	//other users from the same address can still login and their failures are forgotten when they do
+	for i := 0; i < 2; i++ {
+		login("other@tidepool.org", test_wrong_password)
+		login("other@tidepool.org", test_wrong_password)
+		if res := login("other@tidepool.org", "pw"); res.Code != http.StatusOK || strings.Contains(res.Body.String(), html.EscapeString(englishMessages["msg_connected_apps"])) == false {
+			t.Fatalf("another user logging in gave status %d %s", res.Code, res.Body.String())
+		}
+	}
+}
+
+func Test_lockoutPastWindow(t *testing.T) {
+
+	storage := newTestStorage()
+	rtr, _ := initTestApiOn(t, storage, OAuthConfig{ExpireDays: 14, Throttle: ThrottleConfig{LoginLimit: 2, Window: "1m", Lockout: "30m", MaxLockout: "2h"}}, tpClients.NewGatekeeperMock(nil, nil))
+
+	for i := 0; i < 2; i++ {
+		doRequest(rtr, "POST", "/connected", url.Values{"login": {"user@tidepool.org"}, "password": {test_wrong_password}})
+	}
+	res := doRequest(rtr, "POST", "/connected", url.Values{"login": {"user@tidepool.org"}, "password": {"pw"}})
+	if wait := retryAfter(t, res); res.Code != http.StatusTooManyRequests || wait <= 60 {
+		t.Fatalf("got status %d and Retry-After %d expected the lockout of longer than the window", res.Code, wait)
+	}
+
+	//the failures are kept until the lockout is over, not just for the window
+	throttle, err := storage.LoadThrottle("login:user@tidepool.org")
+	if err != nil {
+		t.Fatalf("Error trying to get the failures %s", err.Error())
+	}
+	lockedUntil := throttle.LockedUntil(2, 30*time.Minute, 2*time.Hour)
+	if lockedUntil.Sub(throttle.LastFailureAt) != 30*time.Minute || throttle.ExpiresAt.Before(lockedUntil) {
+		t.Fatalf("got failures %v expected them to be kept until the lockout of half an hour is over", throttle)
+	}
+}
+
+func Test_throttleAddress(t *testing.T) {
+
+	rtr, _ := initTestApiWith(t, OAuthConfig{ExpireDays: 14, Throttle: ThrottleConfig{AddressLimit: 2, SignupLimit: 1, TrustForwardedFor: true}}, tpClients.NewGatekeeperMock(nil, nil))
+
+	from := func(address, path string, form url.Values) *httptest.ResponseRecorder {
+		form.Set(csrf_field, test_csrf_token)
+		req, _ := http.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Forwarded-For", "10.0.0.1, "+address)
+		req.AddCookie(&http.Cookie{Name: csrf_cookie, Value: test_csrf_token})
+		res := httptest.NewRecorder()
+		rtr.ServeHTTP(res, req)
+		return res
+	}
+
+	//guessing a different login each time is still limited by where the guesses come from
+	from("192.0.2.1", "/connected", url.Values{"login": {"a@tidepool.org"}, "password": {test_wrong_password}})
+	from("192.0.2.1", "/connected", url.Values{"login": {"b@tidepool.org"}, "password": {test_wrong_password}})
+	if res := from("192.0.2.1", "/connected", url.Values{"login": {"c@tidepool.org"}, "password": {"pw"}}); res.Code != http.StatusTooManyRequests {
+		t.Fatalf("a login from a locked out address gave status %d expected %d", res.Code, http.StatusTooManyRequests)
+	}
+	if res := from("192.0.2.2", "/connected", url.Values{"login": {"c@tidepool.org"}, "password": {"pw"}}); res.Code != http.StatusOK {
+		t.Fatalf("a login from another address gave status %d expected %d", res.Code, http.StatusOK)
+	}
+
+	signup := url.Values{"usr_name": {"app"}, "uri": {test_redirect_uri}, "email": {"dev@tidepool.org"}, "password": {"pw"}, "password_confirm": {"pw"}, "view": {"view"}}
+	if res := from("192.0.2.3", "/signup", signup); res.Code != http.StatusOK {
+		t.Fatalf("the signup gave status %d %s", res.Code, res.Body.String())
+	}
+	if res := from("192.0.2.3", "/signup", signup); res.Code != http.StatusTooManyRequests || retryAfter(t, res) <= 0 {
+		t.Fatalf("another signup from the address gave status %d expected %d", res.Code, http.StatusTooManyRequests)
+	}
+}
+
+func Test_throttleBehindProxy(t *testing.T) {
+
+	//not trusting X-Forwarded-For every request has the proxy's address
+	rtr, _ := initTestApi(t)
+
+	//so it isn't counted against as that would lock everyone out
+	for i := 0; i <= default_address_limit; i++ {
+		doRequest(rtr, "POST", "/connected", url.Values{"login": {fmt.Sprintf("user%d@tidepool.org", i)}, "password": {test_wrong_password}})
+	}
+	if res := doRequest(rtr, "POST", "/connected", url.Values{"login": {"user@tidepool.org"}, "password": {"pw"}}); res.Code != http.StatusOK {
+		t.Fatalf("a login after others failed through the proxy gave status %d expected %d", res.Code, http.StatusOK)
+	}
+
+	signup := url.Values{"usr_name": {"app"}, "uri": {test_redirect_uri}, "email": {"dev@tidepool.org"}, "password": {"pw"}, "password_confirm": {"pw"}, "view": {"view"}}
+	for i := 0; i <= default_signup_limit; i++ {
+		if res := doRequest(rtr, "POST", "/signup", signup); res.Code != http.StatusOK {
+			t.Fatalf("signup %d through the proxy gave status %d expected %d", i, res.Code, http.StatusOK)
+		}
+	}
+}
+
+func Test_throttleClients(t *testing.T) {
+
+	otherClient := &osin.DefaultClient{Id: "other-1234", Secret: "other-secret", RedirectUri: test_redirect_uri, UserData: map[string]interface{}{"AppName": "other app"}}
+	rtr, theClient := initTestApiWith(t, OAuthConfig{ExpireDays: 14, Throttle: ThrottleConfig{ClientLimit: 2}}, tpClients.NewGatekeeperMock(nil, nil), otherClient)
+
+	guess := func(path string, client *osin.DefaultClient, secret string) (*httptest.ResponseRecorder, map[string]interface{}) {
+		res := doRequest(rtr, "POST", path, url.Values{"grant_type": {"client_credentials"}, "token": {"some-token"}, "client_id": {client.Id}, "client_secret": {secret}})
+		var body map[string]interface{}
+		json.NewDecoder(res.Body).Decode(&body)
+		return res, body
+	}
+
+	guess("/token", theClient, "wrong-secret")
+	guess("/revoke", theClient, "wrong-secret")
+
+	for _, path := range []string{"/token", "/revoke", "/introspect", "/device/code"} {
+		res, body := guess(path, theClient, theClient.Secret)
+		if res.Code != http.StatusTooManyRequests || body["error"] != osin.E_TEMPORARILY_UNAVAILABLE || retryAfter(t, res) <= 0 {
+			t.Fatalf("%s with the right secret once locked out gave status %d %v", path, res.Code, body)
+		}
+	}
+	if res, body := guess("/revoke", otherClient, otherClient.Secret); res.Code != http.StatusOK {
+		t.Fatalf("another client gave status %d %v", res.Code, body)
+	}
+}
+
+func Test_acceptedLanguages(t *testing.T) {
+
+	got := acceptedLanguages("fr;q=0.5, es-MX, *;q=0.1, de;q=0, en;q=0.8")
+	if strings.Join(got, ",") != "es-MX,en,fr" {
+		t.Fatalf("got %v expected the languages most wanted first without those not wanted", got)
+	}
+
+	c := &catalog{languages: map[string]messages{default_language: englishMessages, "es": englishMessages, "pt-br": englishMessages}}
+	for preferred, expected := range map[string]string{
+		"es-MX":    "es",
+		"pt_BR es": "pt-br",
+		"pt es":    "es",
+		"fr de":    default_language,
+	} {
+		if lang := c.language(strings.Fields(preferred)); lang != expected {
+			t.Fatalf("got %s for %s expected %s", lang, preferred, expected)
+		}
+	}
+}
+
+func Test_localizedPages(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "coastline-messages")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	spanish := `{"btn_authorize": "Conceder acceso a Tidepool", "scope_view_grant": "Permitir ver los datos en su nombre", "error_device_user_code": "lo sentimos pero no conocemos ese código"}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "es.json"), []byte(spanish), 0600); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	rtr, theClient := initTestApiWith(t, OAuthConfig{ExpireDays: 14, MessageDir: dir}, tpClients.NewGatekeeperMock(nil, nil))
+
+	authorizeQuery := url.Values{
+		"response_type": {"code"},
+		"client_id":     {theClient.Id},
+		"redirect_uri":  {test_redirect_uri},
+		"scope":         {scopeView.name},
+	}
+	inSpanish := func(path string) string {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Header.Set("Accept-Language", "es-ES,es;q=0.9,en;q=0.5")
+		res := httptest.NewRecorder()
+		rtr.ServeHTTP(res, req)
+		return res.Body.String()
+	}
+
+	page := inSpanish("/authorize?" + authorizeQuery.Encode())
+	if strings.Contains(page, `lang="es"`) == false || strings.Contains(page, "Conceder acceso a Tidepool") == false || strings.Contains(page, "Permitir ver los datos") == false {
+		t.Fatalf("the login page should be in spanish but gave %s", page)
+	}
+	if strings.Contains(page, "ui_locales=") == false {
+		t.Fatalf("the login form should post back the ui_locales asked for but gave %s", page)
+	}
+	//what hasn't been translated is in english
+	if strings.Contains(page, "Deny access to Tidepool") == false {
+		t.Fatalf("the login page should fall back to english but gave %s", page)
+	}
+	//ui_locales comes before the browser
+	authorizeQuery.Set("ui_locales", "en")
+	if page := inSpanish("/authorize?" + authorizeQuery.Encode()); strings.Contains(page, "Grant access to Tidepool") == false {
+		t.Fatalf("the login page should be in the ui_locales asked for but gave %s", page)
+	}
+	if page := inSpanish("/device?user_code=WDJB-MJHT"); strings.Contains(page, "no conocemos ese código") == false {
+		t.Fatalf("the error should be in spanish but gave %s", page)
+	}
+	if page := doRequest(rtr, "GET", "/authorize?"+authorizeQuery.Encode(), nil).Body.String(); strings.Contains(page, `lang="en"`) == false {
+		t.Fatalf("the login page should be in english without a language asked for but gave %s", page)
+	}
+
+	var metadata map[string]interface{}
+	json.NewDecoder(doRequest(rtr, "GET", "/.well-known/oauth-authorization-server", nil).Body).Decode(&metadata)
+	if locales, _ := json.Marshal(metadata["ui_locales_supported"]); string(locales) != `["en","es"]` {
+		t.Fatalf("got ui_locales_supported %s expected the languages we have", locales)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "fr.json"), []byte(`{"btn_authorize": `), 0600); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := newCatalog(dir); err == nil {
+		t.Fatal("a broken translation should be an error")
+	}
+}
+
+func Test_authorizeTokenInfoFlow(t *testing.T) {
+
+	rtr, theClient := initTestApi(t)
+
+	/*
+	 * authorize with the users tidepool login
+	 */
+	authorizeQuery := url.Values{
+		"response_type": {"code"},
+		"client_id":     {theClient.Id},
+		"redirect_uri":  {test_redirect_uri},
+		"state":         {"some-state"},
+	}
+
+	authorizeRes := loginAndConsent(rtr, "/authorize?"+authorizeQuery.Encode(), scopeView.name, scopeUpload.name)
+
+	if authorizeRes.Code != http.StatusFound {
+		t.Fatalf("authorize gave status %d expected %d", authorizeRes.Code, http.StatusFound)
+	}
+
+	redirect, _ := url.Parse(authorizeRes.Header().Get("Location"))
+	code := redirect.Query().Get("code")
+
+	if code == "" {
+		t.Fatalf("authorize redirect [%s] should include a code", redirect.String())
+	}
+	if redirect.Query().Get("state") != "some-state" {
+		t.Fatalf("authorize redirect [%s] should include the state", redirect.String())
+	}
+
+	/*
+	 * exchange the code for a token
+	 */
+	tokenRes := doRequest(rtr, "POST", "/token", url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {theClient.Id},
+		"client_secret": {theClient.Secret},
+		"redirect_uri":  {test_redirect_uri},
+		"code":          {code},
+	})
+
+	var token map[string]interface{}
+	json.NewDecoder(tokenRes.Body).Decode(&token)
+
+	if token["access_token"] == nil || token["access_token"] == "" {
+		t.Fatalf("token should have given an access_token but got %v", token)
+	}
+	if strings.HasPrefix(token["access_token"].(string), models.AccessTokenPrefix) == false {
+		t.Fatalf("the access_token %v should be prefixed with %s", token["access_token"], models.AccessTokenPrefix)
+	}
+
+	/*
+	 * the token is known to the info endpoint
+	 */
+	infoRes := doRequest(rtr, "GET", "/info?code="+url.QueryEscape(token["access_token"].(string)), url.Values{})
+
+	var info map[string]interface{}
+	json.NewDecoder(infoRes.Body).Decode(&info)
+
+	if info["client_id"] != theClient.Id {
+		t.Fatalf("info gave %v expected client_id %s", info, theClient.Id)
+	}
+}
+
+func Test_tokenMalformedCode(t *testing.T) {
+
+	rtr, theClient := initTestApi(t)
+
+	tokenRes := doRequest(rtr, "POST", "/token", url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {theClient.Id},
+		"client_secret": {theClient.Secret},
+		"redirect_uri":  {test_redirect_uri},
+		"code":          {models.AuthorizeCodePrefix + "not-a-code-we-gave-out"},
+	})
+
+	var token map[string]interface{}
+	json.NewDecoder(tokenRes.Body).Decode(&token)
+
+	if token["error"] != osin.E_INVALID_GRANT || token["error_description"] != error_malformed_credential {
+		t.Fatalf("token should have refused the malformed code but got %v", token)
+	}
+}
+
+func Test_authorizeTokenPKCE(t *testing.T) {
+
+	publicClient := &osin.DefaultClient{
+		Id:          "public-1234",
+		RedirectUri: test_redirect_uri,
+		UserData:    map[string]interface{}{"AppName": "public app", "RequirePKCE": true},
+	}
+	rtr, _ := initTestApi(t, publicClient)
+
+	const verifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	sum := sha256.Sum256([]byte(verifier))
+
+	authorizeQuery := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {publicClient.Id},
+		"redirect_uri":          {test_redirect_uri},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	authorizeRes := loginAndConsent(rtr, "/authorize?"+authorizeQuery.Encode(), scopeView.name, scopeUpload.name)
+
+	redirect, _ := url.Parse(authorizeRes.Header().Get("Location"))
+	code := redirect.Query().Get("code")
+
+	if code == "" {
+		t.Fatalf("authorize redirect [%s] should include a code", redirect.String())
+	}
+
+	tokenForm := url.Values{
+		"grant_type":   {"authorization_code"},
+		"client_id":    {publicClient.Id},
+		"redirect_uri": {test_redirect_uri},
+		"code":         {code},
+	}
+
+	var token map[string]interface{}
+	json.NewDecoder(doRequest(rtr, "POST", "/token", tokenForm).Body).Decode(&token)
+
+	if token["access_token"] != nil {
+		t.Fatalf("token should NOT be given without the code_verifier but got %v", token)
+	}
+
+	tokenForm.Set("code_verifier", verifier)
+	json.NewDecoder(doRequest(rtr, "POST", "/token", tokenForm).Body).Decode(&token)
+
+	if token["access_token"] == nil || token["access_token"] == "" {
+		t.Fatalf("token should have given an access_token with the code_verifier but got %v", token)
+	}
+}
+
+func Test_authorizePKCERequired(t *testing.T) {
+
+	pkceClient := &osin.DefaultClient{
+		Id:          "pkce-1234",
+		Secret:      "pkce-secret",
+		RedirectUri: test_redirect_uri,
+		UserData:    map[string]interface{}{"AppName": "pkce app", "RequirePKCE": true},
+	}
+	rtr, _ := initTestApi(t, pkceClient)
+
+	authorizeQuery := url.Values{
+		"response_type": {"code"},
+		"client_id":     {pkceClient.Id},
+		"redirect_uri":  {test_redirect_uri},
+		"state":         {"some-state"},
+	}
+
+	authorizeRes := loginAndConsent(rtr, "/authorize?"+authorizeQuery.Encode(), scopeView.name, scopeUpload.name)
+
+	redirect, _ := url.Parse(authorizeRes.Header().Get("Location"))
+
+	if redirect.Query().Get("code") != "" || redirect.Query().Get("error") != osin.E_INVALID_REQUEST {
+		t.Fatalf("authorize redirect [%s] should be an error without the code_challenge", redirect.String())
+	}
+}
+
+func Test_authorizeScopeNotRegistered(t *testing.T) {
+
+	viewClient := &osin.DefaultClient{
+		Id:          "dashboard-1234",
+		Secret:      "dashboard-secret",
+		RedirectUri: test_redirect_uri,
+		UserData:    map[string]interface{}{"AppName": "dashboard", "Scope": "view"},
+	}
+	rtr, _ := initTestApi(t, viewClient)
+
+	authorizeQuery := url.Values{
+		"response_type": {"code"},
+		"client_id":     {viewClient.Id},
+		"redirect_uri":  {test_redirect_uri},
+		"scope":         {"view upload"},
+	}
+
+	authorizeRes := loginAndConsent(rtr, "/authorize?"+authorizeQuery.Encode(), scopeView.name, scopeUpload.name)
+
+	redirect, _ := url.Parse(authorizeRes.Header().Get("Location"))
+
+	if redirect.Query().Get("code") != "" || redirect.Query().Get("error") != osin.E_INVALID_SCOPE {
+		t.Fatalf("authorize redirect [%s] should be an error for a scope the client wasn't registered for", redirect.String())
+	}
+}
+
+func Test_authorizeGrantedScopes(t *testing.T) {
+
+	perms := &recordingGatekeeper{}
+	rtr, theClient := initTestApiWith(t, OAuthConfig{ExpireDays: 14}, perms)
 
-	option := makeScopeOption(scopeUpload)
+	authorizeQuery := url.Values{
+		"response_type": {"code"},
+		"client_id":     {theClient.Id},
+		"redirect_uri":  {test_redirect_uri},
+		"scope":         {"view upload"},
+	}
+	path := "/authorize?" + authorizeQuery.Encode()
 
-	if option == "" {
-		t.Fatal("makeScopeOption returned something")
+	if res := loginAndConsent(rtr, path); res.Code != http.StatusBadRequest {
+		t.Fatalf("authorize gave status %d expected %d when nothing was granted", res.Code, http.StatusBadRequest)
 	}
 
-	if strings.Contains(option, "type=\"checkbox\"") == false {
-		t.Fatal("makeScopeOption should be a checkbox")
+	authorizeRes := loginAndConsent(rtr, path, scopeView.name)
+	redirect, _ := url.Parse(authorizeRes.Header().Get("Location"))
+
+	tokenRes := doRequest(rtr, "POST", "/token", url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {theClient.Id},
+		"client_secret": {theClient.Secret},
+		"redirect_uri":  {test_redirect_uri},
+		"code":          {redirect.Query().Get("code")},
+	})
+
+	var token map[string]interface{}
+	json.NewDecoder(tokenRes.Body).Decode(&token)
+
+	if token["scope"] != scopeView.name {
+		t.Fatalf("token %v should only have the granted scope %s", token, scopeView.name)
 	}
+	if _, ok := perms.permissions[scopeUpload.name]; ok || len(perms.permissions) != 1 {
+		t.Fatalf("only the %s permisson should have been given but got %v", scopeView.name, perms.permissions)
+	}
+}
 
-	if strings.Contains(option, scopeUpload.name) == false {
-		t.Fatal("makeScopeOption should include the scope name")
+func Test_consentLoginHandle(t *testing.T) {
+
+	rtr, theClient := initTestApiWith(t, OAuthConfig{ExpireDays: 14}, &recordingGatekeeper{})
+
+	path := "/authorize?" + url.Values{
+		"response_type": {"code"},
+		"client_id":     {theClient.Id},
+		"redirect_uri":  {test_redirect_uri},
+		"scope":         {scopeView.name},
+	}.Encode()
+
+	//a failed login gives the one login page with the error
+	failed := doRequest(rtr, "POST", path, url.Values{"login": {"user@tidepool.org"}, "password": {test_wrong_password}})
+	if failed.Code != http.StatusBadRequest || strings.Count(failed.Body.String(), "</html>") != 1 {
+		t.Fatalf("a failed login gave status %d and %s", failed.Code, failed.Body.String())
 	}
 
-	if strings.Contains(option, scopeUpload.detail) == false {
-		t.Fatal("makeScopeOption should include the scope detail")
+	consentRes := doRequest(rtr, "POST", path, url.Values{"login": {"user@tidepool.org"}, "password": {"pw"}})
+	handle := loginHandle(consentRes)
+	if handle == "" || strings.Contains(consentRes.Body.String(), test_session_token) {
+		t.Fatalf("the consent page should carry a login handle and never the session but gave %s", consentRes.Body.String())
 	}
 
+	//the session isn't taken back in place of a handle
+	if res := doRequest(rtr, "POST", path, url.Values{"session_token": {test_session_token}, "grant_scope": {scopeView.name}}); res.Code == http.StatusFound {
+		t.Fatal("the session token should not be accepted by the consent page")
+	}
+
+	//nor is a handle for another page
+	if res := doRequest(rtr, "POST", "/connected", url.Values{login_handle_field: {handle}}); loginHandle(res) != "" {
+		t.Fatalf("the consent handle should not open the connected apps but gave %s", res.Body.String())
+	}
+
+	//and a handle is only used the once
+	consentRes = doRequest(rtr, "POST", path, url.Values{"login": {"user@tidepool.org"}, "password": {"pw"}})
+	handle = loginHandle(consentRes)
+	if res := doRequest(rtr, "POST", path, url.Values{login_handle_field: {handle}, "grant_scope": {scopeView.name}}); res.Code != http.StatusFound {
+		t.Fatalf("consenting gave status %d expected %d", res.Code, http.StatusFound)
+	}
+	if res := doRequest(rtr, "POST", path, url.Values{login_handle_field: {handle}, "grant_scope": {scopeView.name}}); res.Code == http.StatusFound {
+		t.Fatal("a used login handle should not be accepted again")
+	}
+}
+
+func Test_rememberedConsent(t *testing.T) {
+
+	perms := &recordingGatekeeper{}
+	rtr, theClient := initTestApiWith(t, OAuthConfig{ExpireDays: 14}, perms)
+
+	authorizePath := func(scope string) string {
+		return "/authorize?" + url.Values{
+			"response_type": {"code"},
+			"client_id":     {theClient.Id},
+			"redirect_uri":  {test_redirect_uri},
+			"scope":         {scope},
+		}.Encode()
+	}
+	login := url.Values{"login": {"user@tidepool.org"}, "password": {"pw"}}
+
+	if res := loginAndConsent(rtr, authorizePath("view"), scopeView.name); res.Code != http.StatusFound {
+		t.Fatalf("the first authorize gave status %d expected %d", res.Code, http.StatusFound)
+	}
+
+	/*
+	 * a returning user isn't asked again for what they already gave
+	 */
+	perms.permissions = nil
+	if res := doRequest(rtr, "POST", authorizePath("view"), login); res.Code != http.StatusFound {
+		t.Fatalf("authorizing again gave status %d expected %d without being asked to consent", res.Code, http.StatusFound)
+	}
+	if perms.permissions != nil {
+		t.Fatalf("the permissons were already given but were set again %v", perms.permissions)
+	}
+
+	/*
+	 * they are only asked for the new scopes
+	 */
+	consentRes := doRequest(rtr, "POST", authorizePath("view upload"), login)
+	if strings.Contains(consentRes.Body.String(), "value=\"upload\"") == false || strings.Contains(consentRes.Body.String(), "value=\"view\"") {
+		t.Fatalf("the consent page should only ask for the new scope but gave %s", consentRes.Body.String())
+	}
+
+	authorizeRes := loginAndConsent(rtr, authorizePath("view upload"), scopeUpload.name)
+	redirect, _ := url.Parse(authorizeRes.Header().Get("Location"))
+
+	tokenRes := doRequest(rtr, "POST", "/token", url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {theClient.Id},
+		"client_secret": {theClient.Secret},
+		"redirect_uri":  {test_redirect_uri},
+		"code":          {redirect.Query().Get("code")},
+	})
+	var token map[string]interface{}
+	json.NewDecoder(tokenRes.Body).Decode(&token)
+
+	if token["scope"] != "view,upload" {
+		t.Fatalf("token %v should have both the consented scopes", token)
+	}
+	if len(perms.permissions) != 2 {
+		t.Fatalf("both permissons should have been given but got %v", perms.permissions)
+	}
+}
+
+func Test_authorizeDeny(t *testing.T) {
+
+	storage := newTestStorage()
+	perms := &recordingGatekeeper{}
+	rtr, theClient := initTestApiOn(t, storage, OAuthConfig{ExpireDays: 14}, perms)
+
+	authorizeQuery := url.Values{
+		"response_type": {"code"},
+		"client_id":     {theClient.Id},
+		"redirect_uri":  {test_redirect_uri},
+		"state":         {"some-state"},
+		"scope":         {"view"},
+	}
+
+	if res := doRequest(rtr, "GET", "/authorize?"+authorizeQuery.Encode(), url.Values{}); strings.Contains(res.Body.String(), "name=\"deny\"") == false {
+		t.Fatalf("the login page should let the user deny access but gave %s", res.Body.String())
+	}
+
+	authorizeRes := doRequest(rtr, "POST", "/authorize?"+authorizeQuery.Encode(), url.Values{"deny": {"Deny access to Tidepool"}})
+
+	if authorizeRes.Code != http.StatusFound {
+		t.Fatalf("deny gave status %d expected %d", authorizeRes.Code, http.StatusFound)
+	}
+	redirect, _ := url.Parse(authorizeRes.Header().Get("Location"))
+
+	if strings.HasPrefix(redirect.String(), test_redirect_uri) == false || redirect.Query().Get("code") != "" ||
+		redirect.Query().Get("error") != osin.E_ACCESS_DENIED || redirect.Query().Get("state") != "some-state" {
+		t.Fatalf("deny redirect [%s] should be access_denied with the state", redirect.String())
+	}
+	if perms.permissions != nil {
+		t.Fatalf("no permissons should have been given but got %v", perms.permissions)
+	}
+
+	if audits, _ := storage.LoadAudits(theClient.Id); len(audits) != 1 || audits[0].Event != models.AuditAccessDenied || audits[0].Scope != "view" {
+		t.Fatalf("got audits %v expected the access to have been denied", audits)
+	}
+}
+
+func Test_connectedApps(t *testing.T) {
+
+	storage := newTestStorage()
+	perms := &recordingGatekeeper{}
+	rtr, theClient := initTestApiOn(t, storage, OAuthConfig{ExpireDays: 14}, perms)
+
+	token := getToken(t, rtr, theClient)
+	doRequest(rtr, "GET", "/info?code="+url.QueryEscape(token["access_token"].(string)), url.Values{})
+
+	withSession := func(method, path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, nil)
+		req.Header.Set("x-tidepool-session-token", test_session_token)
+		res := httptest.NewRecorder()
+		rtr.ServeHTTP(res, req)
+		return res
+	}
+
+	if res := doRequest(rtr, "GET", "/connected/apps", url.Values{}); res.Code != http.StatusUnauthorized {
+		t.Fatalf("connected apps without a session gave status %d expected %d", res.Code, http.StatusUnauthorized)
+	}
+
+	var connected struct {
+		Apps []connectedApp `json:"apps"`
+	}
+	json.NewDecoder(withSession("GET", "/connected/apps").Body).Decode(&connected)
+
+	if len(connected.Apps) != 1 {
+		t.Fatalf("got %v expected the one connected app", connected.Apps)
+	}
+	if app := connected.Apps[0]; app.ClientId != theClient.Id || app.AppName != "test app" || app.Scope != "view,upload" || app.GrantedAt == 0 || app.LastUsedAt == 0 {
+		t.Fatalf("got %v expected the details of the connected app", app)
+	}
+
+	page := doRequest(rtr, "POST", "/connected", url.Values{"login": {"user@tidepool.org"}, "password": {"pw"}})
+	if strings.Contains(page.Body.String(), "test app") == false || strings.Contains(page.Body.String(), `name="disconnect"`) == false {
+		t.Fatalf("the connected page should list the app but gave %s", page.Body.String())
+	}
+
+	/*
+	 * the user disconnects the app
+	 */
+	if res := withSession("DELETE", "/connected/apps/other-app"); res.Code != http.StatusNotFound {
+		t.Fatalf("disconnecting an app that isn't connected gave status %d expected %d", res.Code, http.StatusNotFound)
+	}
+	if res := withSession("DELETE", "/connected/apps/"+theClient.Id); res.Code != http.StatusOK {
+		t.Fatalf("disconnecting the app gave status %d expected %d", res.Code, http.StatusOK)
+	}
+
+	var info map[string]interface{}
+	json.NewDecoder(doRequest(rtr, "GET", "/info?code="+url.QueryEscape(token["access_token"].(string)), url.Values{}).Body).Decode(&info)
+	if info["error"] == nil {
+		t.Fatalf("the token should have been removed but info gave %v", info)
+	}
+	if perms.permissions == nil || len(perms.permissions) != 0 {
+		t.Fatalf("the permissons should have been withdrawn but got %v", perms.permissions)
+	}
+	json.NewDecoder(withSession("GET", "/connected/apps").Body).Decode(&connected)
+	if len(connected.Apps) != 0 {
+		t.Fatalf("got %v expected no connected apps", connected.Apps)
+	}
+	if audits, _ := storage.LoadAudits(theClient.Id); len(audits) != 1 || audits[0].Event != models.AuditAppDisconnected {
+		t.Fatalf("got audits %v expected the app to have been disconnected", audits)
+	}
+}
+
+func Test_connectedPage(t *testing.T) {
+
+	perms := &recordingGatekeeper{}
+	rtr, theClient := initTestApiWith(t, OAuthConfig{ExpireDays: 14}, perms)
+	getToken(t, rtr, theClient)
+
+	failed := doRequest(rtr, "POST", "/connected", url.Values{"login": {"user@tidepool.org"}, "password": {test_wrong_password}})
+	if failed.Code != http.StatusBadRequest || strings.Count(failed.Body.String(), "</html>") != 1 || strings.Contains(failed.Body.String(), `name="password"`) == false {
+		t.Fatalf("a failed login should give the one login page but gave status %d and %s", failed.Code, failed.Body.String())
+	}
+
+	page := doRequest(rtr, "POST", "/connected", url.Values{"login": {"user@tidepool.org"}, "password": {"pw"}})
+	handle := loginHandle(page)
+	if handle == "" || strings.Contains(page.Body.String(), test_session_token) {
+		t.Fatalf("the connected page should carry a login handle and never the session but gave %s", page.Body.String())
+	}
+
+	if res := doRequest(rtr, "POST", "/connected", url.Values{"session_token": {test_session_token}, "client_id": {theClient.Id}, "disconnect": {"disconnect"}}); strings.Contains(res.Body.String(), `name="disconnect"`) {
+		t.Fatal("the session token should not be accepted by the connected page")
+	}
+
+	/*
+	 * the user disconnects the app from the page
+	 */
+	disconnected := doRequest(rtr, "POST", "/connected", url.Values{login_handle_field: {handle}, "client_id": {theClient.Id}, "disconnect": {"disconnect"}})
+	if disconnected.Code != http.StatusOK || strings.Contains(disconnected.Body.String(), "test app") || perms.permissions == nil || len(perms.permissions) != 0 {
+		t.Fatalf("the app should have been disconnected but gave %s", disconnected.Body.String())
+	}
+	if res := doRequest(rtr, "POST", "/connected", url.Values{login_handle_field: {handle}}); strings.Contains(res.Body.String(), `name="password"`) == false {
+		t.Fatalf("a used login handle should give the login page but gave %s", res.Body.String())
+	}
+}
+
+func Test_developerPortal(t *testing.T) {
+
+	storage := newTestStorage()
+	perms := &recordingGatekeeper{}
+	rtr, theClient := initTestApiOn(t, storage, OAuthConfig{ExpireDays: 14}, perms)
+
+	if res := doRequest(rtr, "GET", "/developer", url.Values{}); strings.Contains(res.Body.String(), "password") == false {
+		t.Fatalf("the portal should ask the developer to login but gave %s", res.Body.String())
+	}
+
+	/*
+	 * the developer adds an app
+	 */
+	res := doRequest(rtr, "POST", "/developer", url.Values{
+		"login":    {"user@tidepool.org"},
+		"password": {"pw"},
+		"action":   {"create"},
+		"usr_name": {"my app"},
+		"uri":      {test_redirect_uri + "\nhttp://localhost:14000/other"},
+		"view":     {"view"},
+	})
+	if strings.Contains(res.Body.String(), "client_secret=") == false {
+		t.Fatalf("the new app should be shown with its secret but gave %s", res.Body.String())
+	}
+
+	apps, _ := storage.LoadDeveloperClients("123.456.789")
+	if len(apps) != 1 || len(apps[0].GetId()) != 36 || apps[0].GetRedirectUri() != test_redirect_uri+" http://localhost:14000/other" {
+		t.Fatalf("got %v expected the developer's new app with its own client_id", apps)
+	}
+	app := apps[0]
+
+	authorizeRes := loginAndConsent(rtr, "/authorize?"+url.Values{
+		"response_type": {"code"},
+		"client_id":     {app.GetId()},
+		"redirect_uri":  {"http://localhost:14000/other"},
+	}.Encode(), scopeView.name)
+	if authorizeRes.Code != http.StatusFound || strings.HasPrefix(authorizeRes.Header().Get("Location"), "http://localhost:14000/other") == false {
+		t.Fatalf("authorizing with any of the app's redirect_uris gave %d %s", authorizeRes.Code, authorizeRes.Header().Get("Location"))
+	}
+
+	if strings.Contains(res.Body.String(), test_session_token) {
+		t.Fatalf("the portal should never be given the session but gave %s", res.Body.String())
+	}
+
+	/*
+	 * the developer changes and then deletes their app but not those of others
+	 */
+	handle := loginHandle(res)
+	manage := func(action, clientId string) *httptest.ResponseRecorder {
+		res := doRequest(rtr, "POST", "/developer", url.Values{
+			login_handle_field: {handle},
+			"action":           {action},
+			"client_id":        {clientId},
+			"usr_name":         {"renamed app"},
+			"uri":              {test_redirect_uri},
+			"upload":           {"upload"},
+		})
+		handle = loginHandle(res)
+		return res
+	}
+
+	if res := doRequest(rtr, "POST", "/developer", url.Values{"session_token": {test_session_token}, "action": {"delete"}, "client_id": {app.GetId()}}); strings.Contains(res.Body.String(), `name="password"`) == false {
+		t.Fatalf("the session token should not be accepted by the portal but gave %s", res.Body.String())
+	}
+	if res := manage("update", theClient.Id); res.Code != http.StatusNotFound || strings.Count(res.Body.String(), "</html>") != 1 || handle == "" {
+		t.Fatalf("changing another developer's app gave status %d expected %d on the one page", res.Code, http.StatusNotFound)
+	}
+	incomplete := doRequest(rtr, "POST", "/developer", url.Values{login_handle_field: {handle}, "action": {"create"}, "usr_name": {"no uris"}})
+	if handle = loginHandle(incomplete); incomplete.Code != http.StatusBadRequest || strings.Count(incomplete.Body.String(), "</html>") != 1 || handle == "" {
+		t.Fatalf("creating an app without all its details gave status %d expected %d on the one page", incomplete.Code, http.StatusBadRequest)
+	}
+
+	manage("update", app.GetId())
+	if updated, _ := storage.GetClient(app.GetId()); appName(updated) != "renamed app" || clientScopes(updated) != "upload" || updated.GetRedirectUri() != test_redirect_uri {
+		t.Fatalf("got %v expected the app to have been changed", updated)
+	}
+
+	manage("delete", app.GetId())
+	if _, err := storage.GetClient(app.GetId()); err == nil {
+		t.Fatal("the app should have been deleted")
+	}
+	if perms.permissions == nil || len(perms.permissions) != 0 {
+		t.Fatalf("the permissons given to the app should have been withdrawn but got %v", perms.permissions)
+	}
+}
+
+func Test_withdrawScopes(t *testing.T) {
+
+	storage := newTestStorage()
+	perms := &recordingGatekeeper{}
+	rtr, _ := initTestApiOn(t, storage, OAuthConfig{ExpireDays: 14}, perms)
+
+	created := doRequest(rtr, "POST", "/developer", url.Values{
+		"login":    {"user@tidepool.org"},
+		"password": {"pw"},
+		"action":   {"create"},
+		"usr_name": {"my app"},
+		"uri":      {test_redirect_uri},
+		"view":     {"view"},
+		"upload":   {"upload"},
+	})
+	apps, _ := storage.LoadDeveloperClients("123.456.789")
+	if len(apps) != 1 {
+		t.Fatalf("got %v expected the developer's new app", apps)
+	}
+	app := &osin.DefaultClient{Id: apps[0].GetId(), Secret: shownSecret(created.Body.String())}
+
+	both := getToken(t, rtr, app)
+	viewRes := loginAndConsent(rtr, "/authorize?"+url.Values{
+		"response_type": {"code"},
+		"client_id":     {app.Id},
+		"redirect_uri":  {test_redirect_uri},
+		"scope":         {scopeView.name},
+	}.Encode())
+	redirect, _ := url.Parse(viewRes.Header().Get("Location"))
+	var viewOnly map[string]interface{}
+	json.NewDecoder(doRequest(rtr, "POST", "/token", url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {app.Id},
+		"client_secret": {app.Secret},
+		"redirect_uri":  {test_redirect_uri},
+		"code":          {redirect.Query().Get("code")},
+	}).Body).Decode(&viewOnly)
+	if viewOnly["scope"] != scopeView.name {
+		t.Fatalf("got %v expected a token for just the view scope", viewOnly)
+	}
+
+	/*
+	 * the app no longer asks for upload so the user no longer gives it
+	 */
+	doRequest(rtr, "POST", "/developer", url.Values{
+		login_handle_field: {loginHandle(created)},
+		"action":           {"update"},
+		"client_id":        {app.Id},
+		"usr_name":         {"my app"},
+		"uri":              {test_redirect_uri},
+		"view":             {"view"},
+	})
+
+	if consent, err := storage.LoadConsent("123.456.789", app.Id); err != nil || consent.Scope != scopeView.name {
+		t.Fatalf("got consent %v expected it to have been cut back to %s", consent, scopeView.name)
+	}
+	if _, ok := perms.permissions[scopeUpload.name]; ok || len(perms.permissions) != 1 {
+		t.Fatalf("only the %s permisson should have been kept but got %v", scopeView.name, perms.permissions)
+	}
+	info := func(token map[string]interface{}) map[string]interface{} {
+		var info map[string]interface{}
+		json.NewDecoder(doRequest(rtr, "GET", "/info?code="+url.QueryEscape(token["access_token"].(string)), url.Values{}).Body).Decode(&info)
+		return info
+	}
+	if found := info(both); found["error"] == nil {
+		t.Fatalf("the token carrying the withdrawn scope should have been revoked but info gave %v", found)
+	}
+	if found := info(viewOnly); found["error"] != nil {
+		t.Fatalf("the token with just the kept scope should still work but info gave %v", found)
+	}
+}
+
+//the secret shown once on the portal
+func shownSecret(body string) string {
+	start := strings.Index(body, "client_secret=")
+	if start < 0 {
+		return ""
+	}
+	secret := body[start+len("client_secret="):]
+	return secret[:strings.IndexAny(secret, " <")]
+}
+
+func Test_rotateSecret(t *testing.T) {
+
+	storage := newTestStorage()
+	rtr, _ := initTestApiOn(t, storage, OAuthConfig{ExpireDays: 14, SecretGracePeriod: "1h"}, &recordingGatekeeper{})
+
+	//the developer logs in to create their app, the pages they are shown after carry the handle for their login
+	handle := ""
+	manage := func(action, clientId string) *httptest.ResponseRecorder {
+		form := url.Values{
+			"action":    {action},
+			"client_id": {clientId},
+			"usr_name":  {"my app"},
+			"uri":       {test_redirect_uri},
+			"view":      {"view"},
+		}
+		if handle == "" {
+			form.Set("login", "user@tidepool.org")
+			form.Set("password", "pw")
+		} else {
+			form.Set(login_handle_field, handle)
+		}
+		res := doRequest(rtr, "POST", "/developer", form)
+		handle = loginHandle(res)
+		return res
+	}
+	matches := func(clientId, secret string) bool {
+		client, err := storage.GetClient(clientId)
+		if err != nil {
+			t.Fatalf("unexpected error getting the client %s", err.Error())
+		}
+		return client.(osin.ClientSecretMatcher).ClientSecretMatches(secret)
+	}
+
+	oldSecret := shownSecret(manage("create", "").Body.String())
+	apps, _ := storage.LoadDeveloperClients("123.456.789")
+	if oldSecret == "" || len(apps) != 1 {
+		t.Fatalf("got %v expected the developer's new app", apps)
+	}
+	appId := apps[0].GetId()
+
+	/*
+	 * both secrets work until the old one is revoked
+	 */
+	newSecret := shownSecret(manage("rotate", appId).Body.String())
+	if newSecret == "" || newSecret == oldSecret {
+		t.Fatalf("got secret [%s] expected a new one", newSecret)
+	}
+	if matches(appId, newSecret) == false || matches(appId, oldSecret) == false {
+		t.Fatal("both the new and old secrets should work during the grace period")
+	}
+
+	if res := manage("revoke_secret", appId); strings.Contains(res.Body.String(), "client_secret=") {
+		t.Fatalf("revoking should not show a secret but gave %s", res.Body.String())
+	}
+	if matches(appId, newSecret) == false || matches(appId, oldSecret) {
+		t.Fatal("only the new secret should work once the old one is revoked")
+	}
+
+	audits, _ := storage.LoadAudits(appId)
+	if len(audits) != 2 || audits[0].Event != models.AuditSecretRotated || audits[1].Event != models.AuditPreviousSecretRevoked {
+		t.Fatalf("got %v expected the rotation and revoke to be audited", audits)
+	}
+}
+
+//a JSON request with the bearer token when one is given
+func doJSONRequest(rtr *mux.Router, method, path, bearer string, body interface{}) (*httptest.ResponseRecorder, map[string]interface{}) {
+	raw, _ := json.Marshal(body)
+	req, _ := http.NewRequest(method, path, strings.NewReader(string(raw)))
+	req.Header.Set("Content-Type", "application/json")
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	res := httptest.NewRecorder()
+	rtr.ServeHTTP(res, req)
+
+	var output map[string]interface{}
+	json.Unmarshal(res.Body.Bytes(), &output)
+	return res, output
+}
+
+//an initial access token from an admin
+func issueInitialToken(rtr *mux.Router, sessionToken string) (*httptest.ResponseRecorder, string) {
+	req, _ := http.NewRequest("POST", "/register/initial_token", nil)
+	if sessionToken != "" {
+		req.Header.Set("x-tidepool-session-token", sessionToken)
+	}
+	res := httptest.NewRecorder()
+	rtr.ServeHTTP(res, req)
+
+	var output map[string]interface{}
+	json.Unmarshal(res.Body.Bytes(), &output)
+	token, _ := output["initial_access_token"].(string)
+	return res, token
+}
+
+func Test_registerClient(t *testing.T) {
+
+	storage := newTestStorage()
+	rtr, _ := initTestApiOn(t, storage, OAuthConfig{ExpireDays: 14}, tpClients.NewGatekeeperMock(nil, nil))
+
+	/*
+	 * only admins, which our services are, can issue an initial access token
+	 */
+	if res, _ := issueInitialToken(rtr, ""); res.Code != http.StatusUnauthorized {
+		t.Fatalf("issuing an initial access token without a session gave status %d", res.Code)
+	}
+	if res, _ := issueInitialToken(rtr, test_session_token); res.Code != http.StatusUnauthorized {
+		t.Fatalf("a user who isn't an admin issuing an initial access token gave status %d", res.Code)
+	}
+	_, initialToken := issueInitialToken(rtr, "server-token")
+	if strings.HasPrefix(initialToken, models.InitialAccessTokenPrefix) == false {
+		t.Fatalf("got [%s] expected an initial access token", initialToken)
+	}
+
+	metadata := map[string]interface{}{
+		"client_name":   "partner integration",
+		"redirect_uris": []string{test_redirect_uri},
+		"grant_types":   []string{"authorization_code", "refresh_token"},
+		"scope":         "view",
+		"logo_uri":      "https://partner.example.com/logo.png",
+		"contacts":      []string{"dev@partner.example.com"},
+	}
+
+	if res, _ := doJSONRequest(rtr, "POST", "/register", "", metadata); res.Code != http.StatusUnauthorized {
+		t.Fatalf("registering without an initial access token gave status %d", res.Code)
+	}
+	if res, _ := doJSONRequest(rtr, "POST", "/register", "tpit_notone", metadata); res.Code != http.StatusUnauthorized {
+		t.Fatalf("registering with an unknown initial access token gave status %d", res.Code)
+	}
+
+	/*
+	 * the metadata is checked
+	 */
+	invalid := map[string]map[string]interface{}{
+		"invalid_redirect_uri":    {"client_name": "app", "redirect_uris": []string{"http://localhost:14000/cb#fragment"}},
+		"invalid_client_metadata": {"client_name": "app", "redirect_uris": []string{test_redirect_uri}, "scope": "admin"},
+	}
+	for expected, bad := range invalid {
+		if res, output := doJSONRequest(rtr, "POST", "/register", initialToken, bad); res.Code != http.StatusBadRequest || output["error"] != expected {
+			t.Fatalf("registering %v gave %d %v expected %s", bad, res.Code, output, expected)
+		}
+	}
+	if res, output := doJSONRequest(rtr, "POST", "/register", initialToken, map[string]interface{}{
+		"client_name": "app", "redirect_uris": []string{test_redirect_uri}, "grant_types": []string{"authorization_code", "client_credentials"},
+	}); res.Code != http.StatusBadRequest || output["error"] != "invalid_client_metadata" {
+		t.Fatalf("a client using client_credentials gave %d %v", res.Code, output)
+	}
+
+	/*
+	 * the client is registered
+	 */
+	res, registered := doJSONRequest(rtr, "POST", "/register", initialToken, metadata)
+	if res.Code != http.StatusCreated {
+		t.Fatalf("registering gave status %d %v", res.Code, registered)
+	}
+	clientId, _ := registered["client_id"].(string)
+	secret, _ := registered["client_secret"].(string)
+	registrationToken, _ := registered["registration_access_token"].(string)
+	if clientId == "" || secret == "" || strings.HasPrefix(registrationToken, models.RegistrationTokenPrefix) == false {
+		t.Fatalf("got %v expected the client_id, client_secret and registration_access_token", registered)
+	}
+	if registered["client_name"] != "partner integration" || registered["scope"] != "view" || registered["token_endpoint_auth_method"] != "client_secret_basic" || registered["logo_uri"] != metadata["logo_uri"] {
+		t.Fatalf("got %v expected the registered metadata back", registered)
+	}
+
+	client, err := storage.GetClient(clientId)
+	if err != nil {
+		t.Fatalf("the registered client should have been saved but got %s", err.Error())
+	}
+	if appName(client) != "partner integration" || clientScopes(client) != "view" || client.GetRedirectUri() != test_redirect_uri {
+		t.Fatalf("got %v expected the client as registered", client)
+	}
+
+	/*
+	 * the client authenticates and uses only the grants as it was registered to
+	 */
+	authorizeRes := loginAndConsent(rtr, "/authorize?"+url.Values{
+		"response_type": {"code"},
+		"client_id":     {clientId},
+		"redirect_uri":  {test_redirect_uri},
+	}.Encode(), scopeView.name)
+	redirect, _ := url.Parse(authorizeRes.Header().Get("Location"))
+	codeForm := url.Values{
+		"grant_type":   {"authorization_code"},
+		"redirect_uri": {test_redirect_uri},
+		"code":         {redirect.Query().Get("code")},
+	}
+
+	var refused map[string]interface{}
+	postedForm := url.Values{"client_id": {clientId}, "client_secret": {secret}}
+	for key, values := range codeForm {
+		postedForm[key] = values
+	}
+	json.NewDecoder(doRequest(rtr, "POST", "/token", postedForm).Body).Decode(&refused)
+	if refused["access_token"] != nil || refused["error"] != osin.E_INVALID_CLIENT {
+		t.Fatalf("the client registered for client_secret_basic gave %v when posting its secret", refused)
+	}
+	var token map[string]interface{}
+	json.NewDecoder(doBasicRequest(rtr, "/token", clientId, secret, codeForm).Body).Decode(&token)
+	if token["access_token"] == nil {
+		t.Fatalf("the registered client should get a token with basic auth but got %v", token)
+	}
+	refused = nil
+	json.NewDecoder(doBasicRequest(rtr, "/token", clientId, secret, url.Values{"grant_type": {"client_credentials"}}).Body).Decode(&refused)
+	if refused["access_token"] != nil || refused["error"] != osin.E_UNAUTHORIZED_CLIENT {
+		t.Fatalf("the registered client acting as itself gave %v", refused)
+	}
+	refused = nil
+	json.NewDecoder(doBasicRequest(rtr, "/device/code", clientId, secret, url.Values{}).Body).Decode(&refused)
+	if refused["device_code"] != nil || refused["error"] != osin.E_UNAUTHORIZED_CLIENT {
+		t.Fatalf("the client not registered for the device grant gave %v", refused)
+	}
+
+	if audits, _ := storage.LoadAudits(clientId); len(audits) != 1 || audits[0].Event != models.AuditClientRegistered || audits[0].UserId != "987.654.321" {
+		t.Fatalf("got %v expected the registration to be audited with the admin who issued the token", audits)
+	}
+
+	//a client not registered for refresh tokens isn't given them
+	_, codeOnly := doJSONRequest(rtr, "POST", "/register", initialToken, map[string]interface{}{
+		"client_name":   "code only",
+		"redirect_uris": []string{test_redirect_uri},
+		"scope":         "view",
+	})
+	codeOnlyId, _ := codeOnly["client_id"].(string)
+	authorizeRes = loginAndConsent(rtr, "/authorize?"+url.Values{
+		"response_type": {"code"},
+		"client_id":     {codeOnlyId},
+		"redirect_uri":  {test_redirect_uri},
+	}.Encode(), scopeView.name)
+	redirect, _ = url.Parse(authorizeRes.Header().Get("Location"))
+	token = nil
+	json.NewDecoder(doBasicRequest(rtr, "/token", codeOnlyId, codeOnly["client_secret"].(string), url.Values{
+		"grant_type":   {"authorization_code"},
+		"redirect_uri": {test_redirect_uri},
+		"code":         {redirect.Query().Get("code")},
+	}).Body).Decode(&token)
+	if token["access_token"] == nil || token["refresh_token"] != nil {
+		t.Fatalf("got %v expected just an access_token for the client not registered for refresh tokens", token)
+	}
+}
+
+func Test_manageRegisteredClient(t *testing.T) {
+
+	storage := newTestStorage()
+	rtr, theClient := initTestApiOn(t, storage, OAuthConfig{ExpireDays: 14, OpenID: OpenIDConfig{Issuer: "http://localhost:8009/oauth"}}, tpClients.NewGatekeeperMock(nil, nil))
+
+	_, initialToken := issueInitialToken(rtr, "server-token")
+	register := func(name string) map[string]interface{} {
+		_, registered := doJSONRequest(rtr, "POST", "/register", initialToken, map[string]interface{}{
+			"client_name":   name,
+			"redirect_uris": []string{"http://localhost:14000/typo"},
+			"grant_types":   []string{"authorization_code"},
+			"scope":         "view",
+		})
+		return registered
+	}
+	registered, other := register("partner app"), register("other partner app")
+
+	clientId := registered["client_id"].(string)
+	secret := registered["client_secret"].(string)
+	registrationToken := registered["registration_access_token"].(string)
+	path := "/register/" + clientId
+	if registered["registration_client_uri"] != "http://localhost:8009/oauth"+path {
+		t.Fatalf("got %v expected the registration_client_uri", registered["registration_client_uri"])
+	}
+
+	/*
+	 * only the client's own registration access token will do
+	 */
+	for _, token := range []string{"", other["registration_access_token"].(string), "tprg_notone"} {
+		if res, _ := doJSONRequest(rtr, "GET", path, token, nil); res.Code != http.StatusUnauthorized {
+			t.Fatalf("reading the client with [%s] gave status %d", token, res.Code)
+		}
+	}
+	if res, _ := doJSONRequest(rtr, "GET", "/register/"+theClient.Id, registrationToken, nil); res.Code != http.StatusUnauthorized {
+		t.Fatalf("reading a client that wasn't registered gave status %d", res.Code)
+	}
+
+	res, read := doJSONRequest(rtr, "GET", path, registrationToken, nil)
+	if res.Code != http.StatusOK || read["client_name"] != "partner app" || read["client_secret"] != nil || read["registration_access_token"] != registrationToken {
+		t.Fatalf("reading the client gave %d %v", res.Code, read)
+	}
+
+	/*
+	 * the typo in the redirect_uri is fixed
+	 */
+	update := map[string]interface{}{
+		"client_id":     clientId,
+		"client_name":   "partner app",
+		"redirect_uris": []string{test_redirect_uri},
+		"grant_types":   []string{"authorization_code"},
+		"scope":         "view upload",
+	}
+	if res, output := doJSONRequest(rtr, "PUT", path, registrationToken, map[string]interface{}{"client_name": "no client_id"}); res.Code != http.StatusBadRequest {
+		t.Fatalf("updating without the client_id gave %d %v", res.Code, output)
+	}
+	res, updated := doJSONRequest(rtr, "PUT", path, registrationToken, update)
+	if res.Code != http.StatusOK || updated["scope"] != "view upload" || updated["client_secret"] != nil {
+		t.Fatalf("updating the client gave %d %v", res.Code, updated)
+	}
+	if client, _ := storage.GetClient(clientId); client.GetRedirectUri() != test_redirect_uri || clientScopes(client) != "view,upload" || osin.CheckClientSecret(client, secret) == false {
+		t.Fatalf("got %v expected the client to have been updated and keep its secret", client)
+	}
+
+	/*
+	 * the tokens carrying a scope the client drops are revoked
+	 */
+	uploadToken := getBasicToken(rtr, clientId, secret, "view upload")
+	update["scope"] = "view"
+	if res, updated := doJSONRequest(rtr, "PUT", path, registrationToken, update); res.Code != http.StatusOK || updated["scope"] != "view" {
+		t.Fatalf("dropping the upload scope gave %d %v", res.Code, updated)
+	}
+	if uploadAccess, _ := uploadToken["access_token"].(string); uploadAccess == "" {
+		t.Fatalf("the client should get a token for the upload scope but got %v", uploadToken)
+	} else if _, err := storage.LoadAccess(uploadAccess); err == nil {
+		t.Fatal("the token with the dropped scope should have been revoked")
+	}
+
+	/*
+	 * deleting the client removes its tokens too
+	 */
+	token := getBasicToken(rtr, clientId, secret, "view")
+	accessToken, _ := token["access_token"].(string)
+	if accessToken == "" {
+		t.Fatalf("the client should get a token but got %v", token)
+	}
+
+	if res, _ := doJSONRequest(rtr, "DELETE", path, registrationToken, nil); res.Code != http.StatusNoContent {
+		t.Fatalf("deleting the client gave status %d", res.Code)
+	}
+	if _, err := storage.GetClient(clientId); err == nil {
+		t.Fatal("the client should have been deleted")
+	}
+	if _, err := storage.LoadAccess(accessToken); err == nil {
+		t.Fatal("the client's tokens should have been deleted with it")
+	}
+	if res, _ := doJSONRequest(rtr, "GET", path, registrationToken, nil); res.Code != http.StatusUnauthorized {
+		t.Fatalf("reading the deleted client gave status %d", res.Code)
+	}
+
+	audits, _ := storage.LoadAudits(clientId)
+	if len(audits) != 4 || audits[1].Event != models.AuditClientUpdated || audits[2].Event != models.AuditClientUpdated || audits[3].Event != models.AuditClientDeleted {
+		t.Fatalf("got %v expected the updates and delete to be audited", audits)
+	}
+}
+
+func Test_registeredClientActsForNoAccount(t *testing.T) {
+
+	storage := newTestStorage()
+	rtr, _ := initTestApiOn(t, storage, OAuthConfig{ExpireDays: 14}, tpClients.NewGatekeeperMock(nil, nil))
+
+	_, initialToken := issueInitialToken(rtr, "server-token")
+	_, registered := doJSONRequest(rtr, "POST", "/register", initialToken, map[string]interface{}{
+		"client_name":   "partner integration",
+		"redirect_uris": []string{test_redirect_uri},
+		"scope":         "view",
+	})
+	clientId, _ := registered["client_id"].(string)
+	secret, _ := registered["client_secret"].(string)
+
+	client, err := storage.GetClient(clientId)
+	if err != nil {
+		t.Fatalf("the registered client should have been saved but got %s", err.Error())
+	}
+	if ud, _ := client.GetUserData().(map[string]interface{}); ud[clients.UserDataDeveloperId] != nil {
+		t.Fatalf("got %v expected the registered client to belong to no developer", ud)
+	}
+
+	//even one saved as set up for client_credentials and belonging to the admin gets no token
+	saved := &osin.DefaultClient{
+		Id:          "registered-1234",
+		Secret:      "registered-secret",
+		RedirectUri: test_redirect_uri,
+		UserData: map[string]interface{}{
+			"AppName":                         "partner integration",
+			"Scope":                           "view",
+			"ClientCredentials":               true,
+			userdata_grant_types:              []string{"authorization_code", "client_credentials"},
+			userdata_token_auth_method:        auth_method_basic,
+			clients.UserDataRegistrationToken: "tprg_registration",
+			clients.UserDataDeveloperId:       "987.654.321",
+		},
+	}
+	storage.SetClient(saved.Id, saved)
+
+	for id, clientSecret := range map[string]string{clientId: secret, saved.Id: saved.Secret} {
+		var token map[string]interface{}
+		json.NewDecoder(doBasicRequest(rtr, "/token", id, clientSecret, url.Values{"grant_type": {"client_credentials"}}).Body).Decode(&token)
+		if token["access_token"] != nil || token["error"] != osin.E_UNAUTHORIZED_CLIENT {
+			t.Fatalf("the registered client [%s] acting as itself gave %v", id, token)
+		}
+	}
+
+	//what a token of the client does act for is the user who authorized it
+	token := getBasicToken(rtr, saved.Id, saved.Secret, "view")
+	accessToken, _ := token["access_token"].(string)
+	req, _ := http.NewRequest("POST", "/introspect", strings.NewReader(url.Values{"token": {accessToken}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("x-tidepool-session-token", "server-token")
+	res := httptest.NewRecorder()
+	rtr.ServeHTTP(res, req)
+
+	var body map[string]interface{}
+	json.NewDecoder(res.Body).Decode(&body)
+	if body["active"] != true || body["sub"] != "123.456.789" {
+		t.Fatalf("introspect gave %v expected the token to be for the user rather than the admin", body)
+	}
+}
+
+//keeps the permissons that were last set
+type recordingGatekeeper struct {
+	permissions tpClients.Permissions
+}
+
+func (g *recordingGatekeeper) UserInGroup(userID, groupID string) (tpClients.Permissions, error) {
+	return g.permissions, nil
+}
+
+func (g *recordingGatekeeper) SetPermissions(userID, groupID string, permissions tpClients.Permissions) (tpClients.Permissions, error) {
+	g.permissions = permissions
+	return permissions, nil
+}
+
+func Test_revoke(t *testing.T) {
+
+	perms := &recordingGatekeeper{}
+	rtr, theClient := initTestApiWith(t, OAuthConfig{ExpireDays: 14, RevokePermissons: true}, perms)
+
+	first := getToken(t, rtr, theClient)
+	second := getToken(t, rtr, theClient)
+
+	revokeForm := url.Values{
+		"client_id":     {theClient.Id},
+		"client_secret": {theClient.Secret},
+		"token":         {first["access_token"].(string)},
+	}
+
+	if res := doRequest(rtr, "POST", "/revoke", url.Values{"token": revokeForm["token"]}); res.Code != http.StatusUnauthorized {
+		t.Fatalf("revoke without client auth gave status %d expected %d", res.Code, http.StatusUnauthorized)
+	}
+
+	if res := doRequest(rtr, "POST", "/revoke", revokeForm); res.Code != http.StatusOK {
+		t.Fatalf("revoke gave status %d expected %d", res.Code, http.StatusOK)
+	}
+
+	infoRes := doRequest(rtr, "GET", "/info?code="+url.QueryEscape(first["access_token"].(string)), url.Values{})
+	var info map[string]interface{}
+	json.NewDecoder(infoRes.Body).Decode(&info)
+
+	if info["client_id"] != nil {
+		t.Fatalf("the revoked token should be unknown to info but got %v", info)
+	}
+	if len(perms.permissions) == 0 {
+		t.Fatal("the permissons should remain while there is still a token")
+	}
+
+	//revoking the refresh token takes its access token too
+	revokeForm.Set("token", second["refresh_token"].(string))
+	revokeForm.Set("token_type_hint", "refresh_token")
+
+	if res := doRequest(rtr, "POST", "/revoke", revokeForm); res.Code != http.StatusOK {
+		t.Fatalf("revoke gave status %d expected %d", res.Code, http.StatusOK)
+	}
+	if len(perms.permissions) != 0 {
+		t.Fatalf("the permissons should have been withdrawn with the last token but are %v", perms.permissions)
+	}
+
+	//an unknown token is already revoked
+	revokeForm.Set("token", "not-a-token")
+
+	if res := doRequest(rtr, "POST", "/revoke", revokeForm); res.Code != http.StatusOK {
+		t.Fatalf("revoke of an unknown token gave status %d expected %d", res.Code, http.StatusOK)
+	}
+}
+
+func Test_introspect(t *testing.T) {
+
+	otherClient := &osin.DefaultClient{
+		Id:          "other-1234",
+		Secret:      "other-secret",
+		RedirectUri: test_redirect_uri,
+		UserData:    map[string]interface{}{"AppName": "other app"},
+	}
+	rtr, theClient := initTestApi(t, otherClient)
+
+	token := getToken(t, rtr, theClient)
+
+	introspect := func(form url.Values, serverToken string) (int, map[string]interface{}) {
+		req, _ := http.NewRequest("POST", "/introspect", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if serverToken != "" {
+			req.Header.Set("x-tidepool-session-token", serverToken)
+		}
+		res := httptest.NewRecorder()
+		rtr.ServeHTTP(res, req)
+
+		var body map[string]interface{}
+		json.NewDecoder(res.Body).Decode(&body)
+		return res.Code, body
+	}
+
+	if code, _ := introspect(url.Values{"token": {token["access_token"].(string)}}, ""); code != http.StatusUnauthorized {
+		t.Fatalf("introspect without auth gave status %d expected %d", code, http.StatusUnauthorized)
+	}
+
+	_, body := introspect(url.Values{"token": {token["access_token"].(string)}}, "server-token")
+
+	if body["active"] != true || body["client_id"] != theClient.Id || body["sub"] == nil || body["token_type"] != "Bearer" {
+		t.Fatalf("introspect gave %v for an active token", body)
+	}
+	if body["exp"].(float64) <= body["iat"].(float64) {
+		t.Fatalf("introspect gave exp %v before iat %v", body["exp"], body["iat"])
+	}
+
+	_, body = introspect(url.Values{"token": {token["refresh_token"].(string)}, "client_id": {theClient.Id}, "client_secret": {theClient.Secret}}, "")
+
+	if body["active"] != true || body["client_id"] != theClient.Id {
+		t.Fatalf("introspect gave %v for the clients own refresh token", body)
+	}
+
+	_, body = introspect(url.Values{"token": {token["access_token"].(string)}, "client_id": {otherClient.Id}, "client_secret": {otherClient.Secret}}, "")
+
+	if body["active"] != false || body["client_id"] != nil {
+		t.Fatalf("introspect gave %v for another clients token", body)
+	}
+
+	_, body = introspect(url.Values{"token": {"tpat_notOneOfOurs"}}, "server-token")
+
+	if body["active"] != false {
+		t.Fatalf("introspect gave %v for an unknown token", body)
+	}
+}
+
+//an api with OpenID Connect on using a new signing key and giving access tokens in the format
+func initOpenIDTestApi(t *testing.T, tokenFormat string) (*mux.Router, *osin.DefaultClient, []byte) {
+	return initOpenIDTestApiOn(t, newTestStorage(), tokenFormat)
+}
+
+//the OpenID Connect api on the storage given so a test can check what was saved
+func initOpenIDTestApiOn(t *testing.T, storage clients.Storage, tokenFormat string, others ...*osin.DefaultClient) (*mux.Router, *osin.DefaultClient, []byte) {
+
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	keyFile, err := ioutil.TempFile("", "coastline-signing-key")
+	if err != nil {
+		t.Fatalf("creating the key file failed %s", err.Error())
+	}
+	defer os.Remove(keyFile.Name())
+	defer keyFile.Close()
+	pem.Encode(keyFile, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	publicKey, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	publicPem := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKey})
+
+	config := OAuthConfig{ExpireDays: 14, OpenID: OpenIDConfig{Issuer: "http://localhost:8009/oauth", KeyFile: keyFile.Name(), KeyId: "test-key"}, TokenFormat: tokenFormat}
+	rtr, theClient := initTestApiOn(t, storage, config, tpClients.NewGatekeeperMock(nil, nil), others...)
+	return rtr, theClient, publicPem
+}
+
+func Test_openIDFlow(t *testing.T) {
+
+	rtr, theClient, publicPem := initOpenIDTestApi(t, "")
+
+	authorizeQuery := url.Values{
+		"response_type": {"code"},
+		"client_id":     {theClient.Id},
+		"redirect_uri":  {test_redirect_uri},
+		"scope":         {"openid email view"},
+		"nonce":         {"the-nonce"},
+	}
+	authorizeRes := loginAndConsent(rtr, "/authorize?"+authorizeQuery.Encode(), scopeView.name, scopeUpload.name)
+	redirect, _ := url.Parse(authorizeRes.Header().Get("Location"))
+
+	tokenRes := doRequest(rtr, "POST", "/token", url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {theClient.Id},
+		"client_secret": {theClient.Secret},
+		"redirect_uri":  {test_redirect_uri},
+		"code":          {redirect.Query().Get("code")},
+	})
+	var token map[string]interface{}
+	json.NewDecoder(tokenRes.Body).Decode(&token)
+
+	idToken, ok := token["id_token"].(string)
+	if ok == false {
+		t.Fatalf("token should have given an id_token but got %v", token)
+	}
+
+	parsed, err := jwt.Parse(idToken, func(*jwt.Token) ([]byte, error) { return publicPem, nil })
+	if err != nil || parsed.Valid == false {
+		t.Fatalf("the id_token should be signed with our key %v", err)
+	}
+	if parsed.Header["kid"] != "test-key" {
+		t.Fatalf("the id_token should have the kid of our key but got %v", parsed.Header)
+	}
+	if parsed.Claims["sub"] != "123.456.789" || parsed.Claims["aud"] != theClient.Id || parsed.Claims["nonce"] != "the-nonce" {
+		t.Fatalf("the id_token claims %v are not for the user and client", parsed.Claims)
+	}
+
+	/*
+	 * the user that authorized the token
+	 */
+	req, _ := http.NewRequest("GET", "/userinfo", nil)
+	req.Header.Set("Authorization", "Bearer "+token["access_token"].(string))
+	res := httptest.NewRecorder()
+	rtr.ServeHTTP(res, req)
+
+	var userinfo map[string]interface{}
+	json.NewDecoder(res.Body).Decode(&userinfo)
+
+	if userinfo["sub"] != "123.456.789" || userinfo["email"] == nil {
+		t.Fatalf("userinfo gave %v", userinfo)
+	}
+
+	/*
+	 * without openid there is no id_token or userinfo
+	 */
+	plainToken := getToken(t, rtr, theClient)
+
+	if plainToken["id_token"] != nil {
+		t.Fatalf("token should NOT have given an id_token without the openid scope but got %v", plainToken)
+	}
+
+	req, _ = http.NewRequest("GET", "/userinfo", nil)
+	req.Header.Set("Authorization", "Bearer "+plainToken["access_token"].(string))
+	res = httptest.NewRecorder()
+	rtr.ServeHTTP(res, req)
+
+	if res.Code != http.StatusUnauthorized {
+		t.Fatalf("userinfo without the openid scope gave status %d expected %d", res.Code, http.StatusUnauthorized)
+	}
+}
+
+func Test_openIDClientCredentials(t *testing.T) {
+
+	integration := &osin.DefaultClient{
+		Id:          "integration-1234",
+		Secret:      "integration-secret",
+		RedirectUri: test_redirect_uri,
+		UserData:    map[string]interface{}{"AppName": "ehr integration", "ClientCredentials": true, "Scope": "view", "DeveloperId": "123.456.789"},
+	}
+	storage := newTestStorage()
+	rtr, _, _ := initOpenIDTestApiOn(t, storage, "", integration)
+
+	tokenForm := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {integration.Id},
+		"client_secret": {integration.Secret},
+	}
+
+	/*
+	 * there is no user for the openid scopes to be about
+	 */
+	for _, scope := range []string{"openid view", "email", "profile view"} {
+		tokenForm.Set("scope", scope)
+		var refused map[string]interface{}
+		json.NewDecoder(doRequest(rtr, "POST", "/token", tokenForm).Body).Decode(&refused)
+		if refused["access_token"] != nil || refused["error"] != osin.E_INVALID_SCOPE {
+			t.Fatalf("client_credentials with the scope [%s] gave %v", scope, refused)
+		}
+	}
+
+	/*
+	 * nor does userinfo say anything about the developer the app acts for, even for a token saved with the openid scope
+	 */
+	tokenForm.Del("scope")
+	var token map[string]interface{}
+	json.NewDecoder(doRequest(rtr, "POST", "/token", tokenForm).Body).Decode(&token)
+	accessToken, _ := token["access_token"].(string)
+	access, err := storage.LoadAccess(accessToken)
+	if err != nil {
+		t.Fatalf("client_credentials should have given a token but got %v", token)
+	}
+	access.Scope = "openid,email,view"
+	storage.SaveAccess(access)
+
+	req, _ := http.NewRequest("GET", "/userinfo", nil)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	res := httptest.NewRecorder()
+	rtr.ServeHTTP(res, req)
+
+	var userinfo map[string]interface{}
+	json.NewDecoder(res.Body).Decode(&userinfo)
+	if res.Code != http.StatusUnauthorized || userinfo["error"] != "invalid_token" || userinfo["sub"] != nil || userinfo["email"] != nil {
+		t.Fatalf("userinfo for the app's own token gave %d %v", res.Code, userinfo)
+	}
+}
+
+func Test_openIDDiscovery(t *testing.T) {
+
+	rtr, _, _ := initOpenIDTestApi(t, "")
+
+	var discovery map[string]interface{}
+	json.NewDecoder(doRequest(rtr, "GET", "/.well-known/openid-configuration", url.Values{}).Body).Decode(&discovery)
+
+	if discovery["issuer"] != "http://localhost:8009/oauth" || discovery["jwks_uri"] != "http://localhost:8009/oauth/jwks" {
+		t.Fatalf("discovery gave %v", discovery)
+	}
+
+	var jwks struct {
+		Keys []map[string]interface{} `json:"keys"`
+	}
+	json.NewDecoder(doRequest(rtr, "GET", "/jwks", url.Values{}).Body).Decode(&jwks)
+
+	if len(jwks.Keys) != 1 || jwks.Keys[0]["kid"] != "test-key" || jwks.Keys[0]["kty"] != "RSA" || jwks.Keys[0]["n"] == nil {
+		t.Fatalf("jwks gave %v", jwks)
+	}
+}
+
+func Test_authorizationServerMetadata(t *testing.T) {
+
+	rtr, _ := initTestApiWith(t, OAuthConfig{ExpireDays: 14, OpenID: OpenIDConfig{Issuer: "https://api.tidepool.org/oauth"}}, tpClients.NewGatekeeperMock(nil, nil))
+
+	var metadata map[string]interface{}
+	json.NewDecoder(doRequest(rtr, "GET", "/.well-known/oauth-authorization-server", url.Values{}).Body).Decode(&metadata)
+
+	expected := map[string]string{
+		"issuer":                 "https://api.tidepool.org/oauth",
+		"authorization_endpoint": "https://api.tidepool.org/oauth/authorize",
+		"token_endpoint":         "https://api.tidepool.org/oauth/token",
+		"info_endpoint":          "https://api.tidepool.org/oauth/info",
+		"revocation_endpoint":    "https://api.tidepool.org/oauth/revoke",
+		"registration_endpoint":  "https://api.tidepool.org/oauth/register",
+	}
+	for key, value := range expected {
+		if metadata[key] != value {
+			t.Fatalf("got %v for %s expected %s", metadata[key], key, value)
+		}
+	}
+	if scopes, _ := json.Marshal(metadata["scopes_supported"]); string(scopes) != `["view","upload"]` {
+		t.Fatalf("got scopes %s expected only the tidepool scopes without OpenID Connect", scopes)
+	}
+	if metadata["jwks_uri"] != nil || metadata["grant_types_supported"] == nil || metadata["token_endpoint_auth_methods_supported"] == nil {
+		t.Fatalf("metadata gave %v", metadata)
+	}
+
+	//the Host the request was sent with doesn't change the urls
+	req, _ := http.NewRequest("GET", "/.well-known/oauth-authorization-server", nil)
+	req.Host = "attacker.example.com"
+	res := httptest.NewRecorder()
+	rtr.ServeHTTP(res, req)
+
+	metadata = nil
+	json.NewDecoder(res.Body).Decode(&metadata)
+	if metadata["issuer"] != "https://api.tidepool.org/oauth" || metadata["token_endpoint"] != "https://api.tidepool.org/oauth/token" {
+		t.Fatalf("metadata gave %v", metadata)
+	}
+
+	//the login form posts back relative to the page so it keeps the scheme and host the page was shown on
+	page := doRequest(rtr, "GET", "/authorize?"+url.Values{"response_type": {"code"}, "client_id": {"app-1234"}, "redirect_uri": {test_redirect_uri}}.Encode(), nil).Body.String()
+	if strings.Contains(page, `action="authorize?response_type=code`) == false {
+		t.Fatalf("the login form should post to a relative action %s", page)
+	}
+}
+
+func Test_jwtAccessToken(t *testing.T) {
+
+	rtr, theClient, publicPem := initOpenIDTestApi(t, "jwt")
+
+	token := getToken(t, rtr, theClient)
+
+	parsed, err := jwt.Parse(token["access_token"].(string), func(*jwt.Token) ([]byte, error) { return publicPem, nil })
+	if err != nil || parsed.Valid == false {
+		t.Fatalf("the access_token should be a JWT signed with our key %v", err)
+	}
+	if parsed.Header["kid"] != "test-key" {
+		t.Fatalf("the access_token should have the kid of our key but got %v", parsed.Header)
+	}
+	if parsed.Claims["sub"] != "123.456.789" || parsed.Claims["client_id"] != theClient.Id || parsed.Claims["jti"] == nil || parsed.Claims["exp"] == nil {
+		t.Fatalf("the access_token claims %v are not for the user and client", parsed.Claims)
+	}
+	if strings.HasPrefix(token["refresh_token"].(string), models.RefreshTokenPrefix) == false {
+		t.Fatalf("the refresh_token %v should still be one of our credentials", token["refresh_token"])
+	}
+
+	//we still know about it
+	infoRes := doRequest(rtr, "GET", "/info?code="+url.QueryEscape(token["access_token"].(string)), url.Values{})
+
+	var info map[string]interface{}
+	json.NewDecoder(infoRes.Body).Decode(&info)
+
+	if info["client_id"] != theClient.Id {
+		t.Fatalf("info gave %v expected client_id %s", info, theClient.Id)
+	}
+}
+
+func Test_clientCredentials(t *testing.T) {
+
+	integration := &osin.DefaultClient{
+		Id:          "integration-1234",
+		Secret:      "integration-secret",
+		RedirectUri: test_redirect_uri,
+		UserData:    map[string]interface{}{"AppName": "ehr integration", "ClientCredentials": true, "Scope": "view"},
+	}
+	developed := &osin.DefaultClient{
+		Id:          "developed-1234",
+		Secret:      "developed-secret",
+		RedirectUri: test_redirect_uri,
+		UserData:    map[string]interface{}{"AppName": "clinic integration", "ClientCredentials": true, "Scope": "view", "DeveloperId": "123.456.789"},
+	}
+	rtr, theClient := initTestApi(t, integration, developed)
+
+	tokenForm := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {theClient.Id},
+		"client_secret": {theClient.Secret},
+	}
+
+	var token map[string]interface{}
+	json.NewDecoder(doRequest(rtr, "POST", "/token", tokenForm).Body).Decode(&token)
+
+	if token["access_token"] != nil || token["error"] != "unauthorized_client" {
+		t.Fatalf("token should NOT be given to a client not set up for client_credentials but got %v", token)
+	}
+
+	tokenForm.Set("client_id", integration.Id)
+	tokenForm.Set("client_secret", integration.Secret)
+	tokenForm.Set("scope", "view,upload")
+
+	token = nil
+	json.NewDecoder(doRequest(rtr, "POST", "/token", tokenForm).Body).Decode(&token)
+
+	if token["access_token"] != nil || token["error"] != "invalid_scope" {
+		t.Fatalf("token should NOT be given for more than the registered scopes but got %v", token)
+	}
+
+	tokenForm.Del("scope")
+
+	token = nil
+	json.NewDecoder(doRequest(rtr, "POST", "/token", tokenForm).Body).Decode(&token)
+
+	if token["access_token"] == nil || token["refresh_token"] != nil || token["scope"] != "view" {
+		t.Fatalf("token should have given just an access_token for the registered scopes but got %v", token)
+	}
+
+	introspect := func(accessToken string) map[string]interface{} {
+		req, _ := http.NewRequest("POST", "/introspect", strings.NewReader(url.Values{"token": {accessToken}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("x-tidepool-session-token", "server-token")
+		res := httptest.NewRecorder()
+		rtr.ServeHTTP(res, req)
+
+		var body map[string]interface{}
+		json.NewDecoder(res.Body).Decode(&body)
+		return body
+	}
+
+	//an app signed up with its own account acts for it
+	if body := introspect(token["access_token"].(string)); body["active"] != true || body["sub"] != integration.Id || body["client_id"] != integration.Id {
+		t.Fatalf("introspect gave %v for the apps own token", body)
+	}
+
+	/*
+	 * an app that belongs to a developer acts for the developer's account
+	 */
+	tokenForm.Set("client_id", developed.Id)
+	tokenForm.Set("client_secret", developed.Secret)
+
+	token = nil
+	json.NewDecoder(doRequest(rtr, "POST", "/token", tokenForm).Body).Decode(&token)
+	if token["access_token"] == nil {
+		t.Fatalf("token should have given an access_token to the developer's app but got %v", token)
+	}
+	if body := introspect(token["access_token"].(string)); body["active"] != true || body["sub"] != "123.456.789" || body["client_id"] != developed.Id {
+		t.Fatalf("introspect gave %v for the token of the developer's app", body)
+	}
+
+	//but the developer didn't connect it to their account
+	req, _ := http.NewRequest("GET", "/connected/apps", nil)
+	req.Header.Set("x-tidepool-session-token", test_session_token)
+	res := httptest.NewRecorder()
+	rtr.ServeHTTP(res, req)
+	var connected struct {
+		Apps []connectedApp `json:"apps"`
+	}
+	if json.NewDecoder(res.Body).Decode(&connected); len(connected.Apps) != 0 {
+		t.Fatalf("got %v expected the developer to have no connected apps", connected.Apps)
+	}
+}
+
+func Test_refreshToken(t *testing.T) {
+
+	rtr, theClient := initTestApi(t)
+
+	token := getToken(t, rtr, theClient)
+
+	var refreshed map[string]interface{}
+	json.NewDecoder(doRequest(rtr, "POST", "/token", url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {theClient.Id},
+		"client_secret": {theClient.Secret},
+		"refresh_token": {token["refresh_token"].(string)},
+	}).Body).Decode(&refreshed)
+
+	if refreshed["access_token"] == nil || refreshed["access_token"] == token["access_token"] {
+		t.Fatalf("refresh should have given a new access_token but got %v", refreshed)
+	}
+
+	//the tokens that were refreshed are gone
+	var info map[string]interface{}
+	json.NewDecoder(doRequest(rtr, "GET", "/info?code="+url.QueryEscape(token["access_token"].(string)), url.Values{}).Body).Decode(&info)
+	if info["client_id"] != nil {
+		t.Fatalf("the refreshed access_token should be unknown to info but got %v", info)
+	}
+	var again map[string]interface{}
+	json.NewDecoder(doRequest(rtr, "POST", "/token", url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {theClient.Id},
+		"client_secret": {theClient.Secret},
+		"refresh_token": {token["refresh_token"].(string)},
+	}).Body).Decode(&again)
+	if again["access_token"] != nil || again["error"] != osin.E_INVALID_GRANT {
+		t.Fatalf("the refresh_token should only be usable the once but got %v", again)
+	}
+}
+
+func Test_deviceFlow(t *testing.T) {
+
+	rtr, theClient := initTestApi(t)
+
+	deviceCode := func() map[string]interface{} {
+		var codes map[string]interface{}
+		json.NewDecoder(doRequest(rtr, "POST", "/device/code", url.Values{
+			"client_id":     {theClient.Id},
+			"client_secret": {theClient.Secret},
+			"scope":         {"upload"},
+		}).Body).Decode(&codes)
+
+		if codes["device_code"] == nil || codes["user_code"] == nil || codes["verification_uri"] == nil {
+			t.Fatalf("device code should have given the codes but got %v", codes)
+		}
+		return codes
+	}
+	poll := func(codes map[string]interface{}) (int, map[string]interface{}) {
+		res := doRequest(rtr, "POST", "/token", url.Values{
+			"grant_type":    {"urn:ietf:params:oauth:grant-type:device_code"},
+			"client_id":     {theClient.Id},
+			"client_secret": {theClient.Secret},
+			"device_code":   {codes["device_code"].(string)},
+		})
+		var token map[string]interface{}
+		json.NewDecoder(res.Body).Decode(&token)
+		return res.Code, token
+	}
+
+	/*
+	 * polling before the user has authorized the device
+	 */
+	waiting := deviceCode()
+
+	if code, token := poll(waiting); code != http.StatusBadRequest || token["error"] != "authorization_pending" {
+		t.Fatalf("polling before authorizing gave %d %v", code, token)
+	}
+	if _, token := poll(waiting); token["error"] != "slow_down" {
+		t.Fatalf("polling too often gave %v", token)
+	}
+
+	/*
+	 * the user authorizes the device
+	 */
+	authorized := deviceCode()
+	userCode := strings.ToLower(authorized["user_code"].(string))
+
+	if res := doRequest(rtr, "GET", "/device?user_code="+userCode, url.Values{}); res.Code != http.StatusOK || strings.Contains(res.Body.String(), "password") == false {
+		t.Fatalf("the device page should ask the user to login but gave %d %s", res.Code, res.Body.String())
+	}
+	if res := loginAndConsent(rtr, "/device?user_code="+userCode, scopeView.name, scopeUpload.name); res.Code != http.StatusOK {
+		t.Fatalf("the device login gave %d %s", res.Code, res.Body.String())
+	}
+
+	if _, token := poll(authorized); token["access_token"] == nil || token["refresh_token"] == nil || token["scope"] != "upload" {
+		t.Fatalf("polling once authorized should give the tokens but gave %v", token)
+	}
+	if _, token := poll(authorized); token["error"] != "invalid_grant" {
+		t.Fatalf("the device code should only be exchanged the once but gave %v", token)
+	}
+
+	/*
+	 * the user denies the device
+	 */
+	denied := deviceCode()
+
+	if res := doRequest(rtr, "POST", "/device?user_code="+denied["user_code"].(string), url.Values{"deny": {"Deny access to Tidepool"}}); res.Code != http.StatusOK {
+		t.Fatalf("denying the device gave %d %s", res.Code, res.Body.String())
+	}
+	if code, token := poll(denied); code != http.StatusBadRequest || token["error"] != osin.E_ACCESS_DENIED {
+		t.Fatalf("polling once denied gave %d %v", code, token)
+	}
+
+	if res := doRequest(rtr, "GET", "/device?user_code=BCDF-GHJK", url.Values{}); res.Code != http.StatusBadRequest {
+		t.Fatalf("an unknown user code gave %d", res.Code)
+	}
+}
+
+//each device is only given back once all the polls racing for it have loaded it
+type racingStorage struct {
+	clients.Storage
+	loaded *sync.WaitGroup
+}
+
+func (s *racingStorage) LoadDevice(deviceCode string) (*models.DeviceAuthorization, error) {
+	device, err := s.Storage.LoadDevice(deviceCode)
+	s.loaded.Done()
+	s.loaded.Wait()
+	return device, err
+}
+
+func Test_devicePollRace(t *testing.T) {
+
+	const racing = 5
+	loaded := &sync.WaitGroup{}
+	loaded.Add(racing)
+	rtr, theClient := initTestApiOn(t, &racingStorage{Storage: newTestStorage(), loaded: loaded}, OAuthConfig{ExpireDays: 14}, tpClients.NewGatekeeperMock(nil, nil))
+
+	var codes map[string]interface{}
+	json.NewDecoder(doRequest(rtr, "POST", "/device/code", url.Values{
+		"client_id":     {theClient.Id},
+		"client_secret": {theClient.Secret},
+	}).Body).Decode(&codes)
+	loginAndConsent(rtr, "/device?user_code="+codes["user_code"].(string), scopeView.name, scopeUpload.name)
+
+	//the polls all find the device authorized but only the one is given the tokens
+	tokens := make(chan map[string]interface{}, racing)
+	for i := 0; i < racing; i++ {
+		go func() {
+			var token map[string]interface{}
+			json.NewDecoder(doRequest(rtr, "POST", "/token", url.Values{
+				"grant_type":    {"urn:ietf:params:oauth:grant-type:device_code"},
+				"client_id":     {theClient.Id},
+				"client_secret": {theClient.Secret},
+				"device_code":   {codes["device_code"].(string)},
+			}).Body).Decode(&token)
+			tokens <- token
+		}()
+	}
+	issued := 0
+	for i := 0; i < racing; i++ {
+		if token := <-tokens; token["access_token"] != nil {
+			issued++
+		} else if token["error"] != osin.E_INVALID_GRANT {
+			t.Fatalf("a poll that lost the race gave %v", token)
+		}
+	}
+	if issued != 1 {
+		t.Fatalf("got %d polls given tokens for the one device code", issued)
+	}
+}
+
+func Test_throttleUserCodes(t *testing.T) {
+
+	rtr, theClient := initTestApiWith(t, OAuthConfig{ExpireDays: 14, Throttle: ThrottleConfig{AddressLimit: 2}}, tpClients.NewGatekeeperMock(nil, nil))
+
+	var codes map[string]interface{}
+	json.NewDecoder(doRequest(rtr, "POST", "/device/code", url.Values{
+		"client_id":     {theClient.Id},
+		"client_secret": {theClient.Secret},
+	}).Body).Decode(&codes)
+
+	//guessing user codes is counted against where the guesses come from
+	for _, guess := range []string{"BCDF-GHJK", "BCDF-GHJL"} {
+		if res := doRequest(rtr, "GET", "/device?user_code="+guess, url.Values{}); res.Code != http.StatusBadRequest {
+			t.Fatalf("the guess %s gave %d", guess, res.Code)
+		}
+	}
+	if res := doRequest(rtr, "GET", "/device?user_code="+codes["user_code"].(string), url.Values{}); res.Code != http.StatusTooManyRequests || retryAfter(t, res) <= 0 {
+		t.Fatalf("the real user code after too many guesses gave %d expected %d", res.Code, http.StatusTooManyRequests)
+	}
 }
@@ -0,0 +1,169 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/RangelReale/osin"
+
+	"../models"
+)
+
+type (
+	//OpenIDConfig turns on OpenID Connect when a signing key is given
+	OpenIDConfig struct {
+		//the url the oauth api is served from e.g. https://api.tidepool.org/oauth
+		Issuer string `json:"issuer"`
+		//PEM encoded RSA private key the id_token is signed with
+		KeyFile string `json:"keyFile"`
+		//given as the kid of the id_token, made from the key when not set
+		KeyId string `json:"keyId"`
+	}
+)
+
+const (
+	scope_openid  = "openid"
+	scope_email   = "email"
+	scope_profile = "profile"
+
+	error_invalid_token  = "invalid_token"
+	error_openid_scope   = "the token was not issued with the openid scope"
+	error_user_not_found = "the user that authorized the token could not be found"
+	error_no_user        = "the token was not authorized by a user"
+)
+
+//the scopes asked for, osin leaves them as given so we allow them to be space or comma separated
+func splitScopes(scope string) []string {
+	return strings.FieldsFunc(scope, func(r rune) bool { return r == ' ' || r == ',' })
+}
+
+func hasScope(scope, wanted string) bool {
+	for _, s := range splitScopes(scope) {
+		if s == wanted {
+			return true
+		}
+	}
+	return false
+}
+
+//add the signed id_token when the openid scope was asked for, see http://openid.net/specs/openid-connect-core-1_0.html#IDToken
+func (o *OAuthApi) addIdToken(resp *osin.Response, ar *osin.AccessRequest) {
+
+	//there is only a user to say who they are when one authorized the app
+	if o.signer == nil || hasScope(ar.Scope, scope_openid) == false || ar.Type == osin.CLIENT_CREDENTIALS {
+		return
+	}
+	user := models.GetTokenUserData(ar.UserData)
+	if user == nil {
+		log.Printf("addIdToken: no user for client[%s]", ar.Client.GetId())
+		return
+	}
+
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":       o.OpenID.Issuer,
+		"sub":       user.UserId,
+		"aud":       ar.Client.GetId(),
+		"iat":       now.Unix(),
+		"exp":       now.Add(time.Duration(ar.Expiration) * time.Second).Unix(),
+		"auth_time": user.AuthTime,
+	}
+	//only the id_token that comes straight from the authorization is for that request
+	if ar.Type == osin.AUTHORIZATION_CODE && user.Nonce != "" {
+		claims["nonce"] = user.Nonce
+	}
+
+	idToken, err := o.signer.sign(claims)
+	if err != nil {
+		log.Printf("addIdToken: error[%s] signing the id_token", err.Error())
+		resp.SetError(osin.E_SERVER_ERROR, error_oauth_service)
+		return
+	}
+	resp.Output["id_token"] = idToken
+}
+
+//claims about the user that authorized the token, see http://openid.net/specs/openid-connect-core-1_0.html#UserInfo
+func (o *OAuthApi) userinfo(w http.ResponseWriter, r *http.Request) {
+
+	log.Print("userinfo: getting user")
+
+	resp := o.oauthServer.NewResponse()
+	defer resp.Close()
+
+	invalidToken := func(description string) {
+		log.Printf("userinfo: error[%s]", description)
+		resp.SetError(error_invalid_token, description)
+		resp.StatusCode = http.StatusUnauthorized
+		w.Header().Set("WWW-Authenticate", "Bearer error=\""+error_invalid_token+"\"")
+		osin.OutputJSON(resp, w, r)
+	}
+
+	bearer := osin.CheckBearerAuth(r)
+	if bearer == nil || o.tokenGen.access.Malformed(bearer.Code) {
+		invalidToken(error_malformed_credential)
+		return
+	}
+	access, err := o.storage.LoadAccess(bearer.Code)
+	if err != nil || access.IsExpired() {
+		invalidToken(error_invalid_token)
+		return
+	}
+	if hasScope(access.Scope, scope_openid) == false {
+		invalidToken(error_openid_scope)
+		return
+	}
+	//a token the app was given as itself says nothing about a user
+	userId := authorizingUser(access)
+	if userId == "" {
+		invalidToken(error_no_user)
+		return
+	}
+
+	user, err := o.userApi.GetUser(userId, o.userApi.TokenProvide())
+	if err != nil || user == nil {
+		log.Printf("userinfo: error[%s] user[%s]", error_user_not_found, userId)
+		resp.SetError(osin.E_SERVER_ERROR, error_user_not_found)
+		resp.StatusCode = http.StatusInternalServerError
+		osin.OutputJSON(resp, w, r)
+		return
+	}
+
+	o.tokenUsed(access)
+
+	resp.Output["sub"] = userId
+	if hasScope(access.Scope, scope_email) && len(user.Emails) > 0 {
+		resp.Output["email"] = user.Emails[0]
+	}
+	if hasScope(access.Scope, scope_profile) {
+		resp.Output["preferred_username"] = user.UserName
+	}
+	osin.OutputJSON(resp, w, r)
+}
+
+//how to use us as an OpenID provider, see http://openid.net/specs/openid-connect-discovery-1_0.html
+func (o *OAuthApi) openidConfiguration(w http.ResponseWriter, r *http.Request) {
+
+	resp := o.oauthServer.NewResponse()
+	defer resp.Close()
+
+	//the same as the authorization server metadata with what OpenID Connect adds to it
+	o.serverMetadata(resp, r)
+	resp.Output["userinfo_endpoint"] = o.endpointUrl(route_userinfo)
+	resp.Output["subject_types_supported"] = []string{"public"}
+	resp.Output["id_token_signing_alg_values_supported"] = []string{o.signer.method.Alg()}
+	resp.Output["claims_supported"] = []string{"iss", "sub", "aud", "iat", "exp", "auth_time", "nonce", "email", "preferred_username"}
+
+	osin.OutputJSON(resp, w, r)
+}
+
+//the public keys our id_tokens can be checked with
+func (o *OAuthApi) jwks(w http.ResponseWriter, r *http.Request) {
+
+	resp := o.oauthServer.NewResponse()
+	defer resp.Close()
+
+	resp.Output["keys"] = []interface{}{o.signer.jwk()}
+	osin.OutputJSON(resp, w, r)
+}
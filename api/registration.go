@@ -0,0 +1,633 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/RangelReale/osin"
+	"github.com/gorilla/mux"
+
+	"../clients"
+	"../models"
+)
+
+type (
+	//RegistrationConfig is who can let partners register their clients with the api, see https://tools.ietf.org/html/rfc7591
+	RegistrationConfig struct {
+		//the tidepool users who can issue initial access tokens, our services always can
+		Admins []string `json:"admins"`
+		//how long an initial access token can be used to register clients e.g. 168h
+		InitialTokenExpiry string `json:"initialTokenExpiry"`
+	}
+	//clientMetadata is the client as it is registered, see https://tools.ietf.org/html/rfc7591#section-2
+	clientMetadata struct {
+		//only given when the client is updated, see https://tools.ietf.org/html/rfc7592#section-2.2
+		ClientId                string   `json:"client_id,omitempty"`
+		ClientSecret            string   `json:"client_secret,omitempty"`
+		RedirectUris            []string `json:"redirect_uris"`
+		ClientName              string   `json:"client_name"`
+		GrantTypes              []string `json:"grant_types"`
+		ResponseTypes           []string `json:"response_types"`
+		Scope                   string   `json:"scope"`
+		TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method"`
+		LogoUri                 string   `json:"logo_uri,omitempty"`
+		ClientUri               string   `json:"client_uri,omitempty"`
+		PolicyUri               string   `json:"policy_uri,omitempty"`
+		TosUri                  string   `json:"tos_uri,omitempty"`
+		Contacts                []string `json:"contacts,omitempty"`
+	}
+	//registrationTokenMatcher is a client that checks its own registration access token, as those from the hashed storage do
+	registrationTokenMatcher interface {
+		RegistrationTokenMatches(token string) bool
+	}
+)
+
+const (
+	//registration errors, see https://tools.ietf.org/html/rfc7591#section-3.2.2
+	error_invalid_redirect_uri    = "invalid_redirect_uri"
+	error_invalid_client_metadata = "invalid_client_metadata"
+
+	error_registration_admin     = "a tidepool session for a registration admin is required"
+	error_initial_token          = "a valid initial access token is required to register a client"
+	error_registration_body      = "the client metadata must be given as a JSON object"
+	error_registration_name      = "the client_name is required"
+	error_registration_redirect  = "each redirect_uri must be an absolute http or https url without a fragment, at least one is needed for the authorization_code grant"
+	error_registration_uri       = "the logo_uri, client_uri, policy_uri and tos_uri must be absolute http or https urls"
+	error_registration_scope     = "the scope can only have the tidepool scopes"
+	error_registration_grant     = "the grant_types can only be authorization_code, refresh_token or urn:ietf:params:oauth:grant-type:device_code"
+	error_registration_response  = "the response_types can only be code"
+	error_registration_auth      = "the token_endpoint_auth_method can only be client_secret_basic, client_secret_post or none"
+	error_registration_client_cc = "a registered client has no tidepool account to act for so can't use the client_credentials grant"
+	error_registration_token     = "a valid registration access token for the client is required"
+	error_registration_client    = "the client_id and client_secret given must be those of the client"
+	error_grant_not_registered   = "the grant_type is not one the client was registered for"
+	error_auth_not_registered    = "the client must authenticate with the token_endpoint_auth_method it was registered for"
+
+	//how the client authenticates at the token endpoint
+	auth_method_basic = "client_secret_basic"
+	auth_method_post  = "client_secret_post"
+	auth_method_none  = "none"
+
+	default_initial_token_expiry = 7 * 24 * time.Hour
+
+	//the registered metadata that isn't otherwise a client setting
+	userdata_grant_types       = "GrantTypes"
+	userdata_token_auth_method = "TokenEndpointAuthMethod"
+	userdata_logo_uri          = "LogoUri"
+	userdata_client_uri        = "ClientUri"
+	userdata_policy_uri        = "PolicyUri"
+	userdata_tos_uri           = "TosUri"
+	userdata_contacts          = "Contacts"
+	userdata_client_issued_at  = "IssuedAt"
+)
+
+var supportedGrantTypes = []string{string(osin.AUTHORIZATION_CODE), string(osin.REFRESH_TOKEN), string(osin.CLIENT_CREDENTIALS), grant_type_device_code}
+
+//how long an initial access token can be used to register clients
+func (c *RegistrationConfig) GetInitialTokenExpiry() time.Duration {
+	if expiry, err := time.ParseDuration(c.InitialTokenExpiry); err == nil && expiry > 0 {
+		return expiry
+	}
+	return default_initial_token_expiry
+}
+
+func contains(values []string, wanted string) bool {
+	for i := range values {
+		if values[i] == wanted {
+			return true
+		}
+	}
+	return false
+}
+
+//an absolute http or https url, redirect_uris also can't have a fragment, see https://tools.ietf.org/html/rfc6749#section-3.1.2
+func isAbsoluteUrl(raw string) bool {
+	parsed, err := url.Parse(raw)
+	return err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != "" && parsed.Fragment == ""
+}
+
+//the defaults are filled in for what wasn't given, the error and its description are given when the metadata can't be registered
+func (m *clientMetadata) validate() (string, string) {
+
+	if m.TokenEndpointAuthMethod == "" {
+		m.TokenEndpointAuthMethod = auth_method_basic
+	}
+	if len(m.GrantTypes) == 0 {
+		m.GrantTypes = []string{string(osin.AUTHORIZATION_CODE)}
+	}
+	if len(m.ResponseTypes) == 0 {
+		m.ResponseTypes = []string{string(osin.CODE)}
+	}
+	if m.Scope == "" {
+		m.Scope = getAllScopes()
+	}
+
+	if strings.TrimSpace(m.ClientName) == "" {
+		return error_invalid_client_metadata, error_registration_name
+	}
+	switch m.TokenEndpointAuthMethod {
+	case auth_method_basic, auth_method_post, auth_method_none:
+	default:
+		return error_invalid_client_metadata, error_registration_auth
+	}
+	if contains(m.GrantTypes, string(osin.CLIENT_CREDENTIALS)) {
+		return error_invalid_client_metadata, error_registration_client_cc
+	}
+	for _, grantType := range m.GrantTypes {
+		if contains(supportedGrantTypes, grantType) == false {
+			return error_invalid_client_metadata, error_registration_grant
+		}
+	}
+	for _, responseType := range m.ResponseTypes {
+		if responseType != string(osin.CODE) {
+			return error_invalid_client_metadata, error_registration_response
+		}
+	}
+	scopes := splitScopes(m.Scope)
+	for _, asked := range scopes {
+		if _, ok := findScope(asked); ok == false {
+			return error_invalid_client_metadata, error_registration_scope
+		}
+	}
+	m.Scope = strings.Join(scopes, " ")
+
+	if contains(m.GrantTypes, string(osin.AUTHORIZATION_CODE)) && len(m.RedirectUris) == 0 {
+		return error_invalid_redirect_uri, error_registration_redirect
+	}
+	for _, uri := range m.RedirectUris {
+		if isAbsoluteUrl(uri) == false || strings.Contains(uri, redirect_uri_separator) {
+			return error_invalid_redirect_uri, error_registration_redirect
+		}
+	}
+	for _, uri := range []string{m.LogoUri, m.ClientUri, m.PolicyUri, m.TosUri} {
+		if uri != "" && isAbsoluteUrl(uri) == false {
+			return error_invalid_client_metadata, error_registration_uri
+		}
+	}
+	return "", ""
+}
+
+//the strings kept in the client user data, mongo gives them back as a list of interfaces
+func userDataStrings(ud map[string]interface{}, key string) []string {
+	switch values := ud[key].(type) {
+	case []string:
+		return values
+	case []interface{}:
+		found := make([]string, 0, len(values))
+		for _, value := range values {
+			if s, ok := value.(string); ok {
+				found = append(found, s)
+			}
+		}
+		return found
+	}
+	return nil
+}
+
+//was the client registered with the api rather than signed up by a developer, see register
+func isRegisteredClient(client osin.Client) bool {
+	ud, _ := client.GetUserData().(map[string]interface{})
+	_, registered := ud[clients.UserDataRegistrationToken].(string)
+	return registered
+}
+
+//can the client use the grant, those that weren't registered with the api can use them all
+//though client_credentials is still only for the clients set up for it. A registered client
+//belongs to no tidepool account so it never acts as itself
+func allowsGrant(client osin.Client, grantType string) bool {
+	if grantType == string(osin.CLIENT_CREDENTIALS) && isRegisteredClient(client) {
+		return false
+	}
+	ud, _ := client.GetUserData().(map[string]interface{})
+	if registered := userDataStrings(ud, userdata_grant_types); len(registered) > 0 {
+		return contains(registered, grantType)
+	}
+	return true
+}
+
+//did the client authenticate the way it was registered to, those that weren't registered with the api can use any
+func usesAuthMethod(client osin.Client, r *http.Request) bool {
+	ud, _ := client.GetUserData().(map[string]interface{})
+	registered, _ := ud[userdata_token_auth_method].(string)
+	auth, _ := osin.CheckBasicAuth(r)
+	switch registered {
+	case auth_method_basic:
+		return auth != nil
+	case auth_method_post:
+		return auth == nil && r.Form.Get("client_secret") != ""
+	case auth_method_none:
+		return auth == nil && r.Form.Get("client_secret") == ""
+	}
+	return true
+}
+
+//the client the metadata is for, it is saved with the userdata settings the rest of the api uses
+func (m *clientMetadata) applyTo(client *osin.DefaultClient) {
+
+	ud, _ := client.UserData.(map[string]interface{})
+	if ud == nil {
+		ud = map[string]interface{}{}
+		client.UserData = ud
+	}
+	public := m.TokenEndpointAuthMethod == auth_method_none
+
+	client.RedirectUri = strings.Join(m.RedirectUris, redirect_uri_separator)
+	ud[userdata_app_name] = m.ClientName
+	ud[userdata_scope] = strings.Join(splitScopes(m.Scope), ",")
+	ud[userdata_require_pkce] = public
+	ud[userdata_client_credentials] = contains(m.GrantTypes, string(osin.CLIENT_CREDENTIALS))
+	ud[userdata_grant_types] = m.GrantTypes
+	ud[userdata_token_auth_method] = m.TokenEndpointAuthMethod
+	ud[userdata_logo_uri] = m.LogoUri
+	ud[userdata_client_uri] = m.ClientUri
+	ud[userdata_policy_uri] = m.PolicyUri
+	ud[userdata_tos_uri] = m.TosUri
+	ud[userdata_contacts] = m.Contacts
+}
+
+//the metadata of the client as it was registered, or as near as we can tell for those that weren't
+func metadataOf(client osin.Client) *clientMetadata {
+
+	m := &clientMetadata{
+		ClientName:    appName(client),
+		ResponseTypes: []string{string(osin.CODE)},
+		Scope:         strings.Join(splitScopes(clientScopes(client)), " "),
+	}
+	if client.GetRedirectUri() != "" {
+		m.RedirectUris = strings.Split(client.GetRedirectUri(), redirect_uri_separator)
+	}
+	ud, _ := client.GetUserData().(map[string]interface{})
+	if ud == nil {
+		ud = map[string]interface{}{}
+	}
+
+	m.GrantTypes = userDataStrings(ud, userdata_grant_types)
+	if len(m.GrantTypes) == 0 {
+		m.GrantTypes = []string{string(osin.AUTHORIZATION_CODE), string(osin.REFRESH_TOKEN)}
+		if clientSetting(client, userdata_client_credentials) {
+			m.GrantTypes = append(m.GrantTypes, string(osin.CLIENT_CREDENTIALS))
+		}
+	}
+	m.TokenEndpointAuthMethod, _ = ud[userdata_token_auth_method].(string)
+	if m.TokenEndpointAuthMethod == "" {
+		m.TokenEndpointAuthMethod = auth_method_basic
+		if client.GetSecret() == "" {
+			m.TokenEndpointAuthMethod = auth_method_none
+		}
+	}
+	m.LogoUri, _ = ud[userdata_logo_uri].(string)
+	m.ClientUri, _ = ud[userdata_client_uri].(string)
+	m.PolicyUri, _ = ud[userdata_policy_uri].(string)
+	m.TosUri, _ = ud[userdata_tos_uri].(string)
+	m.Contacts = userDataStrings(ud, userdata_contacts)
+	return m
+}
+
+//where the client is read, updated and deleted, see https://tools.ietf.org/html/rfc7592#section-2
+func (o *OAuthApi) registrationClientUri(clientId string) string {
+	return o.endpointUrl(route_registration, "client_id", clientId)
+}
+
+//the registered client as given back to whoever registered it, see https://tools.ietf.org/html/rfc7591#section-3.2.1
+func (o *OAuthApi) outputRegistration(resp *osin.Response, r *http.Request, client osin.Client, secret, registrationToken string) {
+
+	m := metadataOf(client)
+	resp.Output["client_id"] = client.GetId()
+	if secret != "" {
+		resp.Output["client_secret"] = secret
+		//our secrets don't expire
+		resp.Output["client_secret_expires_at"] = 0
+	}
+	if ud, ok := client.GetUserData().(map[string]interface{}); ok {
+		switch issuedAt := ud[userdata_client_issued_at].(type) {
+		case int64:
+			resp.Output["client_id_issued_at"] = issuedAt
+		case int:
+			resp.Output["client_id_issued_at"] = issuedAt
+		}
+	}
+	if registrationToken != "" {
+		resp.Output["registration_access_token"] = registrationToken
+		resp.Output["registration_client_uri"] = o.registrationClientUri(client.GetId())
+	}
+	resp.Output["redirect_uris"] = m.RedirectUris
+	resp.Output["client_name"] = m.ClientName
+	resp.Output["grant_types"] = m.GrantTypes
+	resp.Output["response_types"] = m.ResponseTypes
+	resp.Output["scope"] = m.Scope
+	resp.Output["token_endpoint_auth_method"] = m.TokenEndpointAuthMethod
+	for key, value := range map[string]string{"logo_uri": m.LogoUri, "client_uri": m.ClientUri, "policy_uri": m.PolicyUri, "tos_uri": m.TosUri} {
+		if value != "" {
+			resp.Output[key] = value
+		}
+	}
+	if len(m.Contacts) > 0 {
+		resp.Output["contacts"] = m.Contacts
+	}
+}
+
+//the tidepool user or service that can issue initial access tokens, empty when they can't
+func (o *OAuthApi) registrationAdmin(r *http.Request) string {
+	if token := r.Header.Get(tidepool_session_token); token != "" {
+		if td := o.userApi.CheckToken(token); td != nil && (td.IsServer || contains(o.Registration.Admins, td.UserID)) {
+			return td.UserID
+		}
+	}
+	return ""
+}
+
+//an admin issues an initial access token for a partner to register their clients with
+func (o *OAuthApi) initialToken(w http.ResponseWriter, r *http.Request) {
+
+	resp := o.oauthServer.NewResponse()
+	defer resp.Close()
+
+	adminId := o.registrationAdmin(r)
+	if adminId == "" {
+		log.Printf("initialToken: error[%s]", error_registration_admin)
+		resp.SetError(error_invalid_token, error_registration_admin)
+		resp.StatusCode = http.StatusUnauthorized
+		osin.OutputJSON(resp, w, r)
+		return
+	}
+
+	token, err := o.tokenGen.initial.Generate()
+	if err != nil {
+		log.Printf("initialToken: error[%s] generating the token", err.Error())
+		resp.SetError(osin.E_SERVER_ERROR, error_oauth_service)
+		resp.StatusCode = http.StatusInternalServerError
+		osin.OutputJSON(resp, w, r)
+		return
+	}
+
+	expiry := o.Registration.GetInitialTokenExpiry()
+	initial := &models.InitialAccessToken{Token: token, IssuedBy: adminId, CreatedAt: time.Now(), ExpiresAt: time.Now().Add(expiry)}
+	if err := o.storage.SaveInitialAccessToken(initial); err != nil {
+		log.Printf("initialToken: error[%s] saving the token", err.Error())
+		resp.SetError(osin.E_SERVER_ERROR, error_oauth_service)
+		resp.StatusCode = http.StatusInternalServerError
+		osin.OutputJSON(resp, w, r)
+		return
+	}
+
+	log.Printf("initialToken: issued by admin[%s]", adminId)
+	resp.Output["initial_access_token"] = token
+	resp.Output["expires_in"] = int64(expiry / time.Second)
+	osin.OutputJSON(resp, w, r)
+}
+
+//the initial access token given as the bearer token, nil when there isn't one we can use
+func (o *OAuthApi) loadInitialToken(r *http.Request) *models.InitialAccessToken {
+	bearer := osin.CheckBearerAuth(r)
+	if bearer == nil || o.tokenGen.initial.Malformed(bearer.Code) {
+		return nil
+	}
+	initial, err := o.storage.LoadInitialAccessToken(bearer.Code)
+	if err != nil || initial.IsExpired() {
+		return nil
+	}
+	return initial
+}
+
+//register a client from its metadata, see https://tools.ietf.org/html/rfc7591#section-3
+func (o *OAuthApi) register(w http.ResponseWriter, r *http.Request) {
+
+	resp := o.oauthServer.NewResponse()
+	defer resp.Close()
+
+	initial := o.loadInitialToken(r)
+	if initial == nil {
+		log.Printf("register: error[%s]", error_initial_token)
+		resp.SetError(error_invalid_token, error_initial_token)
+		resp.StatusCode = http.StatusUnauthorized
+		w.Header().Set("WWW-Authenticate", "Bearer error=\""+error_invalid_token+"\"")
+		osin.OutputJSON(resp, w, r)
+		return
+	}
+
+	metadata := &clientMetadata{}
+	if err := json.NewDecoder(r.Body).Decode(metadata); err != nil {
+		log.Printf("register: error[%s] reading the metadata", err.Error())
+		resp.SetError(error_invalid_client_metadata, error_registration_body)
+		resp.StatusCode = http.StatusBadRequest
+		osin.OutputJSON(resp, w, r)
+		return
+	}
+	if code, description := metadata.validate(); code != "" {
+		log.Printf("register: error[%s] %s", code, description)
+		resp.SetError(code, description)
+		resp.StatusCode = http.StatusBadRequest
+		osin.OutputJSON(resp, w, r)
+		return
+	}
+
+	client, secret, registrationToken, err := o.registeredClient(metadata)
+	if err != nil {
+		log.Printf("register: error[%s] creating the client", err.Error())
+		resp.SetError(osin.E_SERVER_ERROR, error_oauth_service)
+		resp.StatusCode = http.StatusInternalServerError
+		osin.OutputJSON(resp, w, r)
+		return
+	}
+	if err := o.storage.SetClient(client.Id, client); err != nil {
+		log.Printf("register: error[%s] saving client[%s]", err.Error(), client.Id)
+		resp.SetError(osin.E_SERVER_ERROR, error_oauth_service)
+		resp.StatusCode = http.StatusInternalServerError
+		osin.OutputJSON(resp, w, r)
+		return
+	}
+
+	log.Printf("register: client[%s] registered with the token issued by[%s]", client.Id, initial.IssuedBy)
+	o.audit(models.AuditClientRegistered, client.Id, initial.IssuedBy, metadata.Scope, r)
+
+	o.outputRegistration(resp, r, client, secret, registrationToken)
+	resp.StatusCode = http.StatusCreated
+	osin.OutputJSON(resp, w, r)
+}
+
+//a new client for the metadata with its secret, unless it can't keep one, and the registration access token it can be managed with
+//the client belongs to no tidepool account, not even that of the admin who issued the initial access token
+func (o *OAuthApi) registeredClient(metadata *clientMetadata) (*osin.DefaultClient, string, string, error) {
+
+	secret := ""
+	if metadata.TokenEndpointAuthMethod != auth_method_none {
+		var err error
+		if secret, err = o.secretGen.Generate(); err != nil {
+			return nil, "", "", err
+		}
+	}
+	registrationToken, err := o.tokenGen.registration.Generate()
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	client := &osin.DefaultClient{
+		Id:     uuid.New(),
+		Secret: secret,
+		UserData: map[string]interface{}{
+			userdata_client_issued_at:         time.Now().Unix(),
+			clients.UserDataRegistrationToken: registrationToken,
+		},
+	}
+	metadata.applyTo(client)
+	return client, secret, registrationToken, nil
+}
+
+//the client has the registration access token, it is only kept hashed by the storage we use
+func registrationTokenMatches(client osin.Client, token string) bool {
+	if token == "" {
+		return false
+	}
+	if matcher, ok := client.(registrationTokenMatcher); ok {
+		return matcher.RegistrationTokenMatches(token)
+	}
+	if ud, ok := client.GetUserData().(map[string]interface{}); ok {
+		stored, _ := ud[clients.UserDataRegistrationToken].(string)
+		return stored != "" && subtle.ConstantTimeCompare([]byte(stored), []byte(token)) == 1
+	}
+	return false
+}
+
+//the client given in the path along with the registration access token it was managed with, nil when the token isn't the client's
+func (o *OAuthApi) loadRegisteredClient(r *http.Request) (osin.Client, string) {
+	bearer := osin.CheckBearerAuth(r)
+	if bearer == nil || o.tokenGen.registration.Malformed(bearer.Code) {
+		return nil, ""
+	}
+	client, err := o.storage.GetClient(mux.Vars(r)["client_id"])
+	if err != nil || registrationTokenMatches(client, bearer.Code) == false {
+		return nil, ""
+	}
+	return client, bearer.Code
+}
+
+//unknown clients are turned away the same as a wrong token so nothing is given away about which clients there are
+func invalidRegistrationToken(resp *osin.Response, w http.ResponseWriter, r *http.Request) {
+	resp.SetError(error_invalid_token, error_registration_token)
+	resp.StatusCode = http.StatusUnauthorized
+	w.Header().Set("WWW-Authenticate", "Bearer error=\""+error_invalid_token+"\"")
+	osin.OutputJSON(resp, w, r)
+}
+
+//read the client as it is registered, see https://tools.ietf.org/html/rfc7592#section-2.1
+func (o *OAuthApi) readRegistration(w http.ResponseWriter, r *http.Request) {
+
+	resp := o.oauthServer.NewResponse()
+	defer resp.Close()
+
+	client, registrationToken := o.loadRegisteredClient(r)
+	if client == nil {
+		log.Printf("readRegistration: error[%s]", error_registration_token)
+		invalidRegistrationToken(resp, w, r)
+		return
+	}
+	//the secret is only kept hashed so can't be given back
+	o.outputRegistration(resp, r, client, "", registrationToken)
+	osin.OutputJSON(resp, w, r)
+}
+
+//replace the metadata of the client, what isn't given is set back to its default, see https://tools.ietf.org/html/rfc7592#section-2.2
+func (o *OAuthApi) updateRegistration(w http.ResponseWriter, r *http.Request) {
+
+	resp := o.oauthServer.NewResponse()
+	defer resp.Close()
+
+	client, registrationToken := o.loadRegisteredClient(r)
+	if client == nil {
+		log.Printf("updateRegistration: error[%s]", error_registration_token)
+		invalidRegistrationToken(resp, w, r)
+		return
+	}
+
+	metadata := &clientMetadata{}
+	if err := json.NewDecoder(r.Body).Decode(metadata); err != nil {
+		log.Printf("updateRegistration: error[%s] reading the metadata", err.Error())
+		resp.SetError(error_invalid_client_metadata, error_registration_body)
+		resp.StatusCode = http.StatusBadRequest
+		osin.OutputJSON(resp, w, r)
+		return
+	}
+	if metadata.ClientId != client.GetId() || (metadata.ClientSecret != "" && osin.CheckClientSecret(client, metadata.ClientSecret) == false) {
+		log.Printf("updateRegistration: error[%s] client[%s]", error_registration_client, client.GetId())
+		resp.SetError(error_invalid_client_metadata, error_registration_client)
+		resp.StatusCode = http.StatusBadRequest
+		osin.OutputJSON(resp, w, r)
+		return
+	}
+	if code, description := metadata.validate(); code != "" {
+		log.Printf("updateRegistration: error[%s] %s", code, description)
+		resp.SetError(code, description)
+		resp.StatusCode = http.StatusBadRequest
+		osin.OutputJSON(resp, w, r)
+		return
+	}
+
+	updated, ud := copyClient(client)
+	metadata.applyTo(updated)
+
+	//a client that can no longer keep a secret loses it, one that now can is given one
+	secret := ""
+	if metadata.TokenEndpointAuthMethod == auth_method_none {
+		updated.Secret = ""
+		delete(ud, clients.UserDataPreviousSecret)
+		delete(ud, clients.UserDataPreviousSecretExpiresAt)
+	} else if updated.Secret == "" {
+		var err error
+		if secret, err = o.secretGen.Generate(); err != nil {
+			log.Printf("updateRegistration: error generating the secret: %s", err.Error())
+			resp.SetError(osin.E_SERVER_ERROR, error_oauth_service)
+			resp.StatusCode = http.StatusInternalServerError
+			osin.OutputJSON(resp, w, r)
+			return
+		}
+		updated.Secret = secret
+	}
+
+	if err := o.storage.SetClient(updated.Id, updated); err != nil {
+		log.Printf("updateRegistration: error[%s] saving client[%s]", err.Error(), updated.Id)
+		resp.SetError(osin.E_SERVER_ERROR, error_oauth_service)
+		resp.StatusCode = http.StatusInternalServerError
+		osin.OutputJSON(resp, w, r)
+		return
+	}
+	//users no longer give the client the scopes it has dropped
+	if err := o.withdrawScopes(updated.Id, clientScopes(client), clientScopes(updated)); err != nil {
+		resp.SetError(osin.E_SERVER_ERROR, error_oauth_service)
+		resp.StatusCode = http.StatusInternalServerError
+		osin.OutputJSON(resp, w, r)
+		return
+	}
+
+	log.Printf("updateRegistration: client[%s] updated", updated.Id)
+	o.audit(models.AuditClientUpdated, updated.Id, "", metadata.Scope, r)
+	o.outputRegistration(resp, r, updated, secret, registrationToken)
+	osin.OutputJSON(resp, w, r)
+}
+
+//the client is gone along with its codes, tokens and the permissons users gave it, see https://tools.ietf.org/html/rfc7592#section-2.3
+func (o *OAuthApi) deleteRegistration(w http.ResponseWriter, r *http.Request) {
+
+	resp := o.oauthServer.NewResponse()
+	defer resp.Close()
+
+	client, _ := o.loadRegisteredClient(r)
+	if client == nil {
+		log.Printf("deleteRegistration: error[%s]", error_registration_token)
+		invalidRegistrationToken(resp, w, r)
+		return
+	}
+	if errMsg := o.deleteClient(client); errMsg != "" {
+		resp.SetError(osin.E_SERVER_ERROR, error_oauth_service)
+		resp.StatusCode = http.StatusInternalServerError
+		osin.OutputJSON(resp, w, r)
+		return
+	}
+	o.audit(models.AuditClientDeleted, client.GetId(), "", "", r)
+	w.WriteHeader(http.StatusNoContent)
+}
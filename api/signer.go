@@ -0,0 +1,79 @@
+package api
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+//tokenSigner signs the JWTs we issue with the RSA key from the config
+type tokenSigner struct {
+	key       []byte
+	publicKey *rsa.PublicKey
+	keyId     string
+	method    jwt.SigningMethod
+}
+
+const signing_alg = "RS256"
+
+//newTokenSigner reads the PEM encoded RSA private key, the key id is made from the key when not given
+func newTokenSigner(keyFile, keyId string) (*tokenSigner, error) {
+
+	key, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(key)
+	if block == nil {
+		return nil, errors.New("the signing key must be PEM encoded")
+	}
+	privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		parsed, pkcs8Err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if pkcs8Err != nil {
+			return nil, err
+		}
+		var ok bool
+		if privateKey, ok = parsed.(*rsa.PrivateKey); !ok {
+			return nil, errors.New("the signing key must be an RSA key")
+		}
+	}
+	method, err := jwt.GetSigningMethod(signing_alg)
+	if err != nil {
+		return nil, err
+	}
+
+	if keyId == "" {
+		sum := sha256.Sum256(privateKey.PublicKey.N.Bytes())
+		keyId = hex.EncodeToString(sum[:8])
+	}
+	return &tokenSigner{key: key, publicKey: &privateKey.PublicKey, keyId: keyId, method: method}, nil
+}
+
+//sign the claims as a JWT that says which of our keys it was signed with
+func (s *tokenSigner) sign(claims map[string]interface{}) (string, error) {
+	token := jwt.New(s.method)
+	token.Header["kid"] = s.keyId
+	token.Claims = claims
+	return token.SignedString(s.key)
+}
+
+//the public key as a JWK (rfc7517) so our JWTs can be checked by others
+func (s *tokenSigner) jwk() map[string]interface{} {
+	return map[string]interface{}{
+		"kty": "RSA",
+		"use": "sig",
+		"alg": s.method.Alg(),
+		"kid": s.keyId,
+		"n":   base64.RawURLEncoding.EncodeToString(s.publicKey.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(s.publicKey.E)).Bytes()),
+	}
+}
@@ -0,0 +1,152 @@
+package api
+
+//the templates the pages are shown with when the template dir doesn't have its own
+//each page is given .Lang and the messages in that language as .T
+var defaultTemplates = map[string]string{
+
+	template_layout: `{{define "layout"}}<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<head>
+<meta charset="utf-8">
+<title>{{.T.msg_page_title}}</title>
+<style type="text/css">
+body{margin:40px auto;max-width:650px;line-height:1.6;font-size:18px;color:#444;padding:0 10px}
+h1,h2,h3{line-height:1.2}
+input{width:80%;height:37px;margin:5px;font-size:18px;}
+input[type=submit]{background:#0b9eb3;color:#fff;}
+input[type=checkbox]{width:auto;height:auto;}
+</style>
+</head>
+<body>
+{{if .Error}}<p><i>{{.Error}}</i></p>
+{{end}}{{template "content" .}}
+</body>
+</html>{{end}}`,
+
+	template_partials: `{{define "csrf"}}<input type="hidden" name="csrf_token" value="{{.CSRFToken}}" />{{end}}
+
+{{define "login_fields"}}<input type="text" name="login" placeholder="{{.T.placeholder_email}}" /><br/>
+<input type="password" name="password" placeholder="{{.T.placeholder_pw}}" /><br/>{{end}}
+
+{{define "scope_options"}}{{range .}}<input type="checkbox" name="{{.Name}}" value="{{.Name}}"{{if .Checked}} checked{{end}} /> {{.Message}}<br />
+{{end}}{{end}}
+
+{{define "client_options"}}<input type="checkbox" name="public" value="true" /> {{.T.label_public_client}}<br/>
+<input type="checkbox" name="require_pkce" value="true" /> {{.T.label_require_pkce}}<br/>
+<input type="checkbox" name="client_credentials" value="true" /> {{.T.label_client_credentials}}<br/>{{end}}
+
+{{define "credentials"}}<p>{{.T.msg_signup_save_details}}</p>
+client_id={{.Credentials.Id}} <br/>
+{{if .Credentials.Secret}}client_secret={{.Credentials.Secret}} <br/>{{else}}{{.T.msg_signup_public_client}} <br/>{{end}}{{end}}`,
+
+	page_error: `{{define "content"}}<i>{{.Message}}</i>{{end}}`,
+
+	page_signup: `{{define "content"}}<h2>{{.T.msg_signup_title}}</h2>
+<form action="" method="POST">
+{{template "csrf" $}}
+<fieldset>
+<h4>{{.T.msg_signup_app_info}}</h4>
+<input type="text" name="usr_name" placeholder="{{.T.placeholder_name}}" /><br/>
+<textarea name="uri" placeholder="{{.T.placeholder_uris}}"></textarea><br/>
+{{template "client_options" .}}
+{{template "scope_options" .Scopes}}
+<h4>{{.T.msg_signup_account_info}}</h4>
+<input type="email" name="email" placeholder="{{.T.placeholder_email}}" /><br/>
+<input type="password" name="password" placeholder="{{.T.placeholder_pw}}" /><br/>
+<input type="password" name="password_confirm" placeholder="{{.T.placeholder_pw_confirm}}" /><br/>
+<input type="submit" value="{{.T.btn_signup}}"/>
+</fieldset>
+</form>{{end}}`,
+
+	page_signup_complete: `{{define "content"}}<h2>{{.T.msg_signup_complete}}</h2>
+{{template "credentials" .}}
+<p><a href="developer">{{.T.msg_signup_developer}}</a></p>{{end}}`,
+
+	page_login: `{{define "content"}}<h2>{{.T.msg_tidepool_account_access}}</h2>
+<b>{{printf .T.msg_tidepool_permissons_granted .AppName}}</b>
+{{range .Scopes}}<p>{{.Message}}</p>
+{{end}}<form action="{{.FormAction}}" method="POST">
+{{template "csrf" $}}
+{{template "login_fields" .}}
+<input type="submit" value="{{.T.btn_authorize}}"/>
+<input type="submit" name="deny" value="{{.T.btn_no_authorize}}"/>
+</form>{{end}}`,
+
+	page_consent: `{{define "content"}}<h2>{{.T.msg_tidepool_account_access}}</h2>
+<b>{{printf .T.msg_tidepool_permissons_granted .AppName}}</b>
+<form action="{{.FormAction}}" method="POST">
+{{template "csrf" $}}
+{{range .Scopes}}<input type="checkbox" name="grant_scope" value="{{.Name}}" checked /> {{.Message}}<br />
+{{end}}<input type="hidden" name="login_handle" value="{{.LoginHandle}}" />
+<input type="submit" value="{{.T.btn_authorize}}"/>
+<input type="submit" name="deny" value="{{.T.btn_no_authorize}}"/>
+</form>{{end}}`,
+
+	page_device_code: `{{define "content"}}<h2>{{.T.msg_device_connect}}</h2>
+<form action="device" method="POST">
+{{template "csrf" $}}
+<input type="text" name="user_code" placeholder="{{.T.placeholder_user_code}}" /><br/>
+<input type="submit" value="{{.T.btn_device_continue}}"/>
+</form>{{end}}`,
+
+	page_device_done: `{{define "content"}}<h2>{{.Message}}</h2>{{end}}`,
+
+	page_connected_login: `{{define "content"}}<h2>{{.T.msg_connected_login}}</h2>
+<form action="connected" method="POST">
+{{template "csrf" $}}
+{{template "login_fields" .}}
+<input type="submit" value="{{.T.btn_login}}"/>
+</form>{{end}}`,
+
+	page_connected_apps: `{{define "content"}}<h2>{{.T.msg_connected_apps}}</h2>
+{{if not .Apps}}<p>{{.T.msg_no_connected_apps}}</p>
+{{end}}{{range .Apps}}<form action="connected" method="POST">
+{{template "csrf" $}}
+<h4>{{.AppName}}</h4>
+{{range .Scopes}}{{.Message}}<br />
+{{end}}{{printf $.T.msg_app_granted .GrantedAt}}{{if .LastUsedAt}}, {{printf $.T.msg_app_last_used .LastUsedAt}}{{end}}<br />
+<input type="hidden" name="login_handle" value="{{$.LoginHandle}}" />
+<input type="hidden" name="client_id" value="{{.ClientId}}" />
+<input type="submit" name="disconnect" value="{{$.T.btn_disconnect}}"/>
+</form>
+{{end}}{{end}}`,
+
+	page_developer_login: `{{define "content"}}<h2>{{.T.msg_developer_login}}</h2>
+<form action="developer" method="POST">
+{{template "csrf" $}}
+{{template "login_fields" .}}
+<input type="submit" value="{{.T.btn_login}}"/>
+</form>{{end}}`,
+
+	page_developer_apps: `{{define "content"}}{{if .Notice}}<h2>{{.Notice}}</h2>
+{{end}}{{if .Credentials}}{{template "credentials" .}}
+{{end}}<h2>{{.T.msg_developer_apps}}</h2>
+{{if not .Apps}}<p>{{.T.msg_developer_no_apps}}</p>
+{{end}}{{range .Apps}}<form action="developer" method="POST">
+{{template "csrf" $}}
+<fieldset>
+<h4>client_id={{.ClientId}}</h4>
+<input type="text" name="usr_name" value="{{.AppName}}" placeholder="{{$.T.placeholder_name}}" /><br/>
+<textarea name="uri" placeholder="{{$.T.placeholder_uris}}">{{.RedirectUris}}</textarea><br/>
+{{template "scope_options" .Scopes}}
+<input type="hidden" name="login_handle" value="{{$.LoginHandle}}" />
+<input type="hidden" name="client_id" value="{{.ClientId}}" />
+<button type="submit" name="action" value="update">{{$.T.btn_update_app}}</button>
+<button type="submit" name="action" value="delete">{{$.T.btn_delete_app}}</button>
+{{if .HasSecret}}<button type="submit" name="action" value="rotate">{{$.T.btn_rotate_secret}}</button>
+{{end}}{{if .HasPreviousSecret}}<button type="submit" name="action" value="revoke_secret">{{$.T.btn_revoke_secret}}</button>
+{{end}}</fieldset>
+</form>
+{{end}}<h2>{{.T.msg_developer_new_app}}</h2>
+<form action="developer" method="POST">
+{{template "csrf" $}}
+<fieldset>
+<input type="text" name="usr_name" placeholder="{{.T.placeholder_name}}" /><br/>
+<textarea name="uri" placeholder="{{.T.placeholder_uris}}"></textarea><br/>
+{{template "client_options" .}}
+{{template "scope_options" .NewScopes}}
+<input type="hidden" name="login_handle" value="{{.LoginHandle}}" />
+<button type="submit" name="action" value="create">{{.T.btn_create_app}}</button>
+</fieldset>
+</form>{{end}}`,
+}
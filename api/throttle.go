@@ -0,0 +1,233 @@
+package api
+
+import (
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RangelReale/osin"
+
+	"../models"
+)
+
+type (
+	//ThrottleConfig is how many failures we allow before locking out whoever is guessing logins or client secrets
+	ThrottleConfig struct {
+		//the failures allowed for a login name, an address and a client_id before each is locked out. The address
+		//and signup limits are off unless they are given or we trust X-Forwarded-For, behind a proxy every
+		//request would otherwise come from its address and lock everyone out
+		LoginLimit   int `json:"loginLimit"`
+		AddressLimit int `json:"addressLimit"`
+		ClientLimit  int `json:"clientLimit"`
+		//the signups allowed from an address
+		SignupLimit int `json:"signupLimit"`
+		//how long failures are remembered after the last of them e.g. 15m
+		Window string `json:"window"`
+		//the first lockout, doubled for each failure after it up to the max e.g. 30s and 1h
+		Lockout    string `json:"lockout"`
+		MaxLockout string `json:"maxLockout"`
+		//the address is the last of X-Forwarded-For, only for when we are behind a proxy that sets it
+		TrustForwardedFor bool `json:"trustForwardedFor"`
+	}
+	//what failures are counted against and how many it is allowed
+	throttleKey struct {
+		key   string
+		limit int
+	}
+	//a login refused without asking shoreline as there have been too many failures
+	throttledError struct {
+		wait time.Duration
+	}
+)
+
+const (
+	default_login_limit   = 5
+	default_address_limit = 50
+	default_client_limit  = 10
+	default_signup_limit  = 10
+	default_window        = 15 * time.Minute
+	default_lockout       = 30 * time.Second
+	default_max_lockout   = time.Hour
+
+	error_throttled = "sorry but there have been too many attempts, please wait a while before trying again"
+)
+
+func limitOf(limit, defaultLimit int) int {
+	if limit > 0 {
+		return limit
+	}
+	return defaultLimit
+}
+
+func durationOf(value string, defaultDuration time.Duration) time.Duration {
+	if duration, err := time.ParseDuration(value); err == nil && duration > 0 {
+		return duration
+	}
+	return defaultDuration
+}
+
+//how long failures are remembered after the last of them
+func (c *ThrottleConfig) GetWindow() time.Duration {
+	return durationOf(c.Window, default_window)
+}
+
+func (c *ThrottleConfig) GetLockout() time.Duration {
+	return durationOf(c.Lockout, default_lockout)
+}
+
+func (c *ThrottleConfig) GetMaxLockout() time.Duration {
+	return durationOf(c.MaxLockout, default_max_lockout)
+}
+
+func (e *throttledError) Error() string {
+	return error_throttled
+}
+
+//where the request came from, as the proxy in front of us saw it when we trust it
+func (o *OAuthApi) remoteAddress(r *http.Request) string {
+	if o.Throttle.TrustForwardedFor {
+		if forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ","); strings.TrimSpace(forwarded[len(forwarded)-1]) != "" {
+			return strings.TrimSpace(forwarded[len(forwarded)-1])
+		}
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+//the limit of what is counted by address, off when it wasn't given and we can't tell the addresses behind a proxy apart
+func (o *OAuthApi) addressLimitOf(limit, defaultLimit int) int {
+	if o.Throttle.TrustForwardedFor == false {
+		return limit
+	}
+	return limitOf(limit, defaultLimit)
+}
+
+func (o *OAuthApi) addressKey(r *http.Request) throttleKey {
+	return throttleKey{key: "address:" + o.remoteAddress(r), limit: o.addressLimitOf(o.Throttle.AddressLimit, default_address_limit)}
+}
+
+func (o *OAuthApi) loginKey(login string) throttleKey {
+	return throttleKey{key: "login:" + strings.ToLower(strings.TrimSpace(login)), limit: limitOf(o.Throttle.LoginLimit, default_login_limit)}
+}
+
+func (o *OAuthApi) clientKey(clientId string) throttleKey {
+	return throttleKey{key: "client:" + clientId, limit: limitOf(o.Throttle.ClientLimit, default_client_limit)}
+}
+
+func (o *OAuthApi) signupKey(r *http.Request) throttleKey {
+	return throttleKey{key: "signup:" + o.remoteAddress(r), limit: o.addressLimitOf(o.Throttle.SignupLimit, default_signup_limit)}
+}
+
+//how long until all the keys can be tried again, zero when none of them are locked out. Those without a limit are off
+func (o *OAuthApi) lockedOut(keys ...throttleKey) time.Duration {
+	var wait time.Duration
+	for _, k := range keys {
+		if k.limit <= 0 {
+			continue
+		}
+		throttle, err := o.storage.LoadThrottle(k.key)
+		if err != nil {
+			if err != osin.ErrNotFound {
+				log.Printf("lockedOut: error[%s]", err.Error())
+			}
+			continue
+		}
+		lockedUntil := throttle.LockedUntil(k.limit, o.Throttle.GetLockout(), o.Throttle.GetMaxLockout())
+		if until := lockedUntil.Sub(time.Now()); until > wait {
+			wait = until
+		}
+	}
+	return wait
+}
+
+//count a failure, or for signups each of them, against the keys
+func (o *OAuthApi) count(keys ...throttleKey) {
+	now := time.Now()
+	for _, k := range keys {
+		if k.limit <= 0 {
+			continue
+		}
+		if _, err := o.storage.AddFailure(k.key, now, o.failuresExpireAt(k, now)); err != nil {
+			log.Printf("count: error[%s]", err.Error())
+		}
+	}
+}
+
+//the failures are remembered for the window after the last of them, or for as long as the failure being counted locks
+//out the key when that is longer so the lockout isn't forgotten before it is over
+func (o *OAuthApi) failuresExpireAt(k throttleKey, at time.Time) time.Time {
+	counted := &models.Throttle{Key: k.key, Failures: 1, LastFailureAt: at}
+	if throttle, err := o.storage.LoadThrottle(k.key); err == nil && throttle.ExpiresAt.Before(at) == false {
+		counted.Failures = throttle.Failures + 1
+	}
+	expiresAt := at.Add(o.Throttle.GetWindow())
+	if lockedUntil := counted.LockedUntil(k.limit, o.Throttle.GetLockout(), o.Throttle.GetMaxLockout()); lockedUntil.After(expiresAt) {
+		expiresAt = lockedUntil
+	}
+	return expiresAt
+}
+
+//forget the failures once it has succeeded
+func (o *OAuthApi) forget(k throttleKey) {
+	if err := o.storage.RemoveThrottle(k.key); err != nil {
+		log.Printf("forget: error[%s]", err.Error())
+	}
+}
+
+//the whole seconds until they can try again, see https://tools.ietf.org/html/rfc7231#section-7.1.3
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+}
+
+//the user has to wait before they can try again
+func (o *OAuthApi) showThrottled(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	setRetryAfter(w, wait)
+	o.showError(w, r, error_throttled, http.StatusTooManyRequests)
+}
+
+//the status the page is shown with when the login failed, when it was throttled the user is told how long until they can try again
+func loginFailedStatus(w http.ResponseWriter, err error) int {
+	if throttled, ok := err.(*throttledError); ok {
+		setRetryAfter(w, throttled.wait)
+		return http.StatusTooManyRequests
+	}
+	return http.StatusBadRequest
+}
+
+//the client_id the request is trying to authenticate as, using basic auth or the params
+func requestClientId(r *http.Request) string {
+	r.ParseForm()
+	if auth, err := osin.CheckBasicAuth(r); err == nil && auth != nil {
+		return auth.Username
+	}
+	return r.Form.Get("client_id")
+}
+
+//the keys client secret guesses are counted against
+func (o *OAuthApi) clientKeys(r *http.Request) []throttleKey {
+	keys := []throttleKey{o.addressKey(r)}
+	if clientId := requestClientId(r); clientId != "" {
+		keys = append(keys, o.clientKey(clientId))
+	}
+	return keys
+}
+
+//the client is refused without checking its secret when there have been too many wrong ones
+func (o *OAuthApi) clientLockedOut(resp *osin.Response, w http.ResponseWriter, r *http.Request) bool {
+	wait := o.lockedOut(o.clientKeys(r)...)
+	if wait <= 0 {
+		return false
+	}
+	log.Printf("clientLockedOut: error[%s] client[%s]", error_throttled, requestClientId(r))
+	setRetryAfter(w, wait)
+	resp.SetError(osin.E_TEMPORARILY_UNAVAILABLE, error_throttled)
+	resp.StatusCode = http.StatusTooManyRequests
+	osin.OutputJSON(resp, w, r)
+	return true
+}
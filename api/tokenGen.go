@@ -0,0 +1,123 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/RangelReale/osin"
+
+	"../models"
+)
+
+type (
+	//credentialGen gives osin its codes and tokens from our credential generators, and those it doesn't know about
+	credentialGen struct {
+		code, access, refresh, device *models.CredentialGenerator
+		//the tokens clients are registered and then managed with
+		initial, registration *models.CredentialGenerator
+		//the handles of the users logged in on our pages
+		login *models.CredentialGenerator
+	}
+	//jwtAccessGen gives access tokens as JWTs signed with our key so they can be checked without asking us.
+	//The refresh tokens are still our credentials as only we need to check them.
+	jwtAccessGen struct {
+		*credentialGen
+		signer *tokenSigner
+		issuer string
+	}
+)
+
+const (
+	//access token formats
+	token_format_opaque = "opaque"
+	token_format_jwt    = "jwt"
+
+	jti_bytes = 16
+)
+
+func newCredentialGen(config models.CredentialConfig) (*credentialGen, error) {
+	code, err := models.NewCredentialGenerator(models.AuthorizeCodePrefix, config)
+	if err != nil {
+		return nil, err
+	}
+	access, err := models.NewCredentialGenerator(models.AccessTokenPrefix, config)
+	if err != nil {
+		return nil, err
+	}
+	refresh, err := models.NewCredentialGenerator(models.RefreshTokenPrefix, config)
+	if err != nil {
+		return nil, err
+	}
+	device, err := models.NewCredentialGenerator(models.DeviceCodePrefix, config)
+	if err != nil {
+		return nil, err
+	}
+	initial, err := models.NewCredentialGenerator(models.InitialAccessTokenPrefix, config)
+	if err != nil {
+		return nil, err
+	}
+	registration, err := models.NewCredentialGenerator(models.RegistrationTokenPrefix, config)
+	if err != nil {
+		return nil, err
+	}
+	login, err := models.NewCredentialGenerator(models.LoginHandlePrefix, config)
+	if err != nil {
+		return nil, err
+	}
+	return &credentialGen{code: code, access: access, refresh: refresh, device: device, initial: initial, registration: registration, login: login}, nil
+}
+
+func (g *credentialGen) GenerateAuthorizeToken(data *osin.AuthorizeData) (string, error) {
+	return g.code.Generate()
+}
+
+func (g *credentialGen) GenerateAccessToken(data *osin.AccessData, generaterefresh bool) (string, string, error) {
+	accessToken, err := g.access.Generate()
+	if err != nil {
+		return "", "", err
+	}
+	if generaterefresh == false {
+		return accessToken, "", nil
+	}
+	refreshToken, err := g.refresh.Generate()
+	if err != nil {
+		return "", "", err
+	}
+	return accessToken, refreshToken, nil
+}
+
+func (g *jwtAccessGen) GenerateAccessToken(data *osin.AccessData, generaterefresh bool) (string, string, error) {
+
+	jti := make([]byte, jti_bytes)
+	if _, err := rand.Read(jti); err != nil {
+		return "", "", err
+	}
+
+	//the client is the subject when no user authorized the token
+	subject := data.Client.GetId()
+	if user := models.GetTokenUserData(data.UserData); user != nil {
+		subject = user.UserId
+	}
+
+	accessToken, err := g.signer.sign(map[string]interface{}{
+		"iss":       g.issuer,
+		"sub":       subject,
+		"client_id": data.Client.GetId(),
+		"scope":     data.Scope,
+		"iat":       data.CreatedAt.Unix(),
+		"exp":       data.CreatedAt.Add(time.Duration(data.ExpiresIn) * time.Second).Unix(),
+		"jti":       hex.EncodeToString(jti),
+	})
+	if err != nil {
+		return "", "", err
+	}
+	if generaterefresh == false {
+		return accessToken, "", nil
+	}
+	refreshToken, err := g.refresh.Generate()
+	if err != nil {
+		return "", "", err
+	}
+	return accessToken, refreshToken, nil
+}
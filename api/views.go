@@ -0,0 +1,153 @@
+package api
+
+import (
+	"bytes"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+const (
+	//every page is shown in the layout and can use the partials
+	template_layout   = "layout.html"
+	template_partials = "partials.html"
+
+	//the pages we show
+	page_error           = "error.html"
+	page_signup          = "signup.html"
+	page_signup_complete = "signup_complete.html"
+	page_login           = "login.html"
+	page_consent         = "consent.html"
+	page_device_code     = "device_code.html"
+	page_device_done     = "device_done.html"
+	page_connected_login = "connected_login.html"
+	page_connected_apps  = "connected_apps.html"
+	page_developer_login = "developer_login.html"
+	page_developer_apps  = "developer_apps.html"
+)
+
+var allPages = []string{
+	page_error,
+	page_signup,
+	page_signup_complete,
+	page_login,
+	page_consent,
+	page_device_code,
+	page_device_done,
+	page_connected_login,
+	page_connected_apps,
+	page_developer_login,
+	page_developer_apps,
+}
+
+type (
+	//the pages ready to be shown
+	views struct {
+		pages map[string]*template.Template
+	}
+	//a scope as shown on a page, the templates can't see into scope
+	scopeOption struct {
+		Name, Message string
+		Checked       bool
+	}
+)
+
+//the templates found in dir are used instead of the defaults so the pages can be themed without a rebuild
+func newViews(dir string) (*views, error) {
+
+	layout, err := readTemplate(dir, template_layout)
+	if err != nil {
+		return nil, err
+	}
+	partials, err := readTemplate(dir, template_partials)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &views{pages: make(map[string]*template.Template)}
+	for _, name := range allPages {
+		content, err := readTemplate(dir, name)
+		if err != nil {
+			return nil, err
+		}
+		page := template.New(name)
+		for _, text := range []string{layout, partials, content} {
+			if page, err = page.Parse(text); err != nil {
+				return nil, err
+			}
+		}
+		v.pages[name] = page
+	}
+	return v, nil
+}
+
+//the template from dir when it has it, otherwise our default
+func readTemplate(dir, name string) (string, error) {
+	if dir != "" {
+		content, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err == nil {
+			return string(content), nil
+		}
+		if os.IsNotExist(err) == false {
+			return "", err
+		}
+	}
+	return defaultTemplates[name], nil
+}
+
+//the page is only written once it has been rendered so a broken template can't leave half a page
+func (v *views) render(w http.ResponseWriter, statusCode int, name string, data details) {
+	var page bytes.Buffer
+	if err := v.pages[name].ExecuteTemplate(&page, "layout", data); err != nil {
+		log.Printf("render: error[%s] for page[%s]", err.Error(), name)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if statusCode != http.StatusOK {
+		w.WriteHeader(statusCode)
+	}
+	w.Write(page.Bytes())
+}
+
+//the page in the language the user prefers
+func (o *OAuthApi) render(w http.ResponseWriter, r *http.Request, statusCode int, page string, data details) {
+	if data == nil {
+		data = details{}
+	}
+	data["Lang"], data["T"] = o.messages(r)
+	data["CSRFToken"] = o.csrfToken(w, r)
+	o.views.render(w, statusCode, page, data)
+}
+
+//all the scopes to choose from, ticked for those given
+func requestOptions(t messages, current string) []scopeOption {
+	options := make([]scopeOption, len(allScopes))
+	for i := range allScopes {
+		options[i] = scopeOption{Name: allScopes[i].name, Message: t.text(allScopes[i].requestMsg), Checked: hasScope(current, allScopes[i].name)}
+	}
+	return options
+}
+
+//the tidepool permissons as the user is asked to give them
+func grantOptions(t messages, scopes []scope) []scopeOption {
+	options := make([]scopeOption, len(scopes))
+	for i := range scopes {
+		options[i] = scopeOption{Name: scopes[i].name, Message: t.text(scopes[i].grantMsg), Checked: true}
+	}
+	return options
+}
+
+//the tidepool permissons in the scope, the openid ones aren't shown
+func knownScopes(requested string) []scope {
+	var known []scope
+	for _, asked := range splitScopes(requested) {
+		if theScope, ok := findScope(asked); ok {
+			known = append(known, theScope)
+		}
+	}
+	return known
+}
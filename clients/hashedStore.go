@@ -0,0 +1,344 @@
+package clients
+
+import (
+	"crypto/subtle"
+	"log"
+	"time"
+
+	"github.com/RangelReale/osin"
+
+	"../models"
+)
+
+type (
+	//hashedStorage sits in front of another storage so only keyed hashes of the codes and tokens are ever saved.
+	//Lookups are done on the hash of what we are given and the raw value is put back on what is loaded.
+	//Client secrets are saved hashed by the verifier.
+	hashedStorage struct {
+		Storage
+		hasher   *models.TokenHasher
+		verifier models.SecretVerifier
+	}
+	//secretClient is used by osin to check the secret it is given against the stored hash
+	secretClient struct {
+		osin.Client
+		storage *hashedStorage
+	}
+)
+
+func NewHashedStorage(storage Storage, hasher *models.TokenHasher, verifier models.SecretVerifier) Storage {
+	return &hashedStorage{Storage: storage, hasher: hasher, verifier: verifier}
+}
+
+//a plaintext secret that matches is hashed so it is only ever compared in plaintext the once
+func (c *secretClient) ClientSecretMatches(secret string) bool {
+	stored := c.GetSecret()
+
+	//an empty secret is never hashed so there is nothing to compare
+	if stored == "" || secret == "" {
+		return stored == secret
+	}
+	if c.storage.verifier.IsHashed(stored) {
+		return c.storage.verifier.Matches(stored, secret) || c.previousSecretMatches(secret)
+	}
+	if subtle.ConstantTimeCompare([]byte(stored), []byte(secret)) != 1 {
+		return c.previousSecretMatches(secret)
+	}
+
+	log.Printf("ClientSecretMatches upgrading the plaintext secret for client[%s]", c.GetId())
+	upgraded := &osin.DefaultClient{}
+	upgraded.CopyFrom(c.Client)
+	if err := c.storage.SetClient(upgraded.Id, upgraded); err != nil {
+		//they still gave the right secret so we will try again next time
+		log.Printf("ClientSecretMatches error[%s] upgrading the secret", err.Error())
+	}
+	return true
+}
+
+//the secret from before it was rotated still works for a while, it is only ever saved hashed
+func (c *secretClient) previousSecretMatches(secret string) bool {
+	previous := previousSecret(c.Client)
+	return previous != "" && c.storage.verifier.IsHashed(previous) && c.storage.verifier.Matches(previous, secret)
+}
+
+//RegistrationTokenMatches checks the registration access token against the hash it was saved as
+func (c *secretClient) RegistrationTokenMatches(token string) bool {
+	ud, ok := c.GetUserData().(map[string]interface{})
+	if ok == false || token == "" {
+		return false
+	}
+	stored, _ := ud[UserDataRegistrationToken].(string)
+	return stored != "" && subtle.ConstantTimeCompare([]byte(stored), []byte(c.storage.hasher.Hash(token))) == 1
+}
+
+//the client as it came from the storage we sit in front of
+func storedClient(client osin.Client) osin.Client {
+	if secret, ok := client.(*secretClient); ok {
+		return secret.Client
+	}
+	return client
+}
+
+//the hash of what we were given, what we give out is never a hash so all we are given is hashed.
+//Empty stays empty as there is nothing to find it by
+func (s *hashedStorage) hashOf(value string) string {
+	if value == "" {
+		return value
+	}
+	return s.hasher.Hash(value)
+}
+
+func (s *hashedStorage) Clone() osin.Storage {
+	return s
+}
+
+func (s *hashedStorage) GetClient(id string) (osin.Client, error) {
+	client, err := s.Storage.GetClient(id)
+	if err != nil {
+		return nil, err
+	}
+	return &secretClient{Client: client, storage: s}, nil
+}
+
+func (s *hashedStorage) SetClient(id string, client osin.Client) error {
+	clientToSave := &osin.DefaultClient{}
+	clientToSave.CopyFrom(client)
+	userData, err := s.hashedUserData(client.GetUserData())
+	if err != nil {
+		log.Printf("SetClient error[%s] hashing the previous secret", err.Error())
+		return err
+	}
+	clientToSave.UserData = userData
+
+	if clientToSave.Secret != "" && s.verifier.IsHashed(clientToSave.Secret) == false {
+		hashed, err := s.verifier.Hash(clientToSave.Secret)
+		if err != nil {
+			log.Printf("SetClient error[%s] hashing the secret", err.Error())
+			return err
+		}
+		clientToSave.Secret = hashed
+	}
+	return s.Storage.SetClient(id, clientToSave)
+}
+
+//copy of the client user data with the registration access token hashed and the previous secret hashed by the verifier
+func (s *hashedStorage) hashedUserData(userData interface{}) (interface{}, error) {
+	ud, ok := userData.(map[string]interface{})
+	if ok == false {
+		return userData, nil
+	}
+	token, _ := ud[UserDataRegistrationToken].(string)
+	hashToken := token != "" && models.IsTokenHash(token) == false
+	previous, _ := ud[UserDataPreviousSecret].(string)
+	hashPrevious := previous != "" && s.verifier.IsHashed(previous) == false
+	if hashToken == false && hashPrevious == false {
+		return userData, nil
+	}
+
+	hashed := make(map[string]interface{}, len(ud))
+	for key, value := range ud {
+		hashed[key] = value
+	}
+	if hashToken {
+		hashed[UserDataRegistrationToken] = s.hasher.Hash(token)
+	}
+	if hashPrevious {
+		hashedPrevious, err := s.verifier.Hash(previous)
+		if err != nil {
+			return nil, err
+		}
+		hashed[UserDataPreviousSecret] = hashedPrevious
+	}
+	return hashed, nil
+}
+
+//copy of the authorize with the code hashed
+func (s *hashedStorage) hashedAuthorize(data *osin.AuthorizeData) *osin.AuthorizeData {
+	if data == nil {
+		return nil
+	}
+	hashed := *data
+	hashed.Code = s.hashOf(data.Code)
+	hashed.Client = storedClient(data.Client)
+	return &hashed
+}
+
+//copy of the access with its tokens hashed, along with those of the code or refresh token it was issued for.
+//Those were loaded so what they were issued for is as it was saved, already hashed
+func (s *hashedStorage) hashedAccess(data *osin.AccessData) *osin.AccessData {
+	if data == nil {
+		return nil
+	}
+	hashed := s.hashedTokens(data)
+	hashed.AuthorizeData = s.hashedAuthorize(data.AuthorizeData)
+	if data.AccessData != nil {
+		hashed.AccessData = s.hashedTokens(data.AccessData)
+	}
+	return hashed
+}
+
+func (s *hashedStorage) hashedTokens(data *osin.AccessData) *osin.AccessData {
+	hashed := *data
+	hashed.Client = storedClient(data.Client)
+	hashed.AccessToken = s.hashOf(data.AccessToken)
+	hashed.RefreshToken = s.hashOf(data.RefreshToken)
+	return &hashed
+}
+
+func (s *hashedStorage) SaveAuthorize(data *osin.AuthorizeData) error {
+	return s.Storage.SaveAuthorize(s.hashedAuthorize(data))
+}
+
+func (s *hashedStorage) LoadAuthorize(code string) (*osin.AuthorizeData, error) {
+	data, err := s.Storage.LoadAuthorize(s.hasher.Hash(code))
+	if err != nil {
+		return nil, err
+	}
+	data.Code = code
+	return data, nil
+}
+
+func (s *hashedStorage) RemoveAuthorize(code string) error {
+	return s.Storage.RemoveAuthorize(s.hasher.Hash(code))
+}
+
+func (s *hashedStorage) SaveAccess(data *osin.AccessData) error {
+	return s.Storage.SaveAccess(s.hashedAccess(data))
+}
+
+func (s *hashedStorage) LoadAccess(token string) (*osin.AccessData, error) {
+	data, err := s.Storage.LoadAccess(s.hasher.Hash(token))
+	if err != nil {
+		return nil, err
+	}
+	data.AccessToken = token
+	//we only have the hash so don't hand it out as if it was the refresh token
+	data.RefreshToken = ""
+	return data, nil
+}
+
+func (s *hashedStorage) RemoveAccess(token string) error {
+	return s.Storage.RemoveAccess(s.hasher.Hash(token))
+}
+
+func (s *hashedStorage) LoadRefresh(token string) (*osin.AccessData, error) {
+	data, err := s.Storage.LoadRefresh(s.hasher.Hash(token))
+	if err != nil {
+		return nil, err
+	}
+	//we only have the hash of the access token so don't hand it out, the access is removed by its refresh token
+	data.AccessToken = ""
+	data.RefreshToken = token
+	return data, nil
+}
+
+func (s *hashedStorage) RemoveRefresh(token string) error {
+	return s.Storage.RemoveRefresh(s.hasher.Hash(token))
+}
+
+func (s *hashedStorage) RemoveRefreshAccess(token string) error {
+	return s.Storage.RemoveRefreshAccess(s.hasher.Hash(token))
+}
+
+func (s *hashedStorage) SaveDevice(data *models.DeviceAuthorization) error {
+	hashed := *data
+	hashed.DeviceCode = s.hashOf(data.DeviceCode)
+	hashed.UserCode = s.hashOf(data.UserCode)
+	return s.Storage.SaveDevice(&hashed)
+}
+
+func (s *hashedStorage) LoadDevice(deviceCode string) (*models.DeviceAuthorization, error) {
+	data, err := s.Storage.LoadDevice(s.hasher.Hash(deviceCode))
+	if err != nil {
+		return nil, err
+	}
+	//we only have the hash of the user code, the device only ever polls with its device code
+	data.DeviceCode = deviceCode
+	data.UserCode = ""
+	return data, nil
+}
+
+func (s *hashedStorage) LoadDeviceByUserCode(userCode string) (*models.DeviceAuthorization, error) {
+	data, err := s.Storage.LoadDeviceByUserCode(s.hasher.Hash(userCode))
+	if err != nil {
+		return nil, err
+	}
+	//we only have the hash of the device code, the device is updated by its user code once authorized
+	data.DeviceCode = ""
+	data.UserCode = userCode
+	return data, nil
+}
+
+func (s *hashedStorage) UpdateDevice(data *models.DeviceAuthorization) error {
+	hashed := *data
+	hashed.DeviceCode = s.hashOf(data.DeviceCode)
+	hashed.UserCode = s.hashOf(data.UserCode)
+	return s.Storage.UpdateDevice(&hashed)
+}
+
+func (s *hashedStorage) RemoveDevice(deviceCode string) error {
+	return s.Storage.RemoveDevice(s.hasher.Hash(deviceCode))
+}
+
+func (s *hashedStorage) TakeDevice(deviceCode string) (*models.DeviceAuthorization, error) {
+	data, err := s.Storage.TakeDevice(s.hasher.Hash(deviceCode))
+	if err != nil {
+		return nil, err
+	}
+	data.DeviceCode = deviceCode
+	data.UserCode = ""
+	return data, nil
+}
+
+func (s *hashedStorage) SaveInitialAccessToken(token *models.InitialAccessToken) error {
+	hashed := *token
+	hashed.Token = s.hashOf(token.Token)
+	return s.Storage.SaveInitialAccessToken(&hashed)
+}
+
+func (s *hashedStorage) LoadInitialAccessToken(token string) (*models.InitialAccessToken, error) {
+	data, err := s.Storage.LoadInitialAccessToken(s.hasher.Hash(token))
+	if err != nil {
+		return nil, err
+	}
+	data.Token = token
+	return data, nil
+}
+
+func (s *hashedStorage) SaveLoginHandle(handle *models.LoginHandle) error {
+	hashed := *handle
+	hashed.Handle = s.hasher.Hash(handle.Handle)
+	return s.Storage.SaveLoginHandle(&hashed)
+}
+
+func (s *hashedStorage) TakeLoginHandle(handle string) (*models.LoginHandle, error) {
+	loginHandle, err := s.Storage.TakeLoginHandle(s.hasher.Hash(handle))
+	if err != nil {
+		return nil, err
+	}
+	loginHandle.Handle = handle
+	return loginHandle, nil
+}
+
+//the keys can be login names or addresses so are only kept hashed
+func (s *hashedStorage) AddFailure(key string, at, expiresAt time.Time) (*models.Throttle, error) {
+	throttle, err := s.Storage.AddFailure(s.hasher.Hash(key), at, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	throttle.Key = key
+	return throttle, nil
+}
+
+func (s *hashedStorage) LoadThrottle(key string) (*models.Throttle, error) {
+	throttle, err := s.Storage.LoadThrottle(s.hasher.Hash(key))
+	if err != nil {
+		return nil, err
+	}
+	throttle.Key = key
+	return throttle, nil
+}
+
+func (s *hashedStorage) RemoveThrottle(key string) error {
+	return s.Storage.RemoveThrottle(s.hasher.Hash(key))
+}
@@ -0,0 +1,330 @@
+package clients
+
+import (
+	"testing"
+	"time"
+
+	"github.com/RangelReale/osin"
+
+	"../models"
+)
+
+func newTestHashedStorage(t *testing.T) (*MemoryStorage, Storage) {
+	hasher, err := models.NewTokenHasher("testing secret")
+	if err != nil {
+		t.Fatalf("Error creating the hasher %s", err.Error())
+	}
+	ms := NewMemoryStorage()
+	return ms, NewHashedStorage(ms, hasher, models.NewBcryptVerifier(4))
+}
+
+func TestHashed_AuthorizeStorage(t *testing.T) {
+
+	ms, hs := newTestHashedStorage(t)
+
+	hs.SaveAuthorize(&osin.AuthorizeData{Code: "12+34", Scope: "view", Client: a_client})
+
+	if _, err := ms.LoadAuthorize("12+34"); err == nil {
+		t.Fatal("the raw code should not have been saved")
+	}
+
+	if foundAuthorize, err := hs.LoadAuthorize("12+34"); err != nil {
+		t.Fatalf("Error trying to get auth %s", err.Error())
+	} else if foundAuthorize.Code != "12+34" || foundAuthorize.Scope != "view" {
+		t.Fatalf("got %v expected the raw code back", foundAuthorize)
+	}
+
+	hs.RemoveAuthorize("12+34")
+
+	if _, err := hs.LoadAuthorize("12+34"); err == nil {
+		t.Fatal("the auth should have been removed")
+	}
+}
+
+func TestHashed_AccessStorage(t *testing.T) {
+
+	ms, hs := newTestHashedStorage(t)
+
+	hs.SaveAccess(&osin.AccessData{AccessToken: "4321", RefreshToken: "8765", Client: a_client, Scope: "view", CreatedAt: time.Now()})
+
+	if _, err := ms.LoadAccess("4321"); err == nil {
+		t.Fatal("the raw access token should not have been saved")
+	}
+	if _, err := ms.LoadRefresh("8765"); err == nil {
+		t.Fatal("the raw refresh token should not have been saved")
+	}
+
+	if foundAccess, err := hs.LoadAccess("4321"); err != nil {
+		t.Fatalf("Error trying to get access %s", err.Error())
+	} else if foundAccess.AccessToken != "4321" || foundAccess.RefreshToken != "" {
+		t.Fatalf("got %v expected the raw access token and no refresh token", foundAccess)
+	}
+
+	foundRefresh, err := hs.LoadRefresh("8765")
+	if err != nil {
+		t.Fatalf("Error trying to get refresh %s", err.Error())
+	} else if foundRefresh.RefreshToken != "8765" || foundRefresh.AccessToken != "" {
+		t.Fatalf("got %v expected the raw refresh token and no access token", foundRefresh)
+	}
+
+	//as is done once the refresh token has been used
+	hs.RemoveRefreshAccess(foundRefresh.RefreshToken)
+
+	if _, err := hs.LoadAccess("4321"); err == nil {
+		t.Fatal("the access should have been removed")
+	}
+	if _, err := hs.LoadRefresh("8765"); err == nil {
+		t.Fatal("the refresh should have been removed")
+	}
+}
+
+func TestHashed_LoadWithHash(t *testing.T) {
+
+	_, hs := newTestHashedStorage(t)
+	hasher, _ := models.NewTokenHasher("testing secret")
+
+	hs.SaveAccess(&osin.AccessData{AccessToken: "4321", Client: a_client, CreatedAt: time.Now()})
+
+	if _, err := hs.LoadAccess(hasher.Hash("4321")); err == nil {
+		t.Fatal("the hash of a token should not be usable as the token")
+	}
+
+	hs.RemoveAccess(hasher.Hash("4321"))
+	if _, err := hs.LoadAccess("4321"); err != nil {
+		t.Fatal("the hash of a token should not remove the token")
+	}
+}
+
+func TestHashed_ClientSecret(t *testing.T) {
+
+	ms, hs := newTestHashedStorage(t)
+
+	hs.SetClient(a_client.GetId(), a_client)
+
+	if saved, _ := ms.GetClient(a_client.GetId()); saved.GetSecret() == a_client.GetSecret() {
+		t.Fatal("the raw secret should not have been saved")
+	}
+
+	fndClient, err := hs.GetClient(a_client.GetId())
+	if err != nil {
+		t.Fatalf("Error trying to get client %s", err.Error())
+	}
+	if osin.CheckClientSecret(fndClient, a_client.GetSecret()) == false {
+		t.Fatal("the client secret should match")
+	}
+	if osin.CheckClientSecret(fndClient, "not the secret") {
+		t.Fatal("a different secret should NOT match")
+	}
+}
+
+func TestHashed_ClientSecretUpgrade(t *testing.T) {
+
+	ms, hs := newTestHashedStorage(t)
+
+	//saved before secrets were hashed
+	ms.SetClient(a_client.GetId(), a_client)
+
+	fndClient, _ := hs.GetClient(a_client.GetId())
+
+	if osin.CheckClientSecret(fndClient, "not the secret") {
+		t.Fatal("a different secret should NOT match")
+	}
+	if saved, _ := ms.GetClient(a_client.GetId()); saved.GetSecret() != a_client.GetSecret() {
+		t.Fatal("the secret should only be upgraded once it has been matched")
+	}
+
+	if osin.CheckClientSecret(fndClient, a_client.GetSecret()) == false {
+		t.Fatal("the plaintext client secret should match")
+	}
+	if saved, _ := ms.GetClient(a_client.GetId()); saved.GetSecret() == a_client.GetSecret() {
+		t.Fatal("the secret should have been upgraded once matched")
+	}
+
+	upgradedClient, _ := hs.GetClient(a_client.GetId())
+	if osin.CheckClientSecret(upgradedClient, a_client.GetSecret()) == false {
+		t.Fatal("the client secret should still match once upgraded")
+	}
+}
+
+func TestHashed_PreviousClientSecret(t *testing.T) {
+
+	ms, hs := newTestHashedStorage(t)
+
+	hs.SetClient(a_client.GetId(), a_client)
+	saved, _ := ms.GetClient(a_client.GetId())
+
+	rotated := &osin.DefaultClient{
+		Id:     a_client.GetId(),
+		Secret: "the new secret",
+		UserData: map[string]interface{}{
+			UserDataPreviousSecret:          saved.GetSecret(),
+			UserDataPreviousSecretExpiresAt: time.Now().Add(time.Hour),
+		},
+	}
+	hs.SetClient(rotated.Id, rotated)
+
+	fndClient, _ := hs.GetClient(a_client.GetId())
+	if osin.CheckClientSecret(fndClient, "the new secret") == false || osin.CheckClientSecret(fndClient, a_client.GetSecret()) == false {
+		t.Fatal("both the new and the previous secret should match")
+	}
+
+	rotated.UserData = map[string]interface{}{
+		UserDataPreviousSecret:          saved.GetSecret(),
+		UserDataPreviousSecretExpiresAt: time.Now().Add(-time.Second),
+	}
+	hs.SetClient(rotated.Id, rotated)
+
+	fndClient, _ = hs.GetClient(a_client.GetId())
+	if osin.CheckClientSecret(fndClient, a_client.GetSecret()) {
+		t.Fatal("the previous secret should NOT match once it has expired")
+	}
+
+	//a plaintext secret yet to be upgraded is hashed when it becomes the previous one
+	rotated.UserData = map[string]interface{}{
+		UserDataPreviousSecret:          a_client.GetSecret(),
+		UserDataPreviousSecretExpiresAt: time.Now().Add(time.Hour),
+	}
+	hs.SetClient(rotated.Id, rotated)
+
+	stored, _ := ms.GetClient(a_client.GetId())
+	if ud, _ := stored.GetUserData().(map[string]interface{}); ud[UserDataPreviousSecret] == a_client.GetSecret() {
+		t.Fatal("the plaintext previous secret should not have been saved")
+	}
+	fndClient, _ = hs.GetClient(a_client.GetId())
+	if osin.CheckClientSecret(fndClient, a_client.GetSecret()) == false {
+		t.Fatal("the hashed previous secret should match")
+	}
+}
+
+func TestHashed_DeviceStorage(t *testing.T) {
+
+	ms, hs := newTestHashedStorage(t)
+
+	hs.SaveDevice(&models.DeviceAuthorization{DeviceCode: "device-code", UserCode: "WDJB-MJHT", ClientId: "1234", ExpiresIn: 60, CreatedAt: time.Now()})
+
+	if _, err := ms.LoadDevice("device-code"); err == nil {
+		t.Fatal("the raw device code should not have been saved")
+	}
+
+	foundDevice, err := hs.LoadDeviceByUserCode("WDJB-MJHT")
+	if err != nil {
+		t.Fatalf("Error trying to get the device %s", err.Error())
+	} else if foundDevice.UserCode != "WDJB-MJHT" || foundDevice.DeviceCode != "" || foundDevice.ClientId != "1234" {
+		t.Fatalf("got %v expected the raw user code back and no device code", foundDevice)
+	}
+
+	//authorized from the user code then polled for with the device code
+	foundDevice.UserData = &models.TokenUserData{UserId: "user-id"}
+	if err := hs.UpdateDevice(foundDevice); err != nil {
+		t.Fatalf("Error trying to update the device %s", err.Error())
+	}
+
+	if foundDevice, err := hs.LoadDevice("device-code"); err != nil {
+		t.Fatalf("Error trying to get the device %s", err.Error())
+	} else if foundDevice.DeviceCode != "device-code" || foundDevice.UserData == nil {
+		t.Fatalf("got %v expected the authorized device", foundDevice)
+	}
+
+	if taken, err := hs.TakeDevice("device-code"); err != nil || taken.DeviceCode != "device-code" || taken.UserData == nil {
+		t.Fatalf("got %v %v expected the authorized device to be taken by its raw code", taken, err)
+	}
+	if _, err := hs.LoadDeviceByUserCode("WDJB-MJHT"); err == nil {
+		t.Fatal("the taken device should have been removed")
+	}
+
+	hs.SaveDevice(&models.DeviceAuthorization{DeviceCode: "device-code", UserCode: "WDJB-MJHT", ClientId: "1234", ExpiresIn: 60, CreatedAt: time.Now()})
+	hs.RemoveDevice("device-code")
+
+	if _, err := hs.LoadDeviceByUserCode("WDJB-MJHT"); err == nil {
+		t.Fatal("the device should have been removed")
+	}
+}
+
+func TestHashed_InitialAccessToken(t *testing.T) {
+
+	ms, hs := newTestHashedStorage(t)
+
+	hs.SaveInitialAccessToken(&models.InitialAccessToken{Token: "initial", IssuedBy: "admin-id", ExpiresAt: time.Now().Add(time.Hour)})
+
+	if _, err := ms.LoadInitialAccessToken("initial"); err == nil {
+		t.Fatal("the raw initial access token should not have been saved")
+	}
+	if found, err := hs.LoadInitialAccessToken("initial"); err != nil {
+		t.Fatalf("Error trying to get the initial access token %s", err.Error())
+	} else if found.Token != "initial" || found.IssuedBy != "admin-id" {
+		t.Fatalf("got %v expected the raw token back", found)
+	}
+}
+
+func TestHashed_Throttle(t *testing.T) {
+
+	ms, hs := newTestHashedStorage(t)
+
+	hs.AddFailure("login:user@tidepool.org", time.Now(), time.Now().Add(time.Hour))
+
+	if len(ms.throttles) != 1 {
+		t.Fatalf("got %v expected the failure to be saved", ms.throttles)
+	}
+	if _, err := ms.LoadThrottle("login:user@tidepool.org"); err == nil {
+		t.Fatal("the raw key should not have been saved")
+	}
+	if found, err := hs.LoadThrottle("login:user@tidepool.org"); err != nil {
+		t.Fatalf("Error trying to get the failures %s", err.Error())
+	} else if found.Key != "login:user@tidepool.org" || found.Failures != 1 {
+		t.Fatalf("got %v expected the raw key back", found)
+	}
+
+	hs.RemoveThrottle("login:user@tidepool.org")
+	if len(ms.throttles) != 0 {
+		t.Fatal("the failures should have been removed")
+	}
+}
+
+func TestHashed_RegistrationToken(t *testing.T) {
+
+	ms, hs := newTestHashedStorage(t)
+
+	hs.SetClient("1234", &osin.DefaultClient{Id: "1234", UserData: map[string]interface{}{UserDataRegistrationToken: "registration"}})
+
+	stored, _ := ms.GetClient("1234")
+	token := stored.GetUserData().(map[string]interface{})[UserDataRegistrationToken].(string)
+	if token == "registration" || models.IsTokenHash(token) == false {
+		t.Fatalf("got [%s] expected the registration access token to be saved hashed", token)
+	}
+
+	//saving what was loaded doesn't hash it again
+	loaded, _ := hs.GetClient("1234")
+	matcher := loaded.(*secretClient)
+	if matcher.RegistrationTokenMatches("registration") == false || matcher.RegistrationTokenMatches(token) {
+		t.Fatal("only the raw registration access token should match")
+	}
+	hs.SetClient("1234", loaded)
+	stored, _ = ms.GetClient("1234")
+	if stored.GetUserData().(map[string]interface{})[UserDataRegistrationToken] != token {
+		t.Fatal("the hashed registration access token should have been saved as it was")
+	}
+}
+
+func TestHashed_LoginHandle(t *testing.T) {
+
+	ms, hs := newTestHashedStorage(t)
+
+	hs.SaveLoginHandle(&models.LoginHandle{Handle: "handle", UserId: "user-id", Purpose: "connected", ExpiresAt: time.Now().Add(time.Minute)})
+
+	if _, ok := ms.loginHandles["handle"]; ok {
+		t.Fatal("the raw login handle should not have been saved")
+	}
+	if found, err := hs.TakeLoginHandle("handle"); err != nil {
+		t.Fatalf("Error trying to take the login handle %s", err.Error())
+	} else if found.Handle != "handle" || found.UserId != "user-id" || found.Purpose != "connected" {
+		t.Fatalf("got %v expected the raw handle back", found)
+	}
+	if _, err := hs.TakeLoginHandle("handle"); err == nil {
+		t.Fatal("the login handle should only be taken the once")
+	}
+
+	hs.SaveLoginHandle(&models.LoginHandle{Handle: "expired", UserId: "user-id", ExpiresAt: time.Now().Add(-time.Minute)})
+	if _, err := hs.TakeLoginHandle("expired"); err == nil {
+		t.Fatal("an expired login handle should not be taken")
+	}
+}
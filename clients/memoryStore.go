@@ -0,0 +1,613 @@
+package clients
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RangelReale/osin"
+
+	"../models"
+)
+
+//MemoryStorage keeps all oauth data in process, useful for local runs and testing without mongo
+type MemoryStorage struct {
+	mu            sync.RWMutex
+	clients       map[string]osin.Client
+	authorizes    map[string]osin.AuthorizeData
+	accesses      map[string]osin.AccessData
+	refreshes     map[string]string
+	devices       map[string]models.DeviceAuthorization
+	userCodes     map[string]string
+	consents      map[consentKey]models.Consent
+	audits        []models.AuditRecord
+	initialTokens map[string]models.InitialAccessToken
+	throttles     map[string]models.Throttle
+	loginHandles  map[string]models.LoginHandle
+	refreshExpiry time.Duration
+}
+
+//the user and client a consent is for
+type consentKey struct {
+	userId, clientId string
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		clients:       make(map[string]osin.Client),
+		authorizes:    make(map[string]osin.AuthorizeData),
+		accesses:      make(map[string]osin.AccessData),
+		refreshes:     make(map[string]string),
+		devices:       make(map[string]models.DeviceAuthorization),
+		userCodes:     make(map[string]string),
+		consents:      make(map[consentKey]models.Consent),
+		initialTokens: make(map[string]models.InitialAccessToken),
+		throttles:     make(map[string]models.Throttle),
+		loginHandles:  make(map[string]models.LoginHandle),
+		//the same default as the config gives
+		refreshExpiry: default_refresh_expire_days * oneDay,
+	}
+}
+
+func (s *MemoryStorage) Clone() osin.Storage {
+	return s
+}
+
+func (s *MemoryStorage) Close() {
+	return
+}
+
+func (store *MemoryStorage) GetClient(id string) (osin.Client, error) {
+	log.Printf("GetClient id[%s]", id)
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	if client, ok := store.clients[id]; ok {
+		return client, nil
+	}
+	log.Printf("GetClient error[%s]", osin.ErrNotFound.Error())
+	return nil, osin.ErrNotFound
+}
+
+func (store *MemoryStorage) SetClient(id string, client osin.Client) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	clientToSave := &osin.DefaultClient{}
+	clientToSave.CopyFrom(client)
+	store.clients[id] = clientToSave
+	return nil
+}
+
+func (store *MemoryStorage) LoadDeveloperClients(developerId string) ([]osin.Client, error) {
+	log.Printf("LoadDeveloperClients for developer[%s]", developerId)
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	found := []osin.Client{}
+	for _, client := range store.clients {
+		if isDevelopers(client, developerId) {
+			found = append(found, client)
+		}
+	}
+	return found, nil
+}
+
+func (store *MemoryStorage) RemoveClient(id string) error {
+	log.Printf("RemoveClient id[%s]", id)
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	delete(store.clients, id)
+	for code, data := range store.authorizes {
+		if data.Client.GetId() == id {
+			delete(store.authorizes, code)
+		}
+	}
+	for token, data := range store.accesses {
+		if data.Client.GetId() == id {
+			if data.RefreshToken != "" {
+				delete(store.refreshes, data.RefreshToken)
+			}
+			delete(store.accesses, token)
+		}
+	}
+	for deviceCode, data := range store.devices {
+		if data.ClientId == id {
+			delete(store.userCodes, data.UserCode)
+			delete(store.devices, deviceCode)
+		}
+	}
+	for key := range store.consents {
+		if key.clientId == id {
+			delete(store.consents, key)
+		}
+	}
+	return nil
+}
+
+func (store *MemoryStorage) SaveAuthorize(data *osin.AuthorizeData) error {
+	log.Printf("SaveAuthorize for code[%s]", data.Code)
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.authorizes[data.Code] = *data
+	return nil
+}
+
+func (store *MemoryStorage) LoadAuthorize(code string) (*osin.AuthorizeData, error) {
+	log.Printf("LoadAuthorize for code[%s]", code)
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	if data, ok := store.authorizes[code]; ok {
+		return &data, nil
+	}
+	log.Printf("LoadAuthorize error[%s]", osin.ErrNotFound.Error())
+	return nil, osin.ErrNotFound
+}
+
+func (store *MemoryStorage) RemoveAuthorize(code string) error {
+	log.Printf("RemoveAuthorize for code[%s]", code)
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	delete(store.authorizes, code)
+	return nil
+}
+
+func (store *MemoryStorage) SaveAccess(data *osin.AccessData) error {
+	log.Printf("SaveAccess for token[%s]", data.AccessToken)
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.accesses[data.AccessToken] = *data
+	if data.RefreshToken != "" {
+		store.refreshes[data.RefreshToken] = data.AccessToken
+	}
+	return nil
+}
+
+func (store *MemoryStorage) LoadAccess(token string) (*osin.AccessData, error) {
+	log.Printf("LoadAccess for token[%s]", token)
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	if data, ok := store.accesses[token]; ok {
+		return &data, nil
+	}
+	log.Printf("LoadAccess error[%s]", osin.ErrNotFound.Error())
+	return nil, osin.ErrNotFound
+}
+
+func (store *MemoryStorage) RemoveAccess(token string) error {
+	log.Printf("RemoveAccess for token[%s]", token)
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if data, ok := store.accesses[token]; ok && data.RefreshToken != "" {
+		delete(store.refreshes, data.RefreshToken)
+	}
+	delete(store.accesses, token)
+	return nil
+}
+
+func (store *MemoryStorage) LoadRefresh(token string) (*osin.AccessData, error) {
+	log.Printf("LoadRefresh for token[%s]", token)
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	if accessToken, ok := store.refreshes[token]; ok {
+		if data, ok := store.accesses[accessToken]; ok && refreshExpiresAt(&data, store.refreshExpiry).After(time.Now()) {
+			return &data, nil
+		}
+	}
+	log.Printf("LoadRefresh error[%s]", osin.ErrNotFound.Error())
+	return nil, osin.ErrNotFound
+}
+
+func (store *MemoryStorage) RemoveRefresh(token string) error {
+	log.Printf("RemoveRefresh for token[%s]", token)
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	//the same as mongo, the access stays but loses its refreshtoken
+	if accessToken, ok := store.refreshes[token]; ok {
+		if data, ok := store.accesses[accessToken]; ok {
+			data.RefreshToken = ""
+			store.accesses[accessToken] = data
+		}
+		delete(store.refreshes, token)
+	}
+	return nil
+}
+
+func (store *MemoryStorage) RemoveRefreshAccess(token string) error {
+	log.Printf("RemoveRefreshAccess for token[%s]", token)
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if accessToken, ok := store.refreshes[token]; ok {
+		delete(store.accesses, accessToken)
+		delete(store.refreshes, token)
+	}
+	return nil
+}
+
+func (store *MemoryStorage) LoadUserAccesses(userId string) ([]*osin.AccessData, error) {
+	log.Printf("LoadUserAccesses for user[%s]", userId)
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	found := []*osin.AccessData{}
+	for _, data := range store.accesses {
+		if user := models.GetTokenUserData(data.UserData); user != nil && user.UserId == userId {
+			access := data
+			found = append(found, &access)
+		}
+	}
+	return found, nil
+}
+
+//the user that authorized the code or token is the one given
+func authorizedBy(userData interface{}, userId string) bool {
+	user := models.GetTokenUserData(userData)
+	return user != nil && user.UserId == userId
+}
+
+func (store *MemoryStorage) RemoveUserGrants(userId, clientId string) error {
+	log.Printf("RemoveUserGrants for user[%s] client[%s]", userId, clientId)
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for code, data := range store.authorizes {
+		if data.Client.GetId() == clientId && authorizedBy(data.UserData, userId) {
+			delete(store.authorizes, code)
+		}
+	}
+	for token, data := range store.accesses {
+		if data.Client.GetId() == clientId && authorizedBy(data.UserData, userId) {
+			if data.RefreshToken != "" {
+				delete(store.refreshes, data.RefreshToken)
+			}
+			delete(store.accesses, token)
+		}
+	}
+	return nil
+}
+
+//the scopes of codes and tokens are separated by spaces or commas
+func carriesScope(scope string, scopes []string) bool {
+	for _, carried := range strings.FieldsFunc(scope, func(r rune) bool { return r == ' ' || r == ',' }) {
+		for i := range scopes {
+			if carried == scopes[i] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (store *MemoryStorage) RemoveScopeGrants(clientId string, scopes []string) error {
+	log.Printf("RemoveScopeGrants for client[%s] scopes%v", clientId, scopes)
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for code, data := range store.authorizes {
+		if data.Client.GetId() == clientId && carriesScope(data.Scope, scopes) {
+			delete(store.authorizes, code)
+		}
+	}
+	for token, data := range store.accesses {
+		if data.Client.GetId() == clientId && carriesScope(data.Scope, scopes) {
+			if data.RefreshToken != "" {
+				delete(store.refreshes, data.RefreshToken)
+			}
+			delete(store.accesses, token)
+		}
+	}
+	return nil
+}
+
+func (store *MemoryStorage) SaveDevice(data *models.DeviceAuthorization) error {
+	log.Printf("SaveDevice for code[%s]", data.DeviceCode)
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.devices[data.DeviceCode] = *data
+	store.userCodes[data.UserCode] = data.DeviceCode
+	return nil
+}
+
+func (store *MemoryStorage) LoadDevice(deviceCode string) (*models.DeviceAuthorization, error) {
+	log.Printf("LoadDevice for code[%s]", deviceCode)
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	if data, ok := store.devices[deviceCode]; ok {
+		return &data, nil
+	}
+	log.Printf("LoadDevice error[%s]", osin.ErrNotFound.Error())
+	return nil, osin.ErrNotFound
+}
+
+func (store *MemoryStorage) LoadDeviceByUserCode(userCode string) (*models.DeviceAuthorization, error) {
+	log.Printf("LoadDeviceByUserCode for code[%s]", userCode)
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	if deviceCode, ok := store.userCodes[userCode]; ok {
+		if data, ok := store.devices[deviceCode]; ok {
+			return &data, nil
+		}
+	}
+	log.Printf("LoadDeviceByUserCode error[%s]", osin.ErrNotFound.Error())
+	return nil, osin.ErrNotFound
+}
+
+func (store *MemoryStorage) UpdateDevice(data *models.DeviceAuthorization) error {
+	log.Printf("UpdateDevice for code[%s]", data.DeviceCode)
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	deviceCode := data.DeviceCode
+	if deviceCode == "" {
+		deviceCode = store.userCodes[data.UserCode]
+	}
+	device, ok := store.devices[deviceCode]
+	if ok == false {
+		log.Printf("UpdateDevice error[%s]", osin.ErrNotFound.Error())
+		return osin.ErrNotFound
+	}
+	device.Scope, device.Interval, device.LastPolledAt = data.Scope, data.Interval, data.LastPolledAt
+	device.UserData, device.Denied = data.UserData, data.Denied
+	store.devices[deviceCode] = device
+	return nil
+}
+
+func (store *MemoryStorage) SaveConsent(consent *models.Consent) error {
+	log.Printf("SaveConsent for user[%s] client[%s]", consent.UserId, consent.ClientId)
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.consents[consentKey{consent.UserId, consent.ClientId}] = *consent
+	return nil
+}
+
+func (store *MemoryStorage) LoadConsent(userId, clientId string) (*models.Consent, error) {
+	log.Printf("LoadConsent for user[%s] client[%s]", userId, clientId)
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	if consent, ok := store.consents[consentKey{userId, clientId}]; ok {
+		return &consent, nil
+	}
+	log.Printf("LoadConsent error[%s]", osin.ErrNotFound.Error())
+	return nil, osin.ErrNotFound
+}
+
+func (store *MemoryStorage) LoadUserConsents(userId string) ([]*models.Consent, error) {
+	log.Printf("LoadUserConsents for user[%s]", userId)
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	found := []*models.Consent{}
+	for key, data := range store.consents {
+		if key.userId == userId {
+			consent := data
+			found = append(found, &consent)
+		}
+	}
+	return found, nil
+}
+
+func (store *MemoryStorage) LoadClientConsents(clientId string) ([]*models.Consent, error) {
+	log.Printf("LoadClientConsents for client[%s]", clientId)
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	found := []*models.Consent{}
+	for key, data := range store.consents {
+		if key.clientId == clientId {
+			consent := data
+			found = append(found, &consent)
+		}
+	}
+	return found, nil
+}
+
+func (store *MemoryStorage) RemoveConsent(userId, clientId string) error {
+	log.Printf("RemoveConsent for user[%s] client[%s]", userId, clientId)
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	delete(store.consents, consentKey{userId, clientId})
+	return nil
+}
+
+func (store *MemoryStorage) SetConsentUsed(userId, clientId string, usedAt, staleBefore time.Time) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if consent, ok := store.consents[consentKey{userId, clientId}]; ok && consent.LastUsedAt.Before(staleBefore) {
+		consent.LastUsedAt = usedAt
+		store.consents[consentKey{userId, clientId}] = consent
+	}
+	return nil
+}
+
+func (store *MemoryStorage) SaveAudit(record *models.AuditRecord) error {
+	log.Printf("SaveAudit event[%s] for client[%s]", record.Event, record.ClientId)
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.audits = append(store.audits, *record)
+	return nil
+}
+
+func (store *MemoryStorage) LoadAudits(clientId string) ([]*models.AuditRecord, error) {
+	log.Printf("LoadAudits for client[%s]", clientId)
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	found := []*models.AuditRecord{}
+	for i := range store.audits {
+		if store.audits[i].ClientId == clientId {
+			record := store.audits[i]
+			found = append(found, &record)
+		}
+	}
+	return found, nil
+}
+
+func (store *MemoryStorage) RemoveDevice(deviceCode string) error {
+	log.Printf("RemoveDevice for code[%s]", deviceCode)
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if data, ok := store.devices[deviceCode]; ok {
+		delete(store.userCodes, data.UserCode)
+	}
+	delete(store.devices, deviceCode)
+	return nil
+}
+
+func (store *MemoryStorage) TakeDevice(deviceCode string) (*models.DeviceAuthorization, error) {
+	log.Printf("TakeDevice for code[%s]", deviceCode)
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if data, ok := store.devices[deviceCode]; ok && data.UserData != nil && data.IsExpired() == false {
+		delete(store.userCodes, data.UserCode)
+		delete(store.devices, deviceCode)
+		return &data, nil
+	}
+	log.Printf("TakeDevice error[%s]", osin.ErrNotFound.Error())
+	return nil, osin.ErrNotFound
+}
+
+func (store *MemoryStorage) RemoveExpired() (int, int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := time.Now()
+	codes, tokens := 0, 0
+
+	for code, data := range store.authorizes {
+		if authorizeExpiresAt(&data).Before(now) {
+			delete(store.authorizes, code)
+			codes++
+		}
+	}
+	for deviceCode, data := range store.devices {
+		if data.ExpireAt().Before(now) {
+			delete(store.userCodes, data.UserCode)
+			delete(store.devices, deviceCode)
+			codes++
+		}
+	}
+	for token, data := range store.accesses {
+		if accessExpiresAt(&data, store.refreshExpiry).Before(now) {
+			if data.RefreshToken != "" {
+				delete(store.refreshes, data.RefreshToken)
+			}
+			delete(store.accesses, token)
+			tokens++
+		}
+	}
+	for token, data := range store.initialTokens {
+		if data.IsExpired() {
+			delete(store.initialTokens, token)
+			tokens++
+		}
+	}
+	//the failures and login handles aren't codes or tokens so aren't counted
+	for key, throttle := range store.throttles {
+		if throttle.IsExpired() {
+			delete(store.throttles, key)
+		}
+	}
+	for handle, loginHandle := range store.loginHandles {
+		if loginHandle.IsExpired() {
+			delete(store.loginHandles, handle)
+		}
+	}
+	log.Printf("RemoveExpired removed [%d] codes and [%d] tokens", codes, tokens)
+	return codes, tokens, nil
+}
+
+func (store *MemoryStorage) SaveInitialAccessToken(token *models.InitialAccessToken) error {
+	log.Printf("SaveInitialAccessToken issued by[%s]", token.IssuedBy)
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.initialTokens[token.Token] = *token
+	return nil
+}
+
+func (store *MemoryStorage) LoadInitialAccessToken(token string) (*models.InitialAccessToken, error) {
+	log.Printf("LoadInitialAccessToken for token[%s]", token)
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	if data, ok := store.initialTokens[token]; ok {
+		return &data, nil
+	}
+	log.Printf("LoadInitialAccessToken error[%s]", osin.ErrNotFound.Error())
+	return nil, osin.ErrNotFound
+}
+
+func (store *MemoryStorage) SaveLoginHandle(handle *models.LoginHandle) error {
+	log.Printf("SaveLoginHandle for user[%s]", handle.UserId)
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.loginHandles[handle.Handle] = *handle
+	return nil
+}
+
+func (store *MemoryStorage) TakeLoginHandle(handle string) (*models.LoginHandle, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	loginHandle, ok := store.loginHandles[handle]
+	delete(store.loginHandles, handle)
+	if ok && loginHandle.IsExpired() == false {
+		return &loginHandle, nil
+	}
+	log.Printf("TakeLoginHandle error[%s]", osin.ErrNotFound.Error())
+	return nil, osin.ErrNotFound
+}
+
+func (store *MemoryStorage) AddFailure(key string, at, expiresAt time.Time) (*models.Throttle, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	throttle, ok := store.throttles[key]
+	if ok == false || throttle.ExpiresAt.Before(at) {
+		throttle = models.Throttle{Key: key}
+	}
+	throttle.Failures++
+	throttle.LastFailureAt, throttle.ExpiresAt = at, expiresAt
+	store.throttles[key] = throttle
+	return &throttle, nil
+}
+
+func (store *MemoryStorage) LoadThrottle(key string) (*models.Throttle, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	if throttle, ok := store.throttles[key]; ok && throttle.IsExpired() == false {
+		return &throttle, nil
+	}
+	return nil, osin.ErrNotFound
+}
+
+func (store *MemoryStorage) RemoveThrottle(key string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	delete(store.throttles, key)
+	return nil
+}
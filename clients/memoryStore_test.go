@@ -0,0 +1,370 @@
+package clients
+
+import (
+	"testing"
+	"time"
+
+	"github.com/RangelReale/osin"
+
+	"../models"
+)
+
+func TestMemory_ClientStorage(t *testing.T) {
+
+	ms := NewMemoryStorage()
+
+	if _, err := ms.GetClient(a_client.GetId()); err == nil {
+		t.Fatal("there should be an error when the client doesn't exist")
+	}
+
+	ms.SetClient(a_client.GetId(), a_client)
+
+	if fndClient, err := ms.GetClient(a_client.GetId()); err != nil {
+		t.Fatalf("Error trying to get client %s", err.Error())
+	} else if fndClient.GetId() != a_client.GetId() || fndClient.GetRedirectUri() != a_client.GetRedirectUri() || fndClient.GetSecret() != a_client.GetSecret() {
+		t.Fatalf("got %v expected %v", fndClient, a_client)
+	}
+}
+
+func TestMemory_AuthorizeStorage(t *testing.T) {
+
+	ms := NewMemoryStorage()
+
+	authData := &osin.AuthorizeData{Code: "12+34", Scope: "view", Client: a_client}
+
+	ms.SaveAuthorize(authData)
+
+	if foundAuthorize, err := ms.LoadAuthorize(authData.Code); err != nil {
+		t.Fatalf("Error trying to get auth %s", err.Error())
+	} else if foundAuthorize.Code != authData.Code || foundAuthorize.Scope != authData.Scope || foundAuthorize.Client == nil {
+		t.Fatalf("got %v expected %v", foundAuthorize, authData)
+	}
+
+	ms.RemoveAuthorize(authData.Code)
+
+	if _, err := ms.LoadAuthorize(authData.Code); err == nil {
+		t.Fatal("the auth should have been removed")
+	}
+}
+
+func TestMemory_AccessStorage(t *testing.T) {
+
+	ms := NewMemoryStorage()
+
+	accessData := &osin.AccessData{AccessToken: "4321", RefreshToken: "8765", Client: a_client, Scope: "upload,view", CreatedAt: time.Now()}
+
+	ms.SaveAccess(accessData)
+
+	if foundAccess, err := ms.LoadAccess(accessData.AccessToken); err != nil {
+		t.Fatalf("Error trying to get access %s", err.Error())
+	} else if foundAccess.AccessToken != accessData.AccessToken || foundAccess.Client == nil || foundAccess.Scope != accessData.Scope {
+		t.Fatalf("got %v expected %v", foundAccess, accessData)
+	}
+
+	if foundRefresh, err := ms.LoadRefresh(accessData.RefreshToken); err != nil {
+		t.Fatalf("Error trying to get refresh %s", err.Error())
+	} else if foundRefresh.AccessToken != accessData.AccessToken {
+		t.Fatalf("got %v expected %v", foundRefresh, accessData)
+	}
+
+	ms.RemoveRefresh(accessData.RefreshToken)
+
+	if _, err := ms.LoadRefresh(accessData.RefreshToken); err == nil {
+		t.Fatal("the refresh should have been removed")
+	}
+	if foundAccess, err := ms.LoadAccess(accessData.AccessToken); err != nil || foundAccess.RefreshToken != "" {
+		t.Fatalf("the access should remain without its refresh token got %v", foundAccess)
+	}
+
+	ms.RemoveAccess(accessData.AccessToken)
+
+	if _, err := ms.LoadAccess(accessData.AccessToken); err == nil {
+		t.Fatal("the access should have been removed")
+	}
+
+	//the access goes with its refresh token
+	ms.SaveAccess(accessData)
+	ms.RemoveRefreshAccess(accessData.RefreshToken)
+
+	if _, err := ms.LoadAccess(accessData.AccessToken); err == nil {
+		t.Fatal("the access should have been removed with its refresh token")
+	}
+}
+
+func TestMemory_RemoveExpired(t *testing.T) {
+
+	ms := NewMemoryStorage()
+
+	longAgo := time.Now().Add(-365 * 24 * time.Hour)
+
+	ms.SaveAuthorize(&osin.AuthorizeData{Code: "expired", Client: a_client, ExpiresIn: 60, CreatedAt: longAgo})
+	ms.SaveAuthorize(&osin.AuthorizeData{Code: "current", Client: a_client, ExpiresIn: 60, CreatedAt: time.Now()})
+	ms.SaveAccess(&osin.AccessData{AccessToken: "expired", RefreshToken: "expired-refresh", Client: a_client, ExpiresIn: 60, CreatedAt: longAgo})
+	//the access has gone but the refresh can still be used
+	ms.SaveAccess(&osin.AccessData{AccessToken: "refreshable", RefreshToken: "current-refresh", Client: a_client, ExpiresIn: 60, CreatedAt: time.Now().Add(-time.Hour)})
+
+	if _, err := ms.LoadRefresh("expired-refresh"); err == nil {
+		t.Fatal("an expired refresh token should not be loaded")
+	}
+
+	codes, tokens, err := ms.RemoveExpired()
+
+	if err != nil {
+		t.Fatalf("Error removing expired %s", err.Error())
+	}
+	if codes != 1 || tokens != 1 {
+		t.Fatalf("got [%d] codes and [%d] tokens removed expected one of each", codes, tokens)
+	}
+	if _, err := ms.LoadAuthorize("current"); err != nil {
+		t.Fatal("the current code should not have been removed")
+	}
+	if _, err := ms.LoadRefresh("current-refresh"); err != nil {
+		t.Fatal("the refreshable access should not have been removed")
+	}
+}
+
+func TestMemory_LoadUserAccesses(t *testing.T) {
+
+	ms := NewMemoryStorage()
+
+	ms.SaveAccess(&osin.AccessData{AccessToken: "user-1", Client: a_client, UserData: &models.TokenUserData{UserId: "user-id"}, CreatedAt: time.Now()})
+	ms.SaveAccess(&osin.AccessData{AccessToken: "user-2", Client: a_client, UserData: &models.TokenUserData{UserId: "user-id"}, CreatedAt: time.Now()})
+	ms.SaveAccess(&osin.AccessData{AccessToken: "other", Client: a_client, UserData: &models.TokenUserData{UserId: "other-id"}, CreatedAt: time.Now()})
+
+	if found, err := ms.LoadUserAccesses("user-id"); err != nil {
+		t.Fatalf("Error trying to get the users accesses %s", err.Error())
+	} else if len(found) != 2 {
+		t.Fatalf("got %d accesses expected 2", len(found))
+	}
+
+	if found, _ := ms.LoadUserAccesses("no-id"); len(found) != 0 {
+		t.Fatalf("got %d accesses for a user without any", len(found))
+	}
+}
+
+func TestMemory_DeviceStorage(t *testing.T) {
+
+	ms := NewMemoryStorage()
+
+	ms.SaveDevice(&models.DeviceAuthorization{DeviceCode: "device-code", UserCode: "WDJB-MJHT", ExpiresIn: 60, CreatedAt: time.Now()})
+	ms.SaveDevice(&models.DeviceAuthorization{DeviceCode: "expired", UserCode: "BCDF-GHJK", ExpiresIn: 60, CreatedAt: time.Now().Add(-time.Hour)})
+
+	if foundDevice, err := ms.LoadDeviceByUserCode("WDJB-MJHT"); err != nil {
+		t.Fatalf("Error trying to get the device %s", err.Error())
+	} else if foundDevice.DeviceCode != "device-code" {
+		t.Fatalf("got %v expected the device", foundDevice)
+	}
+
+	//found by the user code alone
+	ms.UpdateDevice(&models.DeviceAuthorization{UserCode: "WDJB-MJHT", Scope: "view", Denied: true})
+	if foundDevice, _ := ms.LoadDevice("device-code"); foundDevice.Scope != "view" || foundDevice.Denied == false || foundDevice.UserCode != "WDJB-MJHT" {
+		t.Fatalf("got %v expected the device to have been updated", foundDevice)
+	}
+	if err := ms.UpdateDevice(&models.DeviceAuthorization{DeviceCode: "other"}); err != osin.ErrNotFound {
+		t.Fatalf("got %v expected the device not to be found", err)
+	}
+
+	if codes, _, _ := ms.RemoveExpired(); codes != 1 {
+		t.Fatalf("got [%d] codes removed expected the expired device", codes)
+	}
+	if _, err := ms.LoadDeviceByUserCode("BCDF-GHJK"); err == nil {
+		t.Fatal("the expired device should have been removed")
+	}
+
+	ms.RemoveDevice("device-code")
+
+	if _, err := ms.LoadDevice("device-code"); err == nil {
+		t.Fatal("the device should have been removed")
+	}
+
+	//only an authorized device is taken and only the once
+	ms.SaveDevice(&models.DeviceAuthorization{DeviceCode: "device-code", UserCode: "WDJB-MJHT", ExpiresIn: 60, CreatedAt: time.Now()})
+	if _, err := ms.TakeDevice("device-code"); err != osin.ErrNotFound {
+		t.Fatalf("got %v expected the device yet to be authorized not to be taken", err)
+	}
+	ms.UpdateDevice(&models.DeviceAuthorization{UserCode: "WDJB-MJHT", UserData: &models.TokenUserData{UserId: "user-id"}})
+	if taken, err := ms.TakeDevice("device-code"); err != nil || taken.UserData == nil || taken.UserData.UserId != "user-id" {
+		t.Fatalf("got %v %v expected the authorized device to be taken", taken, err)
+	}
+	if _, err := ms.TakeDevice("device-code"); err != osin.ErrNotFound {
+		t.Fatalf("got %v expected the device to only be taken the once", err)
+	}
+	if _, err := ms.LoadDeviceByUserCode("WDJB-MJHT"); err == nil {
+		t.Fatal("the taken device should have been removed")
+	}
+}
+
+func TestMemory_InitialAccessToken(t *testing.T) {
+
+	ms := NewMemoryStorage()
+
+	ms.SaveInitialAccessToken(&models.InitialAccessToken{Token: "initial", IssuedBy: "admin-id", CreatedAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)})
+	ms.SaveInitialAccessToken(&models.InitialAccessToken{Token: "expired", IssuedBy: "admin-id", CreatedAt: time.Now().Add(-time.Hour), ExpiresAt: time.Now().Add(-time.Minute)})
+
+	if found, err := ms.LoadInitialAccessToken("initial"); err != nil {
+		t.Fatalf("Error trying to get the initial access token %s", err.Error())
+	} else if found.IssuedBy != "admin-id" || found.IsExpired() {
+		t.Fatalf("got %v expected the initial access token", found)
+	}
+
+	if _, tokens, _ := ms.RemoveExpired(); tokens != 1 {
+		t.Fatalf("got [%d] tokens removed expected the expired initial access token", tokens)
+	}
+	if _, err := ms.LoadInitialAccessToken("expired"); err != osin.ErrNotFound {
+		t.Fatal("the expired initial access token should have been removed")
+	}
+}
+
+func TestMemory_Throttle(t *testing.T) {
+
+	ms := NewMemoryStorage()
+	now := time.Now()
+
+	ms.AddFailure("login:user", now.Add(-time.Minute), now.Add(time.Hour))
+	if throttle, _ := ms.AddFailure("login:user", now, now.Add(time.Hour)); throttle.Failures != 2 || throttle.LastFailureAt.Equal(now) == false {
+		t.Fatalf("got %v expected the failures to be counted", throttle)
+	}
+	//the failures are forgotten once they have expired
+	ms.AddFailure("login:expired", now.Add(-2*time.Hour), now.Add(-time.Hour))
+	if _, err := ms.LoadThrottle("login:expired"); err != osin.ErrNotFound {
+		t.Fatal("the expired failures should not have been found")
+	}
+	if throttle, _ := ms.AddFailure("login:expired", now, now.Add(time.Hour)); throttle.Failures != 1 {
+		t.Fatalf("got %v expected the count to start again", throttle)
+	}
+
+	ms.RemoveThrottle("login:user")
+	if _, err := ms.LoadThrottle("login:user"); err != osin.ErrNotFound {
+		t.Fatal("the failures should have been removed")
+	}
+
+	ms.AddFailure("login:old", now.Add(-2*time.Hour), now.Add(-time.Hour))
+	if codes, tokens, _ := ms.RemoveExpired(); codes != 0 || tokens != 0 || len(ms.throttles) != 1 {
+		t.Fatalf("got [%d] codes [%d] tokens and %v expected only the expired failures removed", codes, tokens, ms.throttles)
+	}
+}
+
+func TestMemory_Audits(t *testing.T) {
+
+	ms := NewMemoryStorage()
+
+	ms.SaveAudit(&models.AuditRecord{Event: models.AuditAccessDenied, ClientId: "1234", CreatedAt: time.Now()})
+	ms.SaveAudit(&models.AuditRecord{Event: models.AuditAccessDenied, ClientId: "other", CreatedAt: time.Now()})
+
+	if found, err := ms.LoadAudits("1234"); err != nil {
+		t.Fatalf("Error trying to get the audits %s", err.Error())
+	} else if len(found) != 1 || found[0].ClientId != "1234" {
+		t.Fatalf("got %v expected only the audits for the client", found)
+	}
+}
+
+func TestMemory_Consent(t *testing.T) {
+
+	ms := NewMemoryStorage()
+
+	if _, err := ms.LoadConsent("user-id", "1234"); err != osin.ErrNotFound {
+		t.Fatal("there should be no consent until one is saved")
+	}
+
+	ms.SaveConsent(&models.Consent{UserId: "user-id", ClientId: "1234", Scope: "view"})
+	ms.SaveConsent(&models.Consent{UserId: "user-id", ClientId: "1234", Scope: "view,upload"})
+
+	if found, err := ms.LoadConsent("user-id", "1234"); err != nil {
+		t.Fatalf("Error trying to get the consent %s", err.Error())
+	} else if found.Scope != "view,upload" {
+		t.Fatalf("got %v expected the consent to have been replaced", found)
+	}
+}
+
+func TestMemory_UserGrants(t *testing.T) {
+
+	ms := NewMemoryStorage()
+	other := &osin.DefaultClient{Id: "other"}
+	user := &models.TokenUserData{UserId: "user-id"}
+
+	ms.SaveAuthorize(&osin.AuthorizeData{Code: "code", Client: a_client, UserData: user, ExpiresIn: 60, CreatedAt: time.Now()})
+	ms.SaveAccess(&osin.AccessData{AccessToken: "access", RefreshToken: "refresh", Client: a_client, UserData: user, ExpiresIn: 60, CreatedAt: time.Now()})
+	ms.SaveAccess(&osin.AccessData{AccessToken: "other-access", Client: other, UserData: user, ExpiresIn: 60, CreatedAt: time.Now()})
+	ms.SaveConsent(&models.Consent{UserId: "user-id", ClientId: a_client.Id, Scope: "view"})
+	ms.SaveConsent(&models.Consent{UserId: "user-id", ClientId: other.Id, Scope: "view"})
+
+	usedAt := time.Now()
+	ms.SetConsentUsed("user-id", a_client.Id, usedAt, usedAt)
+	if found, _ := ms.LoadConsent("user-id", a_client.Id); found.LastUsedAt.Equal(usedAt) == false {
+		t.Fatal("the consent should have been used")
+	}
+	ms.SetConsentUsed("user-id", a_client.Id, usedAt.Add(time.Minute), usedAt)
+	if found, _ := ms.LoadConsent("user-id", a_client.Id); found.LastUsedAt.Equal(usedAt) == false {
+		t.Fatal("a use so soon after the last should not have been written")
+	}
+
+	ms.RemoveUserGrants("user-id", a_client.Id)
+	ms.RemoveConsent("user-id", a_client.Id)
+
+	if _, err := ms.LoadAuthorize("code"); err == nil {
+		t.Fatal("the code should have been removed")
+	}
+	if _, err := ms.LoadRefresh("refresh"); err == nil {
+		t.Fatal("the refresh token should have been removed")
+	}
+	if found, _ := ms.LoadUserAccesses("user-id"); len(found) != 1 || found[0].Client.GetId() != other.Id {
+		t.Fatalf("got %v expected only the other client's token", found)
+	}
+	if found, _ := ms.LoadUserConsents("user-id"); len(found) != 1 || found[0].ClientId != other.Id {
+		t.Fatalf("got %v expected only the other client's consent", found)
+	}
+}
+
+func TestMemory_ScopeGrants(t *testing.T) {
+
+	ms := NewMemoryStorage()
+	other := &osin.DefaultClient{Id: "other"}
+	user := &models.TokenUserData{UserId: "user-id"}
+
+	ms.SaveAuthorize(&osin.AuthorizeData{Code: "code", Client: a_client, UserData: user, Scope: "view upload", ExpiresIn: 60, CreatedAt: time.Now()})
+	ms.SaveAccess(&osin.AccessData{AccessToken: "access", RefreshToken: "refresh", Client: a_client, UserData: user, Scope: "view,upload", ExpiresIn: 60, CreatedAt: time.Now()})
+	ms.SaveAccess(&osin.AccessData{AccessToken: "view-access", Client: a_client, UserData: user, Scope: "view", ExpiresIn: 60, CreatedAt: time.Now()})
+	ms.SaveAccess(&osin.AccessData{AccessToken: "other-access", Client: other, UserData: user, Scope: "upload", ExpiresIn: 60, CreatedAt: time.Now()})
+
+	ms.RemoveScopeGrants(a_client.Id, []string{"upload"})
+
+	if _, err := ms.LoadAuthorize("code"); err == nil {
+		t.Fatal("the code with the scope should have been removed")
+	}
+	if _, err := ms.LoadRefresh("refresh"); err == nil {
+		t.Fatal("the refresh token with the scope should have been removed")
+	}
+	if found, _ := ms.LoadUserAccesses("user-id"); len(found) != 2 {
+		t.Fatalf("got %v expected the token without the scope and the other client's token", found)
+	}
+}
+
+func TestMemory_DeveloperClients(t *testing.T) {
+
+	ms := NewMemoryStorage()
+	developers := &osin.DefaultClient{Id: "developers-app", UserData: map[string]interface{}{UserDataDeveloperId: "developer-id"}}
+
+	ms.SetClient(a_client.Id, a_client)
+	ms.SetClient(developers.Id, developers)
+	ms.SaveAccess(&osin.AccessData{AccessToken: "access", Client: developers, UserData: &models.TokenUserData{UserId: "user-id"}, ExpiresIn: 60, CreatedAt: time.Now()})
+	ms.SaveConsent(&models.Consent{UserId: "user-id", ClientId: developers.Id, Scope: "view"})
+
+	if found, _ := ms.LoadDeveloperClients("developer-id"); len(found) != 1 || found[0].GetId() != developers.Id {
+		t.Fatalf("got %v expected only the developer's client", found)
+	}
+	if found, _ := ms.LoadClientConsents(developers.Id); len(found) != 1 {
+		t.Fatalf("got %v expected the consent for the client", found)
+	}
+
+	ms.RemoveClient(developers.Id)
+
+	if _, err := ms.GetClient(developers.Id); err == nil {
+		t.Fatal("the client should have been removed")
+	}
+	if _, err := ms.LoadAccess("access"); err == nil {
+		t.Fatal("the client's token should have been removed")
+	}
+	if _, err := ms.LoadConsent("user-id", developers.Id); err == nil {
+		t.Fatal("the consent for the client should have been removed")
+	}
+}
@@ -2,25 +2,63 @@ package clients
 
 import (
 	"log"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/RangelReale/osin"
 	"github.com/tidepool-org/go-common/clients/mongo"
 	"labix.org/v2/mgo"
 	"labix.org/v2/mgo/bson"
+
+	"../models"
 )
 
-type OAuthStorage struct {
-	session *mgo.Session
-}
+type (
+	OAuthStorage struct {
+		session       *mgo.Session
+		refreshExpiry time.Duration
+	}
+	//the stored authorize with when mongo can expire it.
+	//The userdata holds the client so what osin was given as userdata is kept as tokenuserdata
+	authorizeDoc struct {
+		osin.AuthorizeData `bson:",inline"`
+		ExpiresAt          time.Time             `bson:"expiresat"`
+		TokenUserData      *models.TokenUserData `bson:"tokenuserdata,omitempty"`
+	}
+	//the stored access with when mongo can expire it
+	accessDoc struct {
+		osin.AccessData `bson:",inline"`
+		ExpiresAt       time.Time             `bson:"expiresat"`
+		TokenUserData   *models.TokenUserData `bson:"tokenuserdata,omitempty"`
+	}
+	//the stored device authorization with when mongo can expire it
+	deviceDoc struct {
+		models.DeviceAuthorization `bson:",inline"`
+		ExpiresAt                  time.Time `bson:"expiresat"`
+	}
+)
 
 const (
 	//mongo collections
 	client_collection    = "oauth_client"
 	authorize_collection = "oauth_authorize"
 	access_collection    = "oauth_access"
+	device_collection    = "oauth_device"
+	consent_collection   = "oauth_consent"
+	audit_collection     = "oauth_audit"
+	initial_collection   = "oauth_initial_token"
+	throttle_collection  = "oauth_throttle"
+	login_collection     = "oauth_login_handle"
 	db_name              = ""
 
 	refreshtoken = "refreshtoken"
+	expiresat    = "expiresat"
+	tokenuserid  = "tokenuserdata.userid"
+	//where the client is kept, see https://github.com/RangelReale/osin/issues/40
+	clientid = "userdata.id"
+	//the developer a client belongs to
+	developerid = "userdata." + UserDataDeveloperId
 )
 
 //filter used to exclude the mongo _id from being returned
@@ -33,7 +71,7 @@ func NewOAuthStorage(config *mongo.Config) *OAuthStorage {
 		log.Fatal(err)
 	}
 
-	storage := &OAuthStorage{session: mongoSession}
+	storage := &OAuthStorage{session: mongoSession, refreshExpiry: default_refresh_expire_days * oneDay}
 
 	index := mgo.Index{
 		Key:        []string{refreshtoken},
@@ -50,13 +88,92 @@ func NewOAuthStorage(config *mongo.Config) *OAuthStorage {
 		log.Printf("NewOAuthStorage EnsureIndex error[%s] ", idxErr.Error())
 		log.Fatal(idxErr)
 	}
+
+	//finding the clients of a developer
+	developerIndex := mgo.Index{
+		Key:        []string{developerid},
+		Background: true,
+		Sparse:     true,
+	}
+
+	if idxErr := storage.session.DB(db_name).C(client_collection).EnsureIndex(developerIndex); idxErr != nil {
+		log.Printf("NewOAuthStorage EnsureIndex error[%s] ", idxErr.Error())
+		log.Fatal(idxErr)
+	}
+
+	//finding the tokens a user has given
+	userIndex := mgo.Index{
+		Key:        []string{tokenuserid},
+		Background: true,
+		Sparse:     true,
+	}
+
+	if idxErr := accesses.EnsureIndex(userIndex); idxErr != nil {
+		log.Printf("NewOAuthStorage EnsureIndex error[%s] ", idxErr.Error())
+		log.Fatal(idxErr)
+	}
+
+	//devices are found by either code
+	devices := storage.session.DB(db_name).C(device_collection)
+	for _, key := range []string{"devicecode", "usercode"} {
+		if idxErr := devices.EnsureIndex(mgo.Index{Key: []string{key}, Unique: true, Background: true}); idxErr != nil {
+			log.Printf("NewOAuthStorage EnsureIndex error[%s] ", idxErr.Error())
+			log.Fatal(idxErr)
+		}
+	}
+
+	//a user has the one consent for each client
+	consents := storage.session.DB(db_name).C(consent_collection)
+	if idxErr := consents.EnsureIndex(mgo.Index{Key: []string{"userid", "clientid"}, Unique: true, Background: true}); idxErr != nil {
+		log.Printf("NewOAuthStorage EnsureIndex error[%s] ", idxErr.Error())
+		log.Fatal(idxErr)
+	}
+
+	//the audit trail is read a client at a time
+	audits := storage.session.DB(db_name).C(audit_collection)
+	if idxErr := audits.EnsureIndex(mgo.Index{Key: []string{"clientid", "createdat"}, Background: true}); idxErr != nil {
+		log.Printf("NewOAuthStorage EnsureIndex error[%s] ", idxErr.Error())
+		log.Fatal(idxErr)
+	}
+
+	//initial access tokens are looked up by the token
+	if idxErr := storage.session.DB(db_name).C(initial_collection).EnsureIndex(mgo.Index{Key: []string{"token"}, Unique: true, Background: true}); idxErr != nil {
+		log.Printf("NewOAuthStorage EnsureIndex error[%s] ", idxErr.Error())
+		log.Fatal(idxErr)
+	}
+
+	//the failures of each key are counted in the one document
+	if idxErr := storage.session.DB(db_name).C(throttle_collection).EnsureIndex(mgo.Index{Key: []string{"key"}, Unique: true, Background: true}); idxErr != nil {
+		log.Printf("NewOAuthStorage EnsureIndex error[%s] ", idxErr.Error())
+		log.Fatal(idxErr)
+	}
+
+	//login handles are taken by the handle
+	if idxErr := storage.session.DB(db_name).C(login_collection).EnsureIndex(mgo.Index{Key: []string{"handle"}, Unique: true, Background: true}); idxErr != nil {
+		log.Printf("NewOAuthStorage EnsureIndex error[%s] ", idxErr.Error())
+		log.Fatal(idxErr)
+	}
+
+	//mongo removes the codes and tokens itself once they are past expiresat
+	expiryIndex := mgo.Index{
+		Key:         []string{expiresat},
+		Background:  true,
+		ExpireAfter: time.Second, //zero would mean no expiry
+	}
+
+	for _, collection := range []string{authorize_collection, access_collection, device_collection, initial_collection, throttle_collection, login_collection} {
+		if idxErr := storage.session.DB(db_name).C(collection).EnsureIndex(expiryIndex); idxErr != nil {
+			log.Printf("NewOAuthStorage EnsureIndex on %s error[%s] ", collection, idxErr.Error())
+			log.Fatal(idxErr)
+		}
+	}
 	return storage
 }
 
 func getUserData(raw interface{}) map[string]interface{} {
 	if raw != nil {
-		userDataM := raw.(bson.M)
-		return map[string]interface{}{"AppName": userDataM["AppName"]}
+		//the app name and any client settings
+		return map[string]interface{}(raw.(bson.M))
 	}
 	log.Print("getUserData has no raw data to process")
 	return nil
@@ -79,6 +196,27 @@ func getClient(raw interface{}) *osin.DefaultClient {
 	return &osin.DefaultClient{}
 }
 
+//the client as a DefaultClient so it can be saved
+func toDefaultClient(client osin.Client) *osin.DefaultClient {
+	if defaultClient, ok := client.(*osin.DefaultClient); ok {
+		return defaultClient
+	}
+	defaultClient := &osin.DefaultClient{}
+	defaultClient.CopyFrom(client)
+	return defaultClient
+}
+
+//the access as osin knows it, see https://github.com/RangelReale/osin/issues/40
+func (doc *accessDoc) toAccessData() *osin.AccessData {
+	data := &doc.AccessData
+	data.Client = getClient(data.UserData)
+	data.UserData = nil
+	if doc.TokenUserData != nil {
+		data.UserData = doc.TokenUserData
+	}
+	return data
+}
+
 func (s *OAuthStorage) Clone() osin.Storage {
 	return s
 }
@@ -97,6 +235,10 @@ func (store *OAuthStorage) GetClient(id string) (osin.Client, error) {
 	client := &osin.DefaultClient{}
 	if err := clients.Find(bson.M{"id": id}).Select(selectFilter).One(client); err != nil {
 		log.Printf("GetClient error[%s]", err.Error())
+		if err == mgo.ErrNotFound {
+			//so osin knows the client doesn't exist rather than the storage having failed
+			return nil, osin.ErrNotFound
+		}
 		return nil, err
 	}
 	log.Printf("GetClient found %v", client)
@@ -117,17 +259,60 @@ func (store *OAuthStorage) SetClient(id string, client osin.Client) error {
 	return err
 }
 
+func (store *OAuthStorage) LoadDeveloperClients(developerId string) ([]osin.Client, error) {
+	log.Printf("LoadDeveloperClients for developer[%s]", developerId)
+	cpy := store.session.Copy()
+	defer cpy.Close()
+	clients := cpy.DB(db_name).C(client_collection)
+
+	var docs []*osin.DefaultClient
+	if err := clients.Find(bson.M{developerid: developerId}).Select(selectFilter).All(&docs); err != nil {
+		log.Printf("LoadDeveloperClients error[%s]", err.Error())
+		return nil, err
+	}
+	found := make([]osin.Client, 0, len(docs))
+	for _, client := range docs {
+		client.UserData = getUserData(client.UserData)
+		found = append(found, client)
+	}
+	return found, nil
+}
+
+func (store *OAuthStorage) RemoveClient(id string) error {
+	log.Printf("RemoveClient id[%s]", id)
+	cpy := store.session.Copy()
+	defer cpy.Close()
+	db := cpy.DB(db_name)
+
+	removals := map[string]bson.M{
+		authorize_collection: {clientid: id},
+		access_collection:    {clientid: id},
+		device_collection:    {"clientid": id},
+		consent_collection:   {"clientid": id},
+		client_collection:    {"id": id},
+	}
+	for collection, query := range removals {
+		if _, err := db.C(collection).RemoveAll(query); err != nil {
+			log.Printf("RemoveClient error[%s] removing from %s", err.Error(), collection)
+			return err
+		}
+	}
+	return nil
+}
+
 func (store *OAuthStorage) SaveAuthorize(data *osin.AuthorizeData) error {
 	log.Printf("SaveAuthorize for code[%s]", data.Code)
 	cpy := store.session.Copy()
 	defer cpy.Close()
 	authorizations := cpy.DB(db_name).C(authorize_collection)
 
+	doc := authorizeDoc{AuthorizeData: *data, ExpiresAt: authorizeExpiresAt(data), TokenUserData: models.GetTokenUserData(data.UserData)}
+
 	//see https://github.com/RangelReale/osin/issues/40
-	data.UserData = data.Client.(*osin.DefaultClient)
-	data.Client = nil
+	doc.UserData = toDefaultClient(data.Client)
+	doc.Client = nil
 
-	if _, err := authorizations.Upsert(bson.M{"code": data.Code}, data); err != nil {
+	if _, err := authorizations.Upsert(bson.M{"code": data.Code}, doc); err != nil {
 		log.Printf("SaveAuthorize error[%s]", err.Error())
 		return err
 	}
@@ -139,18 +324,22 @@ func (store *OAuthStorage) LoadAuthorize(code string) (*osin.AuthorizeData, erro
 	cpy := store.session.Copy()
 	defer cpy.Close()
 	authorizations := cpy.DB(db_name).C(authorize_collection)
-	data := &osin.AuthorizeData{}
+	doc := &authorizeDoc{}
 
-	if err := authorizations.Find(bson.M{"code": code}).Select(selectFilter).One(data); err != nil {
+	if err := authorizations.Find(bson.M{"code": code}).Select(selectFilter).One(doc); err != nil {
 		log.Printf("LoadAuthorize error[%s]", err.Error())
 		return nil, err
 	}
 
-	log.Printf("LoadAuthorize found %v", data)
+	log.Printf("LoadAuthorize found %v", doc.AuthorizeData)
 
 	//see https://github.com/RangelReale/osin/issues/40
+	data := &doc.AuthorizeData
 	data.Client = getClient(data.UserData)
 	data.UserData = nil
+	if doc.TokenUserData != nil {
+		data.UserData = doc.TokenUserData
+	}
 
 	return data, nil
 }
@@ -168,13 +357,15 @@ func (store *OAuthStorage) SaveAccess(data *osin.AccessData) error {
 	cpy := store.session.Copy()
 	defer cpy.Close()
 
-	//see https://github.com/RangelReale/osin/issues/40
-	data.UserData = data.Client.(*osin.DefaultClient)
-	data.Client = nil
-
 	accesses := cpy.DB(db_name).C(access_collection)
 
-	if _, err := accesses.Upsert(bson.M{"accesstoken": data.AccessToken}, data); err != nil {
+	doc := accessDoc{AccessData: *data, ExpiresAt: accessExpiresAt(data, store.refreshExpiry), TokenUserData: models.GetTokenUserData(data.UserData)}
+
+	//see https://github.com/RangelReale/osin/issues/40
+	doc.UserData = toDefaultClient(data.Client)
+	doc.Client = nil
+
+	if _, err := accesses.Upsert(bson.M{"accesstoken": data.AccessToken}, doc); err != nil {
 		log.Printf("SaveAccess error[%s]", err.Error())
 	}
 
@@ -186,17 +377,13 @@ func (store *OAuthStorage) LoadAccess(token string) (*osin.AccessData, error) {
 	cpy := store.session.Copy()
 	defer cpy.Close()
 	accesses := cpy.DB(db_name).C(access_collection)
-	data := &osin.AccessData{}
-	if err := accesses.Find(bson.M{"accesstoken": token}).Select(selectFilter).One(data); err != nil {
+	doc := &accessDoc{}
+	if err := accesses.Find(bson.M{"accesstoken": token}).Select(selectFilter).One(doc); err != nil {
 		log.Printf("LoadAccess error[%s]", err.Error())
 		return nil, err
 	}
-	log.Printf("LoadAccess found %v", data)
-	//see https://github.com/RangelReale/osin/issues/40
-	data.Client = getClient(data.UserData)
-	data.UserData = nil
-
-	return data, nil
+	log.Printf("LoadAccess found %v", doc.AccessData)
+	return doc.toAccessData(), nil
 }
 
 func (store *OAuthStorage) RemoveAccess(token string) error {
@@ -212,14 +399,18 @@ func (store *OAuthStorage) LoadRefresh(token string) (*osin.AccessData, error) {
 	cpy := store.session.Copy()
 	defer cpy.Close()
 	accesses := cpy.DB(db_name).C(access_collection)
-	data := new(osin.AccessData)
+	doc := new(accessDoc)
 
-	if err := accesses.Find(bson.M{"refreshtoken": token}).Select(selectFilter).One(data); err != nil {
+	if err := accesses.Find(bson.M{"refreshtoken": token}).Select(selectFilter).One(doc); err != nil {
 		log.Printf("LoadRefresh error[%s]", err.Error())
 		return nil, err
 	}
-	log.Printf("LoadRefresh found %v", data)
-	return data, nil
+	if refreshExpiresAt(&doc.AccessData, store.refreshExpiry).Before(time.Now()) {
+		log.Print("LoadRefresh error[refresh token has expired]")
+		return nil, mgo.ErrNotFound
+	}
+	log.Printf("LoadRefresh found %v", doc.AccessData)
+	return doc.toAccessData(), nil
 }
 
 func (store *OAuthStorage) RemoveRefresh(token string) error {
@@ -232,3 +423,514 @@ func (store *OAuthStorage) RemoveRefresh(token string) error {
 			refreshtoken: 1,
 		}})
 }
+
+func (store *OAuthStorage) RemoveRefreshAccess(token string) error {
+	log.Printf("RemoveRefreshAccess for token[%s]", token)
+	cpy := store.session.Copy()
+	defer cpy.Close()
+	accesses := cpy.DB(db_name).C(access_collection)
+	return accesses.Remove(bson.M{refreshtoken: token})
+}
+
+func (store *OAuthStorage) LoadUserAccesses(userId string) ([]*osin.AccessData, error) {
+	log.Printf("LoadUserAccesses for user[%s]", userId)
+	cpy := store.session.Copy()
+	defer cpy.Close()
+	accesses := cpy.DB(db_name).C(access_collection)
+
+	var docs []*accessDoc
+	if err := accesses.Find(bson.M{tokenuserid: userId}).Select(selectFilter).All(&docs); err != nil {
+		log.Printf("LoadUserAccesses error[%s]", err.Error())
+		return nil, err
+	}
+	found := make([]*osin.AccessData, 0, len(docs))
+	for _, doc := range docs {
+		found = append(found, doc.toAccessData())
+	}
+	return found, nil
+}
+
+func (store *OAuthStorage) RemoveUserGrants(userId, clientId string) error {
+	log.Printf("RemoveUserGrants for user[%s] client[%s]", userId, clientId)
+	cpy := store.session.Copy()
+	defer cpy.Close()
+	db := cpy.DB(db_name)
+
+	granted := bson.M{tokenuserid: userId, clientid: clientId}
+	for _, collection := range []string{authorize_collection, access_collection} {
+		if _, err := db.C(collection).RemoveAll(granted); err != nil {
+			log.Printf("RemoveUserGrants error[%s] removing from %s", err.Error(), collection)
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *OAuthStorage) RemoveScopeGrants(clientId string, scopes []string) error {
+	log.Printf("RemoveScopeGrants for client[%s] scopes%v", clientId, scopes)
+	cpy := store.session.Copy()
+	defer cpy.Close()
+	db := cpy.DB(db_name)
+
+	//the scopes of codes and tokens are separated by spaces or commas
+	carried := make([]interface{}, len(scopes))
+	for i := range scopes {
+		carried[i] = bson.RegEx{Pattern: "(^|[ ,])" + regexp.QuoteMeta(scopes[i]) + "($|[ ,])"}
+	}
+	granted := bson.M{clientid: clientId, "scope": bson.M{"$in": carried}}
+	for _, collection := range []string{authorize_collection, access_collection} {
+		if _, err := db.C(collection).RemoveAll(granted); err != nil {
+			log.Printf("RemoveScopeGrants error[%s] removing from %s", err.Error(), collection)
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *OAuthStorage) SaveDevice(data *models.DeviceAuthorization) error {
+	log.Printf("SaveDevice for code[%s]", data.DeviceCode)
+	cpy := store.session.Copy()
+	defer cpy.Close()
+	devices := cpy.DB(db_name).C(device_collection)
+
+	doc := deviceDoc{DeviceAuthorization: *data, ExpiresAt: data.ExpireAt()}
+
+	if _, err := devices.Upsert(bson.M{"devicecode": data.DeviceCode}, doc); err != nil {
+		log.Printf("SaveDevice error[%s]", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (store *OAuthStorage) loadDevice(query bson.M) (*models.DeviceAuthorization, error) {
+	cpy := store.session.Copy()
+	defer cpy.Close()
+	devices := cpy.DB(db_name).C(device_collection)
+
+	doc := &deviceDoc{}
+	if err := devices.Find(query).Select(selectFilter).One(doc); err != nil {
+		log.Printf("LoadDevice error[%s]", err.Error())
+		if err == mgo.ErrNotFound {
+			return nil, osin.ErrNotFound
+		}
+		return nil, err
+	}
+	return &doc.DeviceAuthorization, nil
+}
+
+func (store *OAuthStorage) LoadDevice(deviceCode string) (*models.DeviceAuthorization, error) {
+	log.Printf("LoadDevice for code[%s]", deviceCode)
+	return store.loadDevice(bson.M{"devicecode": deviceCode})
+}
+
+func (store *OAuthStorage) LoadDeviceByUserCode(userCode string) (*models.DeviceAuthorization, error) {
+	log.Printf("LoadDeviceByUserCode for code[%s]", userCode)
+	return store.loadDevice(bson.M{"usercode": userCode})
+}
+
+func (store *OAuthStorage) RemoveDevice(deviceCode string) error {
+	log.Printf("RemoveDevice for code[%s]", deviceCode)
+	cpy := store.session.Copy()
+	defer cpy.Close()
+	devices := cpy.DB(db_name).C(device_collection)
+	return devices.Remove(bson.M{"devicecode": deviceCode})
+}
+
+func (store *OAuthStorage) TakeDevice(deviceCode string) (*models.DeviceAuthorization, error) {
+	log.Printf("TakeDevice for code[%s]", deviceCode)
+	cpy := store.session.Copy()
+	defer cpy.Close()
+	devices := cpy.DB(db_name).C(device_collection)
+
+	//found and removed in the one go so two polls of the same device can't both be given tokens
+	doc := &deviceDoc{}
+	query := bson.M{"devicecode": deviceCode, "userdata": bson.M{"$ne": nil}, expiresat: bson.M{"$gte": time.Now()}}
+	if _, err := devices.Find(query).Select(selectFilter).Apply(mgo.Change{Remove: true}, doc); err != nil {
+		log.Printf("TakeDevice error[%s]", err.Error())
+		if err == mgo.ErrNotFound {
+			return nil, osin.ErrNotFound
+		}
+		return nil, err
+	}
+	return &doc.DeviceAuthorization, nil
+}
+
+func (store *OAuthStorage) UpdateDevice(data *models.DeviceAuthorization) error {
+	log.Printf("UpdateDevice for code[%s]", data.DeviceCode)
+	cpy := store.session.Copy()
+	defer cpy.Close()
+	devices := cpy.DB(db_name).C(device_collection)
+
+	query := bson.M{"devicecode": data.DeviceCode}
+	if data.DeviceCode == "" {
+		query = bson.M{"usercode": data.UserCode}
+	}
+	err := devices.Update(query, bson.M{"$set": bson.M{
+		"scope":        data.Scope,
+		"interval":     data.Interval,
+		"lastpolledat": data.LastPolledAt,
+		"userdata":     data.UserData,
+		"denied":       data.Denied,
+	}})
+	if err == mgo.ErrNotFound {
+		return osin.ErrNotFound
+	}
+	return err
+}
+
+func (store *OAuthStorage) SaveConsent(consent *models.Consent) error {
+	log.Printf("SaveConsent for user[%s] client[%s]", consent.UserId, consent.ClientId)
+	cpy := store.session.Copy()
+	defer cpy.Close()
+	consents := cpy.DB(db_name).C(consent_collection)
+
+	if _, err := consents.Upsert(bson.M{"userid": consent.UserId, "clientid": consent.ClientId}, consent); err != nil {
+		log.Printf("SaveConsent error[%s]", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (store *OAuthStorage) LoadConsent(userId, clientId string) (*models.Consent, error) {
+	log.Printf("LoadConsent for user[%s] client[%s]", userId, clientId)
+	cpy := store.session.Copy()
+	defer cpy.Close()
+	consents := cpy.DB(db_name).C(consent_collection)
+
+	consent := &models.Consent{}
+	if err := consents.Find(bson.M{"userid": userId, "clientid": clientId}).Select(selectFilter).One(consent); err != nil {
+		log.Printf("LoadConsent error[%s]", err.Error())
+		if err == mgo.ErrNotFound {
+			return nil, osin.ErrNotFound
+		}
+		return nil, err
+	}
+	return consent, nil
+}
+
+func (store *OAuthStorage) LoadUserConsents(userId string) ([]*models.Consent, error) {
+	log.Printf("LoadUserConsents for user[%s]", userId)
+	cpy := store.session.Copy()
+	defer cpy.Close()
+	consents := cpy.DB(db_name).C(consent_collection)
+
+	found := []*models.Consent{}
+	if err := consents.Find(bson.M{"userid": userId}).Select(selectFilter).All(&found); err != nil {
+		log.Printf("LoadUserConsents error[%s]", err.Error())
+		return nil, err
+	}
+	return found, nil
+}
+
+func (store *OAuthStorage) LoadClientConsents(clientId string) ([]*models.Consent, error) {
+	log.Printf("LoadClientConsents for client[%s]", clientId)
+	cpy := store.session.Copy()
+	defer cpy.Close()
+	consents := cpy.DB(db_name).C(consent_collection)
+
+	found := []*models.Consent{}
+	if err := consents.Find(bson.M{"clientid": clientId}).Select(selectFilter).All(&found); err != nil {
+		log.Printf("LoadClientConsents error[%s]", err.Error())
+		return nil, err
+	}
+	return found, nil
+}
+
+func (store *OAuthStorage) RemoveConsent(userId, clientId string) error {
+	log.Printf("RemoveConsent for user[%s] client[%s]", userId, clientId)
+	cpy := store.session.Copy()
+	defer cpy.Close()
+	consents := cpy.DB(db_name).C(consent_collection)
+
+	if err := consents.Remove(bson.M{"userid": userId, "clientid": clientId}); err != nil && err != mgo.ErrNotFound {
+		log.Printf("RemoveConsent error[%s]", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (store *OAuthStorage) SetConsentUsed(userId, clientId string, usedAt, staleBefore time.Time) error {
+	cpy := store.session.Copy()
+	defer cpy.Close()
+	consents := cpy.DB(db_name).C(consent_collection)
+
+	//there is nothing to record against when the consent was given before they were kept or the use recorded is recent enough
+	stale := bson.M{"userid": userId, "clientid": clientId, "$or": []bson.M{
+		{"lastusedat": bson.M{"$lt": staleBefore}},
+		{"lastusedat": bson.M{"$exists": false}},
+	}}
+	if err := consents.Update(stale, bson.M{"$set": bson.M{"lastusedat": usedAt}}); err != nil && err != mgo.ErrNotFound {
+		log.Printf("SetConsentUsed error[%s]", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (store *OAuthStorage) SaveAudit(record *models.AuditRecord) error {
+	log.Printf("SaveAudit event[%s] for client[%s]", record.Event, record.ClientId)
+	cpy := store.session.Copy()
+	defer cpy.Close()
+	audits := cpy.DB(db_name).C(audit_collection)
+
+	if err := audits.Insert(record); err != nil {
+		log.Printf("SaveAudit error[%s]", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (store *OAuthStorage) LoadAudits(clientId string) ([]*models.AuditRecord, error) {
+	log.Printf("LoadAudits for client[%s]", clientId)
+	cpy := store.session.Copy()
+	defer cpy.Close()
+	audits := cpy.DB(db_name).C(audit_collection)
+
+	found := []*models.AuditRecord{}
+	if err := audits.Find(bson.M{"clientid": clientId}).Select(selectFilter).Sort("createdat").All(&found); err != nil {
+		log.Printf("LoadAudits error[%s]", err.Error())
+		return nil, err
+	}
+	return found, nil
+}
+
+func (store *OAuthStorage) SaveInitialAccessToken(token *models.InitialAccessToken) error {
+	log.Printf("SaveInitialAccessToken issued by[%s]", token.IssuedBy)
+	cpy := store.session.Copy()
+	defer cpy.Close()
+	initialTokens := cpy.DB(db_name).C(initial_collection)
+
+	if _, err := initialTokens.Upsert(bson.M{"token": token.Token}, token); err != nil {
+		log.Printf("SaveInitialAccessToken error[%s]", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (store *OAuthStorage) LoadInitialAccessToken(token string) (*models.InitialAccessToken, error) {
+	log.Printf("LoadInitialAccessToken for token[%s]", token)
+	cpy := store.session.Copy()
+	defer cpy.Close()
+	initialTokens := cpy.DB(db_name).C(initial_collection)
+
+	found := &models.InitialAccessToken{}
+	if err := initialTokens.Find(bson.M{"token": token}).Select(selectFilter).One(found); err != nil {
+		log.Printf("LoadInitialAccessToken error[%s]", err.Error())
+		if err == mgo.ErrNotFound {
+			return nil, osin.ErrNotFound
+		}
+		return nil, err
+	}
+	return found, nil
+}
+
+func (store *OAuthStorage) SaveLoginHandle(handle *models.LoginHandle) error {
+	log.Printf("SaveLoginHandle for user[%s]", handle.UserId)
+	cpy := store.session.Copy()
+	defer cpy.Close()
+	handles := cpy.DB(db_name).C(login_collection)
+
+	if err := handles.Insert(handle); err != nil {
+		log.Printf("SaveLoginHandle error[%s]", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (store *OAuthStorage) TakeLoginHandle(handle string) (*models.LoginHandle, error) {
+	cpy := store.session.Copy()
+	defer cpy.Close()
+	handles := cpy.DB(db_name).C(login_collection)
+
+	//found and removed in the one go so two posts of the same page can't both use it
+	loginHandle := &models.LoginHandle{}
+	if _, err := handles.Find(bson.M{"handle": handle, expiresat: bson.M{"$gte": time.Now()}}).Select(selectFilter).Apply(mgo.Change{Remove: true}, loginHandle); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, osin.ErrNotFound
+		}
+		log.Printf("TakeLoginHandle error[%s]", err.Error())
+		return nil, err
+	}
+	return loginHandle, nil
+}
+
+func (store *OAuthStorage) AddFailure(key string, at, expiresAt time.Time) (*models.Throttle, error) {
+	cpy := store.session.Copy()
+	defer cpy.Close()
+	throttles := cpy.DB(db_name).C(throttle_collection)
+
+	//failures that have expired but mongo hasn't removed yet start again, only while they are still expired so
+	//an instance that has already counted a new failure doesn't have it reset by another
+	if err := throttles.Update(bson.M{"key": key, expiresat: bson.M{"$lt": at}}, bson.M{"$set": bson.M{"failures": 0}}); err != nil && err != mgo.ErrNotFound {
+		log.Printf("AddFailure error[%s] resetting the expired failures", err.Error())
+		return nil, err
+	}
+
+	//counted in the one upsert so the instances don't lose each others failures
+	counted := mgo.Change{
+		Update:    bson.M{"$inc": bson.M{"failures": 1}, "$set": bson.M{"lastfailureat": at, expiresat: expiresAt}},
+		Upsert:    true,
+		ReturnNew: true,
+	}
+	throttle := &models.Throttle{}
+	_, err := throttles.Find(bson.M{"key": key}).Select(selectFilter).Apply(counted, throttle)
+	if mgo.IsDup(err) {
+		//another instance inserted the first failure at the same time, there is now one to count against
+		_, err = throttles.Find(bson.M{"key": key}).Select(selectFilter).Apply(counted, throttle)
+	}
+	if err != nil {
+		log.Printf("AddFailure error[%s]", err.Error())
+		return nil, err
+	}
+	return throttle, nil
+}
+
+func (store *OAuthStorage) LoadThrottle(key string) (*models.Throttle, error) {
+	cpy := store.session.Copy()
+	defer cpy.Close()
+	throttles := cpy.DB(db_name).C(throttle_collection)
+
+	throttle := &models.Throttle{}
+	if err := throttles.Find(bson.M{"key": key, expiresat: bson.M{"$gte": time.Now()}}).Select(selectFilter).One(throttle); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, osin.ErrNotFound
+		}
+		log.Printf("LoadThrottle error[%s]", err.Error())
+		return nil, err
+	}
+	return throttle, nil
+}
+
+func (store *OAuthStorage) RemoveThrottle(key string) error {
+	cpy := store.session.Copy()
+	defer cpy.Close()
+	throttles := cpy.DB(db_name).C(throttle_collection)
+
+	if err := throttles.Remove(bson.M{"key": key}); err != nil && err != mgo.ErrNotFound {
+		log.Printf("RemoveThrottle error[%s]", err.Error())
+		return err
+	}
+	return nil
+}
+
+//give documents saved before expiresat was added an expiry so they can be purged
+func (store *OAuthStorage) setMissingExpiry(db *mgo.Database) {
+
+	missing := bson.M{expiresat: bson.M{"$exists": false}}
+
+	authorizations := db.C(authorize_collection)
+	iter := authorizations.Find(missing).Iter()
+	doc := struct {
+		Id                 bson.ObjectId `bson:"_id"`
+		osin.AuthorizeData `bson:",inline"`
+	}{}
+	for iter.Next(&doc) {
+		authorizations.UpdateId(doc.Id, bson.M{"$set": bson.M{expiresat: authorizeExpiresAt(&doc.AuthorizeData)}})
+	}
+	if err := iter.Close(); err != nil {
+		log.Printf("setMissingExpiry for authorizations error[%s]", err.Error())
+	}
+
+	accesses := db.C(access_collection)
+	iter = accesses.Find(missing).Iter()
+	accDoc := struct {
+		Id              bson.ObjectId `bson:"_id"`
+		osin.AccessData `bson:",inline"`
+	}{}
+	for iter.Next(&accDoc) {
+		accesses.UpdateId(accDoc.Id, bson.M{"$set": bson.M{expiresat: accessExpiresAt(&accDoc.AccessData, store.refreshExpiry)}})
+	}
+	if err := iter.Close(); err != nil {
+		log.Printf("setMissingExpiry for accesses error[%s]", err.Error())
+	}
+}
+
+func (store *OAuthStorage) RemoveExpired() (int, int, error) {
+	cpy := store.session.Copy()
+	defer cpy.Close()
+	db := cpy.DB(db_name)
+
+	store.setMissingExpiry(db)
+
+	//the TTL index will get to these too but this way we know what was removed
+	expired := bson.M{expiresat: bson.M{"$lt": time.Now()}}
+
+	codes, err := db.C(authorize_collection).RemoveAll(expired)
+	if err != nil {
+		log.Printf("RemoveExpired authorizations error[%s]", err.Error())
+		return 0, 0, err
+	}
+	devices, err := db.C(device_collection).RemoveAll(expired)
+	if err != nil {
+		log.Printf("RemoveExpired devices error[%s]", err.Error())
+		return codes.Removed, 0, err
+	}
+	tokens, err := db.C(access_collection).RemoveAll(expired)
+	if err != nil {
+		log.Printf("RemoveExpired accesses error[%s]", err.Error())
+		return codes.Removed + devices.Removed, 0, err
+	}
+	initialTokens, err := db.C(initial_collection).RemoveAll(expired)
+	if err != nil {
+		log.Printf("RemoveExpired initial access tokens error[%s]", err.Error())
+		return codes.Removed + devices.Removed, tokens.Removed, err
+	}
+	log.Printf("RemoveExpired removed [%d] codes, [%d] device codes, [%d] tokens and [%d] initial access tokens", codes.Removed, devices.Removed, tokens.Removed, initialTokens.Removed)
+	return codes.Removed + devices.Removed, tokens.Removed + initialTokens.Removed, nil
+}
+
+//hash the token at the (dotted) field of the document when it hasn't been already
+func setHashed(doc bson.M, field string, hash func(string) string, update bson.M) {
+	var value interface{} = doc
+	for _, key := range strings.Split(field, ".") {
+		embedded, ok := value.(bson.M)
+		if !ok {
+			return
+		}
+		value = embedded[key]
+	}
+	if token, ok := value.(string); ok && token != "" && models.IsTokenHash(token) == false {
+		update[field] = hash(token)
+	}
+}
+
+//HashTokens upgrades documents saved with plaintext codes and tokens so they only hold the hashes
+func (store *OAuthStorage) HashTokens(hash func(string) string) (int, error) {
+	cpy := store.session.Copy()
+	defer cpy.Close()
+	db := cpy.DB(db_name)
+
+	upgraded := 0
+
+	//the fields holding tokens for each collection, including those of the authorize or access that an access came from
+	tokenFields := map[string][]string{
+		authorize_collection: {"code"},
+		access_collection:    {"accesstoken", refreshtoken, "authorizedata.code", "accessdata.accesstoken", "accessdata.refreshtoken"},
+	}
+
+	for collection, fields := range tokenFields {
+		docs := db.C(collection)
+		iter := docs.Find(nil).Iter()
+		doc := bson.M{}
+		for iter.Next(&doc) {
+			update := bson.M{}
+			for _, field := range fields {
+				setHashed(doc, field, hash, update)
+			}
+			if len(update) > 0 {
+				if err := docs.UpdateId(doc["_id"], bson.M{"$set": update}); err != nil {
+					log.Printf("HashTokens error[%s] upgrading %s", err.Error(), collection)
+					iter.Close()
+					return upgraded, err
+				}
+				upgraded++
+			}
+			doc = bson.M{}
+		}
+		if err := iter.Close(); err != nil {
+			log.Printf("HashTokens error[%s] reading %s", err.Error(), collection)
+			return upgraded, err
+		}
+	}
+	log.Printf("HashTokens upgraded [%d] documents with plaintext tokens", upgraded)
+	return upgraded, nil
+}
@@ -2,10 +2,14 @@ package clients
 
 import (
 	//"log"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/RangelReale/osin"
 	"github.com/tidepool-org/go-common/clients/mongo"
+
+	"../models"
 )
 
 var (
@@ -30,8 +34,17 @@ var (
 	testingConfig = &mongo.Config{ConnectionString: "mongodb://localhost/oauth_test"}
 )
 
+//the mongo tests need a running mongo, use `go test -short` to run without one
+func skipWithoutMongo(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping mongo storage test in short mode")
+	}
+}
+
 func TestOAuth_ClientStorage(t *testing.T) {
 
+	skipWithoutMongo(t)
+
 	os := NewOAuthStorage(testingConfig)
 
 	/*
@@ -57,6 +70,8 @@ func TestOAuth_ClientStorage(t *testing.T) {
 
 func TestOAuth_AccessStorage(t *testing.T) {
 
+	skipWithoutMongo(t)
+
 	os := NewOAuthStorage(testingConfig)
 
 	/*
@@ -82,6 +97,8 @@ func TestOAuth_AccessStorage(t *testing.T) {
 
 func TestOAuth_AuthorizeStorage(t *testing.T) {
 
+	skipWithoutMongo(t)
+
 	os := NewOAuthStorage(testingConfig)
 
 	/*
@@ -104,3 +121,480 @@ func TestOAuth_AuthorizeStorage(t *testing.T) {
 		t.Fatalf("got %v expected %v", foundAuthorize, auth_data)
 	}
 }
+
+func TestOAuth_RemoveExpired(t *testing.T) {
+
+	skipWithoutMongo(t)
+
+	os := NewOAuthStorage(testingConfig)
+
+	/*
+	 * INIT THE TEST - we use a clean copy of the collection before we start
+	 */
+	cpy := os.session.Copy()
+	defer cpy.Close()
+
+	//just drop and don't worry about any errors
+	cpy.DB("").DropDatabase()
+
+	/*
+	 * THE TESTS
+	 */
+	longAgo := time.Now().Add(-365 * 24 * time.Hour)
+
+	os.SaveAuthorize(&osin.AuthorizeData{Code: "expired", Client: a_client, ExpiresIn: 60, CreatedAt: longAgo})
+	os.SaveAuthorize(&osin.AuthorizeData{Code: "current", Client: a_client, ExpiresIn: 60, CreatedAt: time.Now()})
+	os.SaveAccess(&osin.AccessData{AccessToken: "expired", RefreshToken: "expired-refresh", Client: a_client, ExpiresIn: 60, CreatedAt: longAgo})
+	os.SaveAccess(&osin.AccessData{AccessToken: "refreshable", RefreshToken: "current-refresh", Client: a_client, ExpiresIn: 60, CreatedAt: time.Now().Add(-time.Hour)})
+
+	if _, err := os.LoadRefresh("expired-refresh"); err == nil {
+		t.Fatal("an expired refresh token should not be loaded")
+	}
+
+	if codes, tokens, err := os.RemoveExpired(); err != nil {
+		t.Fatalf("Error removing expired %s", err.Error())
+	} else if codes != 1 || tokens != 1 {
+		t.Fatalf("got [%d] codes and [%d] tokens removed expected one of each", codes, tokens)
+	}
+
+	if _, err := os.LoadAuthorize("current"); err != nil {
+		t.Fatal("the current code should not have been removed")
+	}
+	if _, err := os.LoadRefresh("current-refresh"); err != nil {
+		t.Fatal("the refreshable access should not have been removed")
+	}
+}
+
+func TestOAuth_HashTokens(t *testing.T) {
+
+	skipWithoutMongo(t)
+
+	os := NewOAuthStorage(testingConfig)
+
+	/*
+	 * INIT THE TEST - we use a clean copy of the collection before we start
+	 */
+	cpy := os.session.Copy()
+	defer cpy.Close()
+
+	//just drop and don't worry about any errors
+	cpy.DB("").DropDatabase()
+
+	/*
+	 * THE TESTS
+	 */
+	hasher, _ := models.NewTokenHasher("testing secret")
+
+	//saved before tokens were hashed
+	os.SaveAuthorize(&osin.AuthorizeData{Code: "plain-code", Client: a_client, ExpiresIn: 60, CreatedAt: time.Now()})
+	os.SaveAccess(&osin.AccessData{AccessToken: "plain-access", RefreshToken: "plain-refresh", Client: a_client, ExpiresIn: 60, CreatedAt: time.Now()})
+
+	if upgraded, err := os.HashTokens(hasher.Hash); err != nil {
+		t.Fatalf("Error hashing tokens %s", err.Error())
+	} else if upgraded != 2 {
+		t.Fatalf("got [%d] upgraded expected 2", upgraded)
+	}
+
+	hs := NewHashedStorage(os, hasher, models.NewBcryptVerifier(4))
+
+	if _, err := hs.LoadAuthorize("plain-code"); err != nil {
+		t.Fatalf("Error trying to get auth after hashing %s", err.Error())
+	}
+	if _, err := hs.LoadAccess("plain-access"); err != nil {
+		t.Fatalf("Error trying to get access after hashing %s", err.Error())
+	}
+	if _, err := hs.LoadRefresh("plain-refresh"); err != nil {
+		t.Fatalf("Error trying to get refresh after hashing %s", err.Error())
+	}
+
+	//running again has nothing left to do
+	if upgraded, _ := os.HashTokens(hasher.Hash); upgraded != 0 {
+		t.Fatalf("got [%d] upgraded expected none", upgraded)
+	}
+}
+
+func TestOAuth_LoadUserAccesses(t *testing.T) {
+
+	skipWithoutMongo(t)
+
+	os := NewOAuthStorage(testingConfig)
+
+	/*
+	 * INIT THE TEST - we use a clean copy of the collection before we start
+	 */
+	cpy := os.session.Copy()
+	defer cpy.Close()
+
+	//just drop and don't worry about any errors
+	cpy.DB("").DropDatabase()
+
+	/*
+	 * THE TESTS
+	 */
+	os.SaveAccess(&osin.AccessData{AccessToken: "user-1", Client: a_client, UserData: &models.TokenUserData{UserId: "user-id"}, CreatedAt: time.Now()})
+	os.SaveAccess(&osin.AccessData{AccessToken: "other", Client: a_client, UserData: &models.TokenUserData{UserId: "other-id"}, CreatedAt: time.Now()})
+
+	if found, err := os.LoadUserAccesses("user-id"); err != nil {
+		t.Fatalf("Error trying to get the users accesses %s", err.Error())
+	} else if len(found) != 1 || found[0].Client.GetId() != a_client.GetId() || models.GetTokenUserData(found[0].UserData).UserId != "user-id" {
+		t.Fatalf("got %v expected the one access for user-id", found)
+	}
+
+	if foundAccess, err := os.LoadAccess("user-1"); err != nil || models.GetTokenUserData(foundAccess.UserData) == nil {
+		t.Fatalf("the access should keep its userdata got %v", foundAccess)
+	}
+}
+
+func TestOAuth_DeviceStorage(t *testing.T) {
+
+	skipWithoutMongo(t)
+
+	os := NewOAuthStorage(testingConfig)
+
+	/*
+	 * INIT THE TEST - we use a clean copy of the collection before we start
+	 */
+	cpy := os.session.Copy()
+	defer cpy.Close()
+
+	//just drop and don't worry about any errors
+	cpy.DB("").DropDatabase()
+
+	/*
+	 * THE TESTS
+	 */
+	os.SaveDevice(&models.DeviceAuthorization{DeviceCode: "device-code", UserCode: "WDJB-MJHT", ClientId: a_client.GetId(), ExpiresIn: 60, CreatedAt: time.Now()})
+
+	foundDevice, err := os.LoadDeviceByUserCode("WDJB-MJHT")
+	if err != nil {
+		t.Fatalf("Error trying to get the device %s", err.Error())
+	}
+
+	foundDevice.UserData = &models.TokenUserData{UserId: "user-id"}
+	if err := os.UpdateDevice(&models.DeviceAuthorization{UserCode: "WDJB-MJHT", Scope: foundDevice.Scope, UserData: foundDevice.UserData}); err != nil {
+		t.Fatalf("Error trying to update the device %s", err.Error())
+	}
+
+	if foundDevice, err := os.LoadDevice("device-code"); err != nil {
+		t.Fatalf("Error trying to get the device %s", err.Error())
+	} else if foundDevice.ClientId != a_client.GetId() || foundDevice.UserData == nil || foundDevice.UserData.UserId != "user-id" {
+		t.Fatalf("got %v expected the authorized device", foundDevice)
+	}
+
+	if taken, err := os.TakeDevice("device-code"); err != nil || taken.UserData == nil || taken.UserData.UserId != "user-id" {
+		t.Fatalf("got %v %v expected the authorized device to be taken", taken, err)
+	}
+	if _, err := os.TakeDevice("device-code"); err != osin.ErrNotFound {
+		t.Fatalf("got %v expected the device to only be taken the once", err)
+	}
+
+	os.SaveDevice(&models.DeviceAuthorization{DeviceCode: "device-code", UserCode: "WDJB-MJHT", ClientId: a_client.GetId(), ExpiresIn: 60, CreatedAt: time.Now()})
+	if _, err := os.TakeDevice("device-code"); err != osin.ErrNotFound {
+		t.Fatalf("got %v expected the device yet to be authorized not to be taken", err)
+	}
+
+	os.RemoveDevice("device-code")
+
+	if _, err := os.LoadDevice("device-code"); err != osin.ErrNotFound {
+		t.Fatal("the device should have been removed")
+	}
+}
+
+func TestOAuth_Audits(t *testing.T) {
+
+	skipWithoutMongo(t)
+
+	os := NewOAuthStorage(testingConfig)
+
+	/*
+	 * INIT THE TEST - we use a clean copy of the collection before we start
+	 */
+	cpy := os.session.Copy()
+	defer cpy.Close()
+
+	//just drop and don't worry about any errors
+	cpy.DB("").DropDatabase()
+
+	/*
+	 * THE TESTS
+	 */
+	os.SaveAudit(&models.AuditRecord{Event: models.AuditAccessDenied, ClientId: a_client.GetId(), Scope: "view", CreatedAt: time.Now()})
+	os.SaveAudit(&models.AuditRecord{Event: models.AuditAccessDenied, ClientId: "other", CreatedAt: time.Now()})
+
+	if found, err := os.LoadAudits(a_client.GetId()); err != nil {
+		t.Fatalf("Error trying to get the audits %s", err.Error())
+	} else if len(found) != 1 || found[0].Event != models.AuditAccessDenied || found[0].Scope != "view" {
+		t.Fatalf("got %v expected only the audits for the client", found)
+	}
+}
+
+func TestOAuth_InitialAccessToken(t *testing.T) {
+
+	skipWithoutMongo(t)
+
+	os := NewOAuthStorage(testingConfig)
+
+	/*
+	 * INIT THE TEST - we use a clean copy of the collection before we start
+	 */
+	cpy := os.session.Copy()
+	defer cpy.Close()
+
+	//just drop and don't worry about any errors
+	cpy.DB("").DropDatabase()
+
+	/*
+	 * THE TESTS
+	 */
+	os.SaveInitialAccessToken(&models.InitialAccessToken{Token: "initial", IssuedBy: "admin-id", CreatedAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)})
+
+	if found, err := os.LoadInitialAccessToken("initial"); err != nil {
+		t.Fatalf("Error trying to get the initial access token %s", err.Error())
+	} else if found.IssuedBy != "admin-id" || found.IsExpired() {
+		t.Fatalf("got %v expected the initial access token", found)
+	}
+
+	if _, err := os.LoadInitialAccessToken("other"); err != osin.ErrNotFound {
+		t.Fatalf("got %v expected the initial access token not to be found", err)
+	}
+}
+
+func TestOAuth_Throttle(t *testing.T) {
+
+	skipWithoutMongo(t)
+
+	os := NewOAuthStorage(testingConfig)
+
+	/*
+	 * INIT THE TEST - we use a clean copy of the collection before we start
+	 */
+	cpy := os.session.Copy()
+	defer cpy.Close()
+
+	//just drop and don't worry about any errors
+	cpy.DB("").DropDatabase()
+
+	/*
+	 * THE TESTS
+	 */
+	now := time.Now()
+
+	os.AddFailure("login:user", now.Add(-time.Minute), now.Add(time.Hour))
+	if throttle, err := os.AddFailure("login:user", now, now.Add(time.Hour)); err != nil {
+		t.Fatalf("Error trying to count the failure %s", err.Error())
+	} else if throttle.Failures != 2 {
+		t.Fatalf("got %v expected the failures to be counted", throttle)
+	}
+	if found, err := os.LoadThrottle("login:user"); err != nil {
+		t.Fatalf("Error trying to get the failures %s", err.Error())
+	} else if found.Failures != 2 || found.IsExpired() {
+		t.Fatalf("got %v expected the failures", found)
+	}
+
+	//the failures are forgotten once they have expired
+	os.AddFailure("login:expired", now.Add(-2*time.Hour), now.Add(-time.Hour))
+	if _, err := os.LoadThrottle("login:expired"); err != osin.ErrNotFound {
+		t.Fatalf("got %v expected the expired failures not to be found", err)
+	}
+	if throttle, _ := os.AddFailure("login:expired", now, now.Add(time.Hour)); throttle == nil || throttle.Failures != 1 {
+		t.Fatalf("got %v expected the count to start again", throttle)
+	}
+
+	//no failure is lost when the instances count them at the same time, whether the key is new or has expired
+	os.AddFailure("address:expired", now.Add(-2*time.Hour), now.Add(-time.Hour))
+	for _, key := range []string{"address:new", "address:expired"} {
+		var counting sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			counting.Add(1)
+			go func() {
+				defer counting.Done()
+				if _, err := os.AddFailure(key, now, now.Add(time.Hour)); err != nil {
+					t.Errorf("Error trying to count the failure %s", err.Error())
+				}
+			}()
+		}
+		counting.Wait()
+		if found, _ := os.LoadThrottle(key); found == nil || found.Failures != 10 {
+			t.Fatalf("got %v expected all the failures counted at the same time for [%s]", found, key)
+		}
+	}
+
+	if err := os.RemoveThrottle("login:user"); err != nil {
+		t.Fatalf("Error trying to remove the failures %s", err.Error())
+	}
+	if _, err := os.LoadThrottle("login:user"); err != osin.ErrNotFound {
+		t.Fatalf("got %v expected the failures to have been removed", err)
+	}
+}
+
+func TestOAuth_Consent(t *testing.T) {
+
+	skipWithoutMongo(t)
+
+	os := NewOAuthStorage(testingConfig)
+
+	/*
+	 * INIT THE TEST - we use a clean copy of the collection before we start
+	 */
+	cpy := os.session.Copy()
+	defer cpy.Close()
+
+	//just drop and don't worry about any errors
+	cpy.DB("").DropDatabase()
+
+	/*
+	 * THE TESTS
+	 */
+	if _, err := os.LoadConsent("user-id", a_client.GetId()); err != osin.ErrNotFound {
+		t.Fatal("there should be no consent until one is saved")
+	}
+
+	os.SaveConsent(&models.Consent{UserId: "user-id", ClientId: a_client.GetId(), Scope: "view", UpdatedAt: time.Now()})
+	os.SaveConsent(&models.Consent{UserId: "user-id", ClientId: a_client.GetId(), Scope: "view,upload", UpdatedAt: time.Now()})
+
+	if found, err := os.LoadConsent("user-id", a_client.GetId()); err != nil {
+		t.Fatalf("Error trying to get the consent %s", err.Error())
+	} else if found.Scope != "view,upload" {
+		t.Fatalf("got %v expected the consent to have been replaced", found)
+	}
+}
+
+func TestOAuth_UserGrants(t *testing.T) {
+
+	skipWithoutMongo(t)
+
+	os := NewOAuthStorage(testingConfig)
+
+	/*
+	 * INIT THE TEST - we use a clean copy of the collection before we start
+	 */
+	cpy := os.session.Copy()
+	defer cpy.Close()
+
+	//just drop and don't worry about any errors
+	cpy.DB("").DropDatabase()
+
+	/*
+	 * THE TESTS
+	 */
+	other := &osin.DefaultClient{Id: "other"}
+	user := &models.TokenUserData{UserId: "user-id"}
+
+	os.SaveAuthorize(&osin.AuthorizeData{Code: "code", Client: a_client, UserData: user, ExpiresIn: 60, CreatedAt: time.Now()})
+	os.SaveAccess(&osin.AccessData{AccessToken: "access", Client: a_client, UserData: user, ExpiresIn: 60, CreatedAt: time.Now()})
+	os.SaveAccess(&osin.AccessData{AccessToken: "other-access", Client: other, UserData: user, ExpiresIn: 60, CreatedAt: time.Now()})
+	os.SaveConsent(&models.Consent{UserId: "user-id", ClientId: a_client.Id, Scope: "view", UpdatedAt: time.Now()})
+	os.SaveConsent(&models.Consent{UserId: "user-id", ClientId: other.Id, Scope: "view", UpdatedAt: time.Now()})
+
+	usedAt := time.Now()
+	os.SetConsentUsed("user-id", a_client.Id, usedAt, usedAt)
+	if found, _ := os.LoadConsent("user-id", a_client.Id); found.LastUsedAt.IsZero() {
+		t.Fatal("the consent should have been used")
+	}
+	os.SetConsentUsed("user-id", a_client.Id, usedAt.Add(time.Minute), usedAt.Add(-time.Minute))
+	if found, _ := os.LoadConsent("user-id", a_client.Id); found.LastUsedAt.After(usedAt) {
+		t.Fatal("a use so soon after the last should not have been written")
+	}
+
+	if err := os.RemoveUserGrants("user-id", a_client.Id); err != nil {
+		t.Fatalf("Error trying to remove the grants %s", err.Error())
+	}
+	os.RemoveConsent("user-id", a_client.Id)
+
+	if _, err := os.LoadAuthorize("code"); err == nil {
+		t.Fatal("the code should have been removed")
+	}
+	if found, _ := os.LoadUserAccesses("user-id"); len(found) != 1 || found[0].Client.GetId() != other.Id {
+		t.Fatalf("got %v expected only the other client's token", found)
+	}
+	if found, _ := os.LoadUserConsents("user-id"); len(found) != 1 || found[0].ClientId != other.Id {
+		t.Fatalf("got %v expected only the other client's consent", found)
+	}
+}
+
+func TestOAuth_ScopeGrants(t *testing.T) {
+
+	skipWithoutMongo(t)
+
+	os := NewOAuthStorage(testingConfig)
+
+	/*
+	 * INIT THE TEST - we use a clean copy of the collection before we start
+	 */
+	cpy := os.session.Copy()
+	defer cpy.Close()
+
+	//just drop and don't worry about any errors
+	cpy.DB("").DropDatabase()
+
+	/*
+	 * THE TESTS
+	 */
+	other := &osin.DefaultClient{Id: "other"}
+	user := &models.TokenUserData{UserId: "user-id"}
+
+	os.SaveAuthorize(&osin.AuthorizeData{Code: "code", Client: a_client, UserData: user, Scope: "view upload", ExpiresIn: 60, CreatedAt: time.Now()})
+	os.SaveAccess(&osin.AccessData{AccessToken: "access", Client: a_client, UserData: user, Scope: "view,upload", ExpiresIn: 60, CreatedAt: time.Now()})
+	os.SaveAccess(&osin.AccessData{AccessToken: "view-access", Client: a_client, UserData: user, Scope: "view", ExpiresIn: 60, CreatedAt: time.Now()})
+	os.SaveAccess(&osin.AccessData{AccessToken: "other-access", Client: other, UserData: user, Scope: "upload", ExpiresIn: 60, CreatedAt: time.Now()})
+
+	if err := os.RemoveScopeGrants(a_client.Id, []string{"upload"}); err != nil {
+		t.Fatalf("Error trying to remove the grants %s", err.Error())
+	}
+
+	if _, err := os.LoadAuthorize("code"); err == nil {
+		t.Fatal("the code with the scope should have been removed")
+	}
+	if found, _ := os.LoadUserAccesses("user-id"); len(found) != 2 {
+		t.Fatalf("got %v expected the token without the scope and the other client's token", found)
+	}
+}
+
+func TestOAuth_DeveloperClients(t *testing.T) {
+
+	skipWithoutMongo(t)
+
+	os := NewOAuthStorage(testingConfig)
+
+	/*
+	 * INIT THE TEST - we use a clean copy of the collection before we start
+	 */
+	cpy := os.session.Copy()
+	defer cpy.Close()
+
+	//just drop and don't worry about any errors
+	cpy.DB("").DropDatabase()
+
+	/*
+	 * THE TESTS
+	 */
+	developers := &osin.DefaultClient{Id: "developers-app", UserData: map[string]interface{}{UserDataDeveloperId: "developer-id"}}
+
+	os.SetClient(a_client.Id, a_client)
+	os.SetClient(developers.Id, developers)
+	os.SaveAccess(&osin.AccessData{AccessToken: "access", Client: developers, UserData: &models.TokenUserData{UserId: "user-id"}, ExpiresIn: 60, CreatedAt: time.Now()})
+	os.SaveConsent(&models.Consent{UserId: "user-id", ClientId: developers.Id, Scope: "view", UpdatedAt: time.Now()})
+
+	if found, err := os.LoadDeveloperClients("developer-id"); err != nil {
+		t.Fatalf("Error trying to get the clients %s", err.Error())
+	} else if len(found) != 1 || found[0].GetId() != developers.Id {
+		t.Fatalf("got %v expected only the developer's client", found)
+	}
+	if found, _ := os.LoadClientConsents(developers.Id); len(found) != 1 {
+		t.Fatalf("got %v expected the consent for the client", found)
+	}
+
+	if err := os.RemoveClient(developers.Id); err != nil {
+		t.Fatalf("Error trying to remove the client %s", err.Error())
+	}
+
+	if _, err := os.GetClient(developers.Id); err != osin.ErrNotFound {
+		t.Fatal("the client should have been removed")
+	}
+	if _, err := os.LoadAccess("access"); err == nil {
+		t.Fatal("the client's token should have been removed")
+	}
+	if _, err := os.LoadConsent("user-id", developers.Id); err != osin.ErrNotFound {
+		t.Fatal("the consent for the client should have been removed")
+	}
+}
@@ -0,0 +1,46 @@
+package clients
+
+import (
+	"log"
+	"time"
+)
+
+//Reaper purges expired codes and tokens from the storage in the background
+type Reaper struct {
+	storage  Storage
+	interval time.Duration
+	done     chan bool
+}
+
+func NewReaper(storage Storage, interval time.Duration) *Reaper {
+	return &Reaper{storage: storage, interval: interval, done: make(chan bool)}
+}
+
+//Start purges what has gone stale while we were down then keeps purging every interval
+func (r *Reaper) Start() {
+
+	if codes, tokens, err := r.storage.RemoveExpired(); err != nil {
+		log.Printf("Reaper: error[%s] purging stale records at startup", err.Error())
+	} else {
+		log.Printf("Reaper: purged [%d] stale codes and [%d] stale tokens at startup", codes, tokens)
+	}
+
+	go func() {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, _, err := r.storage.RemoveExpired(); err != nil {
+					log.Printf("Reaper: error[%s] purging expired records", err.Error())
+				}
+			case <-r.done:
+				return
+			}
+		}
+	}()
+}
+
+func (r *Reaper) Close() {
+	close(r.done)
+}
@@ -0,0 +1,23 @@
+package clients
+
+import (
+	"testing"
+	"time"
+
+	"github.com/RangelReale/osin"
+)
+
+func TestReaper_StartPurges(t *testing.T) {
+
+	ms := NewMemoryStorage()
+
+	ms.SaveAuthorize(&osin.AuthorizeData{Code: "stale", Client: a_client, ExpiresIn: 60, CreatedAt: time.Now().Add(-time.Hour)})
+
+	reaper := NewReaper(ms, time.Hour)
+	reaper.Start()
+	defer reaper.Close()
+
+	if _, err := ms.LoadAuthorize("stale"); err == nil {
+		t.Fatal("the stale code should have been purged at startup")
+	}
+}
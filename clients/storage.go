@@ -0,0 +1,179 @@
+package clients
+
+import (
+	"log"
+	"time"
+
+	"github.com/RangelReale/osin"
+	"github.com/tidepool-org/go-common/clients/mongo"
+
+	"../models"
+)
+
+type (
+	//Storage is everything osin needs from a backend plus the extras coastline relies on
+	Storage interface {
+		osin.Storage
+		SetClient(id string, client osin.Client) error
+		//LoadDeveloperClients finds the clients that belong to the developer, as given in their user data
+		LoadDeveloperClients(developerId string) ([]osin.Client, error)
+		//RemoveClient removes the client along with all its codes, tokens and consents
+		RemoveClient(id string) error
+		//RemoveExpired purges the codes, including device codes, and tokens that can no longer be used, returning how many of each were removed
+		RemoveExpired() (codes int, tokens int, err error)
+		//RemoveRefreshAccess removes the access the refresh token was issued with, along with the refresh token
+		RemoveRefreshAccess(token string) error
+		//LoadUserAccesses finds the stored accesses the user authorized, their tokens are only as the storage keeps them
+		LoadUserAccesses(userId string) ([]*osin.AccessData, error)
+		//RemoveUserGrants removes the codes and tokens the user authorized for the client
+		RemoveUserGrants(userId, clientId string) error
+		//RemoveScopeGrants removes the codes and tokens of the client that carry any of the scopes
+		RemoveScopeGrants(clientId string, scopes []string) error
+		//the pending device authorizations, see https://tools.ietf.org/html/rfc8628
+		SaveDevice(data *models.DeviceAuthorization) error
+		LoadDevice(deviceCode string) (*models.DeviceAuthorization, error)
+		LoadDeviceByUserCode(userCode string) (*models.DeviceAuthorization, error)
+		//UpdateDevice saves what has happened to a device found by whichever of its codes it has, the codes stay as they are
+		UpdateDevice(data *models.DeviceAuthorization) error
+		RemoveDevice(deviceCode string) error
+		//TakeDevice removes the authorized device so its device code can only be exchanged the once,
+		//not found when it is yet to be authorized, has expired or was already taken
+		TakeDevice(deviceCode string) (*models.DeviceAuthorization, error)
+		//the scopes each user has given each client, not found when they have given none
+		SaveConsent(consent *models.Consent) error
+		LoadConsent(userId, clientId string) (*models.Consent, error)
+		LoadUserConsents(userId string) ([]*models.Consent, error)
+		LoadClientConsents(clientId string) ([]*models.Consent, error)
+		RemoveConsent(userId, clientId string) error
+		//SetConsentUsed records when a token the user gave the client was last used, it isn't written
+		//again when the use already recorded isn't before staleBefore so checking a token doesn't always write
+		SetConsentUsed(userId, clientId string, usedAt, staleBefore time.Time) error
+		//the audit trail of each client, they are kept after the client's codes and tokens are purged
+		SaveAudit(record *models.AuditRecord) error
+		LoadAudits(clientId string) ([]*models.AuditRecord, error)
+		//the initial access tokens clients are registered with, see https://tools.ietf.org/html/rfc7591#section-3
+		SaveInitialAccessToken(token *models.InitialAccessToken) error
+		LoadInitialAccessToken(token string) (*models.InitialAccessToken, error)
+		//the handles of the users logged in on our pages, taking one removes it so it can only be used the once
+		SaveLoginHandle(handle *models.LoginHandle) error
+		TakeLoginHandle(handle string) (*models.LoginHandle, error)
+		//AddFailure counts a failure of what is throttled by the key, starting again once the failures have expired.
+		//They are counted across all our instances so a guesser can't spread their guesses over them
+		AddFailure(key string, at, expiresAt time.Time) (*models.Throttle, error)
+		//LoadThrottle is not found when there have been no failures since they last expired or were removed
+		LoadThrottle(key string) (*models.Throttle, error)
+		RemoveThrottle(key string) error
+	}
+	//StorageConfig selects the backend used for oauth data and how long it is kept
+	StorageConfig struct {
+		Type              string `json:"type"`
+		RefreshExpireDays int    `json:"refreshExpireDays"`
+		PurgeInterval     string `json:"purgeInterval"`
+		TokenSecret       string `json:"tokenSecret"`
+		SecretCost        int    `json:"secretCost"`
+	}
+)
+
+const (
+	//UserDataDeveloperId is the client user data holding the id of the developer the client belongs to
+	UserDataDeveloperId = "DeveloperId"
+	//UserDataPreviousSecret is the secret the client had before it was rotated, it can be used until UserDataPreviousSecretExpiresAt
+	UserDataPreviousSecret          = "PreviousSecret"
+	UserDataPreviousSecretExpiresAt = "PreviousSecretExpiresAt"
+	//UserDataRegistrationToken is the registration access token of a client registered with the api, it is only saved hashed
+	UserDataRegistrationToken = "RegistrationToken"
+
+	//storage types
+	mongo_storage  = "mongo"
+	memory_storage = "memory"
+
+	default_refresh_expire_days = 30
+	default_purge_interval      = time.Hour
+	oneDay                      = 24 * time.Hour
+)
+
+//how long a refresh token can be used for after it was issued
+func (c *StorageConfig) GetRefreshExpiry() time.Duration {
+	if c.RefreshExpireDays > 0 {
+		return time.Duration(c.RefreshExpireDays) * oneDay
+	}
+	return default_refresh_expire_days * oneDay
+}
+
+//how often expired codes and tokens are purged
+func (c *StorageConfig) GetPurgeInterval() time.Duration {
+	if interval, err := time.ParseDuration(c.PurgeInterval); err == nil && interval > 0 {
+		return interval
+	}
+	return default_purge_interval
+}
+
+//the client belongs to the developer
+func isDevelopers(client osin.Client, developerId string) bool {
+	if ud, ok := client.GetUserData().(map[string]interface{}); ok {
+		return ud[UserDataDeveloperId] == developerId
+	}
+	return false
+}
+
+//the secret the client had before it was rotated, empty once it can no longer be used
+func previousSecret(client osin.Client) string {
+	if ud, ok := client.GetUserData().(map[string]interface{}); ok {
+		previous, _ := ud[UserDataPreviousSecret].(string)
+		expiresAt, _ := ud[UserDataPreviousSecretExpiresAt].(time.Time)
+		if expiresAt.After(time.Now()) {
+			return previous
+		}
+	}
+	return ""
+}
+
+//when the authorize code can no longer be used
+func authorizeExpiresAt(data *osin.AuthorizeData) time.Time {
+	return data.CreatedAt.Add(time.Duration(data.ExpiresIn) * time.Second)
+}
+
+//when the refresh token can no longer be used
+func refreshExpiresAt(data *osin.AccessData, refreshExpiry time.Duration) time.Time {
+	return data.CreatedAt.Add(refreshExpiry)
+}
+
+//when the access can be removed, it is kept for as long as either of its tokens can be used
+func accessExpiresAt(data *osin.AccessData, refreshExpiry time.Duration) time.Time {
+	expiresAt := data.CreatedAt.Add(time.Duration(data.ExpiresIn) * time.Second)
+	if data.RefreshToken != "" && refreshExpiresAt(data, refreshExpiry).After(expiresAt) {
+		return refreshExpiresAt(data, refreshExpiry)
+	}
+	return expiresAt
+}
+
+//NewStorage builds the storage backend selected in the config, mongo is used when no type is given.
+//Codes and tokens are only ever saved as hashes keyed with the tokenSecret, client secrets are saved bcrypt hashed.
+func NewStorage(config *StorageConfig, mongoConfig *mongo.Config) Storage {
+
+	hasher, err := models.NewTokenHasher(config.TokenSecret)
+	if err != nil {
+		log.Fatalf("NewStorage: tokenSecret error[%s]", err.Error())
+	}
+	verifier := models.NewBcryptVerifier(config.SecretCost)
+
+	switch config.Type {
+	case "", mongo_storage:
+		log.Print("NewStorage: using mongo storage")
+		storage := NewOAuthStorage(mongoConfig)
+		storage.refreshExpiry = config.GetRefreshExpiry()
+		if upgraded, err := storage.HashTokens(hasher.Hash); err != nil {
+			log.Fatalf("NewStorage: error[%s] hashing plaintext tokens", err.Error())
+		} else if upgraded > 0 {
+			log.Printf("NewStorage: hashed the plaintext tokens of [%d] documents", upgraded)
+		}
+		return NewHashedStorage(storage, hasher, verifier)
+	case memory_storage:
+		log.Print("NewStorage: using in-memory storage, nothing will survive a restart")
+		storage := NewMemoryStorage()
+		storage.refreshExpiry = config.GetRefreshExpiry()
+		return NewHashedStorage(storage, hasher, verifier)
+	}
+	log.Fatalf("NewStorage: unknown storage type [%s]", config.Type)
+	return nil
+}
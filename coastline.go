@@ -25,6 +25,7 @@ type (
 		clients.Config
 		Service disc.ServiceListing `json:"service"`
 		Mongo   mongo.Config        `json:"mongo"`
+		Storage sc.StorageConfig    `json:"storage"`
 		Api     api.OAuthConfig     `json:"coastline"`
 	}
 )
@@ -79,7 +80,13 @@ func main() {
 	/*
 	 * Oauth2 setup
 	 */
-	oauthApi := api.InitOAuthApi(config.Api, sc.NewOAuthStorage(&config.Mongo), user, perms)
+	storage := sc.NewStorage(&config.Storage, &config.Mongo)
+
+	reaper := sc.NewReaper(storage, config.Storage.GetPurgeInterval())
+	reaper.Start()
+	defer reaper.Close()
+
+	oauthApi := api.InitOAuthApi(config.Api, storage, user, perms)
 	oauthApi.SetHandlers("", rtr)
 
 	/*
@@ -0,0 +1,26 @@
+package models
+
+import "time"
+
+//AuditRecord is something that happened to a client that we keep a record of
+type AuditRecord struct {
+	Event    string `bson:"event"`
+	ClientId string `bson:"clientid"`
+	//the tidepool user involved when we know who they are
+	UserId     string    `bson:"userid,omitempty"`
+	Scope      string    `bson:"scope,omitempty"`
+	RemoteAddr string    `bson:"remoteaddr"`
+	CreatedAt  time.Time `bson:"createdat"`
+}
+
+const (
+	//audited events
+	AuditAccessDenied     = "access_denied"
+	AuditAppDisconnected  = "app_disconnected"
+	AuditSecretRotated    = "secret_rotated"
+	AuditClientRegistered = "client_registered"
+	AuditClientUpdated    = "client_updated"
+	AuditClientDeleted    = "client_deleted"
+	//the secret from before the rotation was revoked before it expired
+	AuditPreviousSecretRevoked = "previous_secret_revoked"
+)
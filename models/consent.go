@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+//Consent is the scopes a user has given a client, they are only asked again for those they haven't
+type Consent struct {
+	UserId    string    `bson:"userid"`
+	ClientId  string    `bson:"clientid"`
+	Scope     string    `bson:"scope"`
+	UpdatedAt time.Time `bson:"updatedat"`
+	//when a token the user gave the client was last used
+	LastUsedAt time.Time `bson:"lastusedat,omitempty"`
+}
@@ -0,0 +1,180 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"math/big"
+	"strings"
+)
+
+type (
+	//CredentialConfig is how much randomness goes into each credential and how it is written out
+	CredentialConfig struct {
+		EntropyBytes int    `json:"entropyBytes"`
+		Encoding     string `json:"encoding"`
+	}
+	//CredentialGenerator makes random credentials that can be recognized as Tidepool ones.
+	//Each is the prefix, the encoded random bytes and a checksum of both so a malformed one can be spotted without looking it up.
+	CredentialGenerator struct {
+		prefix   string
+		entropy  int
+		encoding *credentialEncoding
+	}
+	credentialEncoding struct {
+		encode func(b []byte) string
+		valid  func(s string) bool
+		//the encoded length of n bytes
+		encodedLen func(n int) int
+	}
+)
+
+const (
+	//the prefixes that mark what the credential is
+	ClientSecretPrefix  = "tpcs_"
+	AccessTokenPrefix   = "tpat_"
+	RefreshTokenPrefix  = "tprt_"
+	AuthorizeCodePrefix = "tpac_"
+	DeviceCodePrefix    = "tpdc_"
+	//the initial access token a client is registered with and the registration access token it is then managed with
+	InitialAccessTokenPrefix = "tpit_"
+	RegistrationTokenPrefix  = "tprg_"
+	//what a page is posted back with by the user who logged in on it
+	LoginHandlePrefix = "tplh_"
+
+	//encodings
+	Base62Encoding = "base62"
+	HexEncoding    = "hex"
+	Base64Encoding = "base64"
+
+	default_entropy_bytes = 32
+	min_entropy_bytes     = 16
+	checksum_bytes        = 4
+
+	base62Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+var (
+	credentialPrefixes = []string{ClientSecretPrefix, AccessTokenPrefix, RefreshTokenPrefix, AuthorizeCodePrefix, DeviceCodePrefix, InitialAccessTokenPrefix, RegistrationTokenPrefix, LoginHandlePrefix}
+
+	credentialEncodings = map[string]*credentialEncoding{
+		//letters and digits only so the whole credential is selected by a double click
+		Base62Encoding: {
+			encode:     encodeBase62,
+			encodedLen: base62EncodedLen,
+			valid: func(s string) bool {
+				return strings.Trim(s, base62Alphabet) == ""
+			},
+		},
+		HexEncoding: {
+			encode:     hex.EncodeToString,
+			encodedLen: hex.EncodedLen,
+			valid: func(s string) bool {
+				_, err := hex.DecodeString(s)
+				return err == nil
+			},
+		},
+		Base64Encoding: {
+			encode:     base64.RawURLEncoding.EncodeToString,
+			encodedLen: base64.RawURLEncoding.EncodedLen,
+			valid: func(s string) bool {
+				_, err := base64.RawURLEncoding.DecodeString(s)
+				return err == nil
+			},
+		},
+	}
+)
+
+//the base62 length of n bytes, the same for any value of those bytes
+func base62EncodedLen(n int) int {
+	return int(math.Ceil(float64(n*8) / math.Log2(float64(len(base62Alphabet)))))
+}
+
+//encode as base62 padded with leading zeros so the length doesn't depend on the value
+func encodeBase62(b []byte) string {
+	width := base62EncodedLen(len(b))
+	n := new(big.Int).SetBytes(b)
+	base := big.NewInt(int64(len(base62Alphabet)))
+	mod := new(big.Int)
+
+	encoded := make([]byte, width)
+	for i := width - 1; i >= 0; i-- {
+		n.DivMod(n, base, mod)
+		encoded[i] = base62Alphabet[mod.Int64()]
+	}
+	return string(encoded)
+}
+
+//NewCredentialGenerator uses 32 bytes of entropy written as base62 unless the config says otherwise
+func NewCredentialGenerator(prefix string, config CredentialConfig) (*CredentialGenerator, error) {
+
+	entropy := config.EntropyBytes
+	if entropy == 0 {
+		entropy = default_entropy_bytes
+	}
+	if entropy < min_entropy_bytes {
+		return nil, fmt.Errorf("we need at least %d bytes of entropy for a credential", min_entropy_bytes)
+	}
+
+	encodingName := config.Encoding
+	if encodingName == "" {
+		encodingName = Base62Encoding
+	}
+	encoding, ok := credentialEncodings[encodingName]
+	if !ok {
+		return nil, fmt.Errorf("there is no credential encoding called %s", encodingName)
+	}
+
+	return &CredentialGenerator{prefix: prefix, entropy: entropy, encoding: encoding}, nil
+}
+
+func (g *CredentialGenerator) checksum(body string) string {
+	sum := make([]byte, checksum_bytes)
+	binary.BigEndian.PutUint32(sum, crc32.ChecksumIEEE([]byte(body)))
+	return g.encoding.encode(sum)
+}
+
+//Generate a new random credential
+func (g *CredentialGenerator) Generate() (string, error) {
+	random := make([]byte, g.entropy)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	body := g.prefix + g.encoding.encode(random)
+	return body + g.checksum(body), nil
+}
+
+//Valid is true for a credential this generator could have made, including those made before the entropy was changed
+func (g *CredentialGenerator) Valid(credential string) bool {
+	minRandomLen := g.encoding.encodedLen(min_entropy_bytes)
+	checksumLen := g.encoding.encodedLen(checksum_bytes)
+
+	if len(credential) < len(g.prefix)+minRandomLen+checksumLen || strings.HasPrefix(credential, g.prefix) == false {
+		return false
+	}
+	body := credential[:len(credential)-checksumLen]
+	if g.encoding.valid(body[len(g.prefix):]) == false {
+		return false
+	}
+	return g.checksum(body) == credential[len(body):]
+}
+
+//Malformed is true when the credential looks to be one of ours but isn't one this generator could have made.
+//Credentials without any of our prefixes were issued before we had them so are left to be looked up.
+func (g *CredentialGenerator) Malformed(credential string) bool {
+	return HasCredentialPrefix(credential) && g.Valid(credential) == false
+}
+
+//HasCredentialPrefix is true when the credential is marked as a Tidepool one
+func HasCredentialPrefix(credential string) bool {
+	for _, prefix := range credentialPrefixes {
+		if strings.HasPrefix(credential, prefix) {
+			return true
+		}
+	}
+	return false
+}
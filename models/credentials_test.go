@@ -0,0 +1,79 @@
+package models
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewCredentialGenerator_NotEnoughEntropy(t *testing.T) {
+
+	if _, err := NewCredentialGenerator(AccessTokenPrefix, CredentialConfig{EntropyBytes: 8}); err == nil {
+		t.Fatal("there should be an error when there isn't enough entropy")
+	}
+
+}
+
+func TestNewCredentialGenerator_UnknownEncoding(t *testing.T) {
+
+	if _, err := NewCredentialGenerator(AccessTokenPrefix, CredentialConfig{Encoding: "rot13"}); err == nil {
+		t.Fatal("there should be an error when the encoding is unknown")
+	}
+
+}
+
+func TestCredentialGenerator(t *testing.T) {
+
+	for _, encoding := range []string{"", Base62Encoding, HexEncoding, Base64Encoding} {
+
+		gen, err := NewCredentialGenerator(ClientSecretPrefix, CredentialConfig{Encoding: encoding})
+		if err != nil {
+			t.Fatalf("there should be no error for the %s encoding %s", encoding, err.Error())
+		}
+
+		credential, _ := gen.Generate()
+		other, _ := gen.Generate()
+
+		if strings.HasPrefix(credential, ClientSecretPrefix) == false {
+			t.Fatalf("%s should have the prefix %s", credential, ClientSecretPrefix)
+		}
+
+		if credential == other {
+			t.Fatal("the two credentials should NOT match")
+		}
+
+		if gen.Valid(credential) == false || gen.Malformed(credential) {
+			t.Fatalf("%s should be valid", credential)
+		}
+
+		//change the last character of the random part
+		tampered := []byte(credential)
+		at := len(tampered) - gen.encoding.encodedLen(checksum_bytes) - 1
+		if tampered[at] == 'a' {
+			tampered[at] = 'b'
+		} else {
+			tampered[at] = 'a'
+		}
+
+		if gen.Valid(string(tampered)) || gen.Malformed(string(tampered)) == false {
+			t.Fatalf("%s should NOT be valid as it no longer matches the checksum", tampered)
+		}
+	}
+
+}
+
+func TestCredentialGenerator_OtherCredentials(t *testing.T) {
+
+	secretGen, _ := NewCredentialGenerator(ClientSecretPrefix, CredentialConfig{})
+	tokenGen, _ := NewCredentialGenerator(AccessTokenPrefix, CredentialConfig{})
+
+	secret, _ := secretGen.Generate()
+
+	if tokenGen.Malformed(secret) == false {
+		t.Fatal("a client secret should NOT be accepted as an access token")
+	}
+
+	if tokenGen.Malformed("T9cE5asGnuyYCCqIZFoWjFHvNbvVqHjl") {
+		t.Fatal("a token without one of our prefixes was issued before them so isn't malformed")
+	}
+
+}
@@ -0,0 +1,70 @@
+package models
+
+import (
+	"crypto/rand"
+	"math/big"
+	"strings"
+	"time"
+)
+
+//DeviceAuthorization is a device waiting for the user to authorize it, see https://tools.ietf.org/html/rfc8628
+type DeviceAuthorization struct {
+	//what the device polls for its tokens with
+	DeviceCode string `bson:"devicecode"`
+	//what the user enters on the verification page
+	UserCode  string    `bson:"usercode"`
+	ClientId  string    `bson:"clientid"`
+	Scope     string    `bson:"scope"`
+	CreatedAt time.Time `bson:"createdat"`
+	ExpiresIn int32     `bson:"expiresin"`
+	//seconds the device must wait between polls, polling faster slows it down
+	Interval     int32     `bson:"interval"`
+	LastPolledAt time.Time `bson:"lastpolledat"`
+	//who authorized the device once they have
+	UserData *TokenUserData `bson:"userdata,omitempty"`
+	//the user said no so the device is told it was denied
+	Denied bool `bson:"denied,omitempty"`
+}
+
+const (
+	//no vowels so no words can be made and nothing that is easily mistaken for something else
+	user_code_alphabet = "BCDFGHJKLMNPQRSTVWXZ"
+	user_code_length   = 8
+)
+
+//ExpireAt is when the device can no longer be authorized or poll
+func (d *DeviceAuthorization) ExpireAt() time.Time {
+	return d.CreatedAt.Add(time.Duration(d.ExpiresIn) * time.Second)
+}
+
+func (d *DeviceAuthorization) IsExpired() bool {
+	return d.ExpireAt().Before(time.Now())
+}
+
+//GenerateUserCode makes a random code that is easy to read and type e.g. WDJB-MJHT
+func GenerateUserCode() (string, error) {
+	code := make([]byte, user_code_length)
+	max := big.NewInt(int64(len(user_code_alphabet)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = user_code_alphabet[n.Int64()]
+	}
+	return string(code[:user_code_length/2]) + "-" + string(code[user_code_length/2:]), nil
+}
+
+//NormalizeUserCode gives the user code as we issued it however the user typed it e.g. wdjbmjht
+func NormalizeUserCode(userCode string) string {
+	code := make([]rune, 0, user_code_length)
+	for _, r := range strings.ToUpper(userCode) {
+		if strings.ContainsRune(user_code_alphabet, r) {
+			code = append(code, r)
+		}
+	}
+	if len(code) != user_code_length {
+		return string(code)
+	}
+	return string(code[:user_code_length/2]) + "-" + string(code[user_code_length/2:])
+}
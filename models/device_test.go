@@ -0,0 +1,35 @@
+package models
+
+import (
+	"testing"
+)
+
+func TestGenerateUserCode(t *testing.T) {
+
+	code, err := GenerateUserCode()
+
+	if err != nil {
+		t.Fatalf("there should be no error generating the code %s", err.Error())
+	}
+
+	if len(code) != user_code_length+1 || code[user_code_length/2] != '-' {
+		t.Fatalf("%s should be two groups of four", code)
+	}
+
+	if other, _ := GenerateUserCode(); other == code {
+		t.Fatal("the two codes should NOT match")
+	}
+
+}
+
+func TestNormalizeUserCode(t *testing.T) {
+
+	if NormalizeUserCode("wdjb mjht") != "WDJB-MJHT" {
+		t.Fatalf("got %s expected WDJB-MJHT", NormalizeUserCode("wdjb mjht"))
+	}
+
+	if NormalizeUserCode("WDJB-MJHT") != "WDJB-MJHT" {
+		t.Fatal("a code as issued should be unchanged")
+	}
+
+}
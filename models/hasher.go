@@ -1,23 +1,36 @@
 package models
 
 import (
-	"crypto/sha1"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
+	"regexp"
 )
 
-func GenerateHash(args ...string) (string, error) {
-
-	if len(args) < 3 {
-		return "", errors.New("we need at least three strings to create the hash")
-	}
+//TokenHasher gives keyed hashes of tokens so they can be stored and looked up without keeping the token itself
+type TokenHasher struct {
+	secret []byte
+}
 
-	hash := sha1.New()
+//what a hash from the TokenHasher looks like
+var tokenHashPattern = regexp.MustCompile("^[0-9a-f]{64}$")
 
-	for i := range args {
-		hash.Write([]byte(args[i]))
+func NewTokenHasher(secret string) (*TokenHasher, error) {
+	if secret == "" {
+		return nil, errors.New("we need a secret to hash the tokens with")
 	}
-	pwHash := hex.EncodeToString(hash.Sum(nil))
+	return &TokenHasher{secret: []byte(secret)}, nil
+}
+
+//Hash returns the hex encoded HMAC-SHA256 of the token
+func (h *TokenHasher) Hash(token string) string {
+	mac := hmac.New(sha256.New, h.secret)
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
 
-	return pwHash, nil
+//IsTokenHash is true when the value already looks like a hash from a TokenHasher
+func IsTokenHash(value string) bool {
+	return tokenHashPattern.MatchString(value)
 }
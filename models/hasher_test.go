@@ -4,30 +4,35 @@ import (
 	"testing"
 )
 
-func TestGenerateHash_NotEnoughArgs(t *testing.T) {
+func TestNewTokenHasher_NoSecret(t *testing.T) {
 
-	if _, err := GenerateHash("stuff", "th3P0rd"); err == nil {
-		t.Fatal("there should be an error not enough data is given")
+	if _, err := NewTokenHasher(""); err == nil {
+		t.Fatal("there should be an error when no secret is given")
 	}
 
 }
 
-func TestGenerateHash(t *testing.T) {
+func TestTokenHasher(t *testing.T) {
 
-	if pwHashed, err := GenerateHash("1234", "th3P0rd", "some salt", "6789"); err != nil {
-		t.Fatal("there should be an error when no pw is given")
-	} else {
-		reHashed, _ := GenerateHash("1234", "th3P0rd", "some salt", "6789")
+	hasher, _ := NewTokenHasher("some secret")
+	otherHasher, _ := NewTokenHasher("other secret")
 
-		if pwHashed != reHashed {
-			t.Fatal("the two hash's should match")
-		}
+	hashed := hasher.Hash("a-token")
 
-		otherHash, _ := GenerateHash("1235", "th3P0rd", "some salt", "6789")
+	if hashed != hasher.Hash("a-token") {
+		t.Fatal("the two hash's should match")
+	}
+
+	if hashed == otherHasher.Hash("a-token") {
+		t.Fatal("the two hash's should NOT match as they have different secrets")
+	}
+
+	if IsTokenHash(hashed) == false {
+		t.Fatalf("%s should be seen as a token hash", hashed)
+	}
 
-		if pwHashed == otherHash {
-			t.Fatal("the two hash's should NOT match as they have different userid's")
-		}
+	if IsTokenHash("a-token") {
+		t.Fatal("a-token should NOT be seen as a token hash")
 	}
 
 }
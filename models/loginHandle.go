@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+//LoginHandle stands in for a user who has logged in on one of our pages so the page they are then shown can be posted back without them logging in again.
+//It is only good for the purpose it was issued for, e.g. the authorize request they are consenting to, and only the once.
+type LoginHandle struct {
+	Handle    string    `bson:"handle"`
+	UserId    string    `bson:"userid"`
+	Purpose   string    `bson:"purpose"`
+	CreatedAt time.Time `bson:"createdat"`
+	ExpiresAt time.Time `bson:"expiresat"`
+}
+
+func (h *LoginHandle) IsExpired() bool {
+	return h.ExpiresAt.Before(time.Now())
+}
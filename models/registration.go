@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+//InitialAccessToken lets whoever has it register clients, admins issue them, see https://tools.ietf.org/html/rfc7591#section-3
+type InitialAccessToken struct {
+	Token string `bson:"token"`
+	//the admin who issued it
+	IssuedBy  string    `bson:"issuedby"`
+	CreatedAt time.Time `bson:"createdat"`
+	ExpiresAt time.Time `bson:"expiresat"`
+}
+
+func (t *InitialAccessToken) IsExpired() bool {
+	return t.ExpiresAt.Before(time.Now())
+}
@@ -0,0 +1,47 @@
+package models
+
+import (
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+//SecretVerifier hashes client secrets for storage and checks the secrets we are given against them
+type SecretVerifier interface {
+	//Hash gives what should be stored for the secret
+	Hash(secret string) (string, error)
+	//Matches is true when the secret is the one the stored hash was made from
+	Matches(hashed, secret string) bool
+	//IsHashed is false when what is stored is still the plaintext secret
+	IsHashed(stored string) bool
+}
+
+//BcryptVerifier is a SecretVerifier using bcrypt at the given cost
+type BcryptVerifier struct {
+	cost int
+}
+
+//NewBcryptVerifier uses bcrypt's default cost when none is given
+func NewBcryptVerifier(cost int) *BcryptVerifier {
+	if cost < bcrypt.MinCost {
+		cost = bcrypt.DefaultCost
+	}
+	return &BcryptVerifier{cost: cost}
+}
+
+func (v *BcryptVerifier) Hash(secret string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(secret), v.cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hashed), nil
+}
+
+func (v *BcryptVerifier) Matches(hashed, secret string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hashed), []byte(secret)) == nil
+}
+
+func (v *BcryptVerifier) IsHashed(stored string) bool {
+	//all bcrypt versions are prefixed $2
+	return strings.HasPrefix(stored, "$2")
+}
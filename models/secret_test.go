@@ -0,0 +1,33 @@
+package models
+
+import (
+	"testing"
+)
+
+func TestBcryptVerifier(t *testing.T) {
+
+	verifier := NewBcryptVerifier(4)
+
+	hashed, err := verifier.Hash("th3S3cret")
+
+	if err != nil {
+		t.Fatalf("there should be no error hashing the secret %s", err.Error())
+	}
+
+	if hashed == "th3S3cret" || verifier.IsHashed(hashed) == false {
+		t.Fatal("the secret should have been hashed")
+	}
+
+	if verifier.Matches(hashed, "th3S3cret") == false {
+		t.Fatal("the secret should match its hash")
+	}
+
+	if verifier.Matches(hashed, "n0tTh3S3cret") {
+		t.Fatal("a different secret should NOT match the hash")
+	}
+
+	if verifier.IsHashed("th3S3cret") {
+		t.Fatal("a plaintext secret should NOT be seen as hashed")
+	}
+
+}
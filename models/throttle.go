@@ -0,0 +1,30 @@
+package models
+
+import "time"
+
+//Throttle counts the failures of something we limit e.g. the logins of a user or the secret guesses for a client.
+//The failures are forgotten once it is past ExpiresAt.
+type Throttle struct {
+	Key           string    `bson:"key"`
+	Failures      int       `bson:"failures"`
+	LastFailureAt time.Time `bson:"lastfailureat"`
+	ExpiresAt     time.Time `bson:"expiresat"`
+}
+
+func (t *Throttle) IsExpired() bool {
+	return t.ExpiresAt.Before(time.Now())
+}
+
+//LockedUntil is when it can be tried again, each failure over the limit doubles the lockout up to the max
+func (t *Throttle) LockedUntil(limit int, lockout, maxLockout time.Duration) time.Time {
+	if t.Failures < limit {
+		return time.Time{}
+	}
+	for i := limit; i < t.Failures && lockout < maxLockout; i++ {
+		lockout *= 2
+	}
+	if lockout > maxLockout {
+		lockout = maxLockout
+	}
+	return t.LastFailureAt.Add(lockout)
+}
@@ -0,0 +1,30 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestThrottle_LockedUntil(t *testing.T) {
+
+	last := time.Now()
+	throttle := &Throttle{Key: "login:user@tidepool.org", LastFailureAt: last, ExpiresAt: last.Add(time.Hour)}
+
+	for failures, lockout := range map[int]time.Duration{
+		0: 0,
+		2: 0,
+		3: time.Minute,
+		4: 2 * time.Minute,
+		5: 4 * time.Minute,
+		8: 10 * time.Minute,
+	} {
+		throttle.Failures = failures
+		until := throttle.LockedUntil(3, time.Minute, 10*time.Minute)
+		if lockout == 0 && until.IsZero() == false {
+			t.Fatalf("%d failures locked out until %v expected no lockout", failures, until)
+		}
+		if lockout > 0 && until.Equal(last.Add(lockout)) == false {
+			t.Fatalf("%d failures locked out for %v expected %v", failures, until.Sub(last), lockout)
+		}
+	}
+}
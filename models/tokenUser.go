@@ -0,0 +1,19 @@
+package models
+
+//TokenUserData is kept with an authorize code and then the tokens issued for it
+type TokenUserData struct {
+	//the tidepool user that authorized the app, or the account the app acts for when it was given the token as itself
+	UserId string `bson:"userid" json:"userid"`
+	//the token was given to the app with its own credentials, no user authorized it
+	ClientCredentials bool `bson:"clientcredentials,omitempty" json:"clientcredentials,omitempty"`
+	//when they logged in to do so
+	AuthTime int64 `bson:"authtime" json:"authtime"`
+	//given by the app when authorizing so it can match the OpenID Connect id_token to its request
+	Nonce string `bson:"nonce,omitempty" json:"nonce,omitempty"`
+}
+
+//GetTokenUserData is nil when the userdata isn't ours e.g. the code or token was issued before we kept it
+func GetTokenUserData(userData interface{}) *TokenUserData {
+	tokenUserData, _ := userData.(*TokenUserData)
+	return tokenUserData
+}